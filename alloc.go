@@ -0,0 +1,282 @@
+// Copyright 2019 The Swarm Authors
+// This file is part of the Swarm library.
+//
+// The Swarm library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The Swarm library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the Swarm library. If not, see <http://www.gnu.org/licenses/>.
+
+package forky
+
+import (
+	"context"
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+// allocator reserves slots of a single bin, so that Puts to the same shard
+// can write chunk data concurrently. New slots are reserved by atomically
+// advancing the end of the file. Free slots remain free offsets in MetaStore
+// until chunk meta is stored, so they are claimed until then to be reserved
+// only once.
+//
+// If data ends are recorded, the end of the file is advanced under growMu,
+// preallocating the file in extents, and recorded before new slots are
+// used.
+type allocator struct {
+	// end is the offset after the last reserved slot, accessed atomically
+	end      int64
+	slotSize int64
+	f        *os.File
+	bin      uint8
+	ends     *dataEnds
+	// extent is the size by which the file is preallocated, if not zero
+	extent int64
+	// allocated is the size of the file, with preallocated extents
+	allocated int64
+	growMu    sync.Mutex
+	claimed   map[int64]struct{}
+	mu        sync.Mutex
+	// lookupMu is held for reading while free offsets are looked up in
+	// MetaStore and for writing while claims are released, as MetaStore
+	// may iterate over a snapshot that still contains released slots
+	lookupMu sync.RWMutex
+}
+
+func newAllocator(f *os.File, bin uint8, slotSize int64, ends *dataEnds, extent int64) (a *allocator, err error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	end := fi.Size()
+	if ends != nil {
+		if e, ok := ends.get(bin); ok {
+			end = e
+		}
+	}
+	// incomplete last slot is overwritten
+	if r := end % slotSize; r != 0 {
+		end += slotSize - r
+	}
+	if ends != nil {
+		if err := ends.set(bin, end); err != nil {
+			return nil, err
+		}
+	}
+	return &allocator{
+		end:       end,
+		slotSize:  slotSize,
+		f:         f,
+		bin:       bin,
+		ends:      ends,
+		extent:    extent,
+		allocated: fi.Size(),
+		claimed:   make(map[int64]struct{}),
+	}, nil
+}
+
+func (a *allocator) reserve(count int) (offset int64, err error) {
+	size := int64(count) * a.slotSize
+	if a.ends == nil {
+		return atomic.AddInt64(&a.end, size) - size, nil
+	}
+
+	a.growMu.Lock()
+	defer a.growMu.Unlock()
+
+	offset = atomic.LoadInt64(&a.end)
+	end := offset + size
+	if a.extent > 0 && end > a.allocated {
+		allocated := end
+		if r := allocated % a.extent; r != 0 {
+			allocated += a.extent - r
+		}
+		if err := fallocate(a.f, a.allocated, allocated-a.allocated); err != nil {
+			return 0, err
+		}
+		a.allocated = allocated
+	}
+	if err := a.ends.set(a.bin, end); err != nil {
+		return 0, err
+	}
+	atomic.StoreInt64(&a.end, end)
+	return offset, nil
+}
+
+func (a *allocator) size() (size int64) {
+	return atomic.LoadInt64(&a.end)
+}
+
+// truncate truncates the file and sets the end of reserved slots. The shard
+// lock must be held exclusively, so that no slots are reserved concurrently.
+func (a *allocator) truncate(size int64) (err error) {
+	a.growMu.Lock()
+	defer a.growMu.Unlock()
+
+	if a.ends != nil {
+		if err := a.ends.set(a.bin, size); err != nil {
+			return err
+		}
+	}
+	if err := a.f.Truncate(size); err != nil {
+		return err
+	}
+	atomic.StoreInt64(&a.end, size)
+	a.allocated = size
+	return nil
+}
+
+func (a *allocator) cover(offset int64) (err error) {
+	a.growMu.Lock()
+	defer a.growMu.Unlock()
+
+	end := offset + a.slotSize
+	if end <= atomic.LoadInt64(&a.end) {
+		return nil
+	}
+	if a.ends != nil {
+		if err := a.ends.set(a.bin, end); err != nil {
+			return err
+		}
+	}
+	atomic.StoreInt64(&a.end, end)
+	return nil
+}
+
+func (a *allocator) claim(offset int64) (ok bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if _, ok := a.claimed[offset]; ok {
+		return false
+	}
+	a.claimed[offset] = struct{}{}
+	return true
+}
+
+func (a *allocator) lookup(fn func() error) (err error) {
+	a.lookupMu.RLock()
+	defer a.lookupMu.RUnlock()
+
+	return fn()
+}
+
+// release ends the claim of the slot, after lookups that may have started
+// before its meta was stored are done.
+func (a *allocator) release(offset int64) {
+	a.lookupMu.Lock()
+	a.mu.Lock()
+	delete(a.claimed, offset)
+	a.mu.Unlock()
+	a.lookupMu.Unlock()
+}
+
+// allocate reserves a slot in the bin, reusing a free slot if there is one.
+// Reclaimed slots must be released with releaseSlot when Put completes.
+func (s *Store) allocate(ctx context.Context, bin uint8) (offset int64, reclaimed bool, err error) {
+	a := s.allocators[bin]
+
+	if s.bitmaps != nil {
+		if slot := s.bitmaps[bin].pop(); slot >= 0 {
+			return slot * a.slotSize, true, nil
+		}
+		offset, err = a.reserve(1)
+		return offset, false, err
+	}
+
+	s.freeMu.RLock()
+	_, hasFree := s.free[bin]
+	s.freeMu.RUnlock()
+	if !hasFree {
+		offset, err = a.reserve(1)
+		return offset, false, err
+	}
+
+	if s.freeCache != nil {
+		for {
+			offset = s.freeCache.pop(bin)
+			if offset < 0 {
+				break
+			}
+			if a.claim(offset) {
+				return offset, true, nil
+			}
+		}
+	}
+	offset = -1
+	if err := a.lookup(func() error {
+		return s.metaContext.IterateFreeOffsetsContext(ctx, bin, func(o int64) (stop bool, err error) {
+			if a.claim(o) {
+				offset = o
+				return true, nil
+			}
+			return false, nil
+		})
+	}); err != nil {
+		return 0, false, err
+	}
+	if offset >= 0 {
+		if s.freeCache != nil {
+			s.freeCache.remove(bin, offset)
+		}
+		return offset, true, nil
+	}
+	s.freeMu.Lock()
+	delete(s.free, bin)
+	s.freeMu.Unlock()
+	offset, err = a.reserve(1)
+	return offset, false, err
+}
+
+func (s *Store) releaseSlot(bin uint8, offset int64, putErr error) (err error) {
+	if putErr != nil {
+		// the slot is made available again even if its header is not cleared
+		err = s.markSlotFree(bin, offset)
+	}
+	if s.bitmaps != nil {
+		if putErr != nil {
+			s.bitmaps[bin].set(offset / s.allocators[bin].slotSize)
+		}
+		return err
+	}
+	s.allocators[bin].release(offset)
+	if putErr == nil {
+		return nil
+	}
+	if s.freeCache != nil {
+		s.freeCache.set(bin, offset)
+	}
+	s.freeMu.Lock()
+	s.free[bin] = struct{}{}
+	s.freeMu.Unlock()
+	return err
+}
+
+func (s *Store) freeSlot(bin uint8, offset int64) (err error) {
+	if err := s.markSlotFree(bin, offset); err != nil {
+		return err
+	}
+	if s.bitmaps != nil {
+		s.bitmaps[bin].set(offset / s.layout.slotSize(bin))
+		return nil
+	}
+	if err := s.meta.SetFreeOffset(bin, offset); err != nil {
+		return err
+	}
+	if s.freeCache != nil {
+		s.freeCache.set(bin, offset)
+	}
+	s.freeMu.Lock()
+	s.free[bin] = struct{}{}
+	s.freeMu.Unlock()
+	return nil
+}
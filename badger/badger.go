@@ -64,6 +64,34 @@ func (s *BadgerStore) Get(addr chunk.Address) (c chunk.Chunk, err error) {
 	return c, err
 }
 
+func (s *BadgerStore) GetMulti(addrs ...chunk.Address) (chunks []chunk.Chunk, errs []error, err error) {
+	chunks = make([]chunk.Chunk, len(addrs))
+	errs = make([]error, len(addrs))
+	err = s.db.View(func(txn *badger.Txn) (err error) {
+		for i, addr := range addrs {
+			item, err := txn.Get(addr)
+			if err != nil {
+				if err == badger.ErrKeyNotFound {
+					err = chunk.ErrChunkNotFound
+				}
+				errs[i] = err
+				continue
+			}
+			data, err := item.ValueCopy(nil)
+			if err != nil {
+				errs[i] = err
+				continue
+			}
+			chunks[i] = chunk.NewChunk(addr, data)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return chunks, errs, nil
+}
+
 func (s *BadgerStore) Has(addr chunk.Address) (yes bool, err error) {
 	yes = false
 	err = s.db.View(func(txn *badger.Txn) (err error) {
@@ -88,6 +116,17 @@ func (s *BadgerStore) Put(ch chunk.Chunk) (err error) {
 	})
 }
 
+func (s *BadgerStore) PutMulti(chunks ...chunk.Chunk) (err error) {
+	return s.db.Update(func(txn *badger.Txn) (err error) {
+		for _, ch := range chunks {
+			if err := txn.Set(ch.Address(), ch.Data()); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
 func (s *BadgerStore) Delete(addr chunk.Address) (err error) {
 	return s.db.Update(func(txn *badger.Txn) (err error) {
 		return txn.Delete(addr)
@@ -24,7 +24,15 @@ import (
 	"github.com/janos/forky"
 )
 
-var _ forky.MetaStore = new(MetaStore)
+var (
+	_ forky.MetaStore         = new(MetaStore)
+	_ forky.BatchMetaStore    = new(MetaStore)
+	_ forky.BatchGetMetaStore = new(MetaStore)
+	_ forky.SyncMetaStore     = new(MetaStore)
+	_ forky.GroupMetaStore    = new(MetaStore)
+	_ forky.BitmapMetaStore   = new(MetaStore)
+	_ forky.RangeMetaStore    = new(MetaStore)
+)
 
 type MetaStore struct {
 	db *badger.DB
@@ -48,6 +56,20 @@ func (s *MetaStore) Get(addr chunk.Address) (m *forky.Meta, err error) {
 	return m, err
 }
 
+func (s *MetaStore) GetBatch(addrs []chunk.Address) (metas []*forky.Meta, err error) {
+	metas = make([]*forky.Meta, len(addrs))
+	err = s.db.View(func(txn *badger.Txn) (err error) {
+		for i, addr := range addrs {
+			metas[i], err = getMeta(txn, chunkKey(addr))
+			if err != nil && err != chunk.ErrChunkNotFound {
+				return err
+			}
+		}
+		return nil
+	})
+	return metas, err
+}
+
 func (s *MetaStore) Set(addr chunk.Address, shard uint8, reclaimed bool, m *forky.Meta) (err error) {
 	meta, err := m.MarshalBinary()
 	if err != nil {
@@ -64,6 +86,69 @@ func (s *MetaStore) Set(addr chunk.Address, shard uint8, reclaimed bool, m *fork
 	})
 }
 
+func (s *MetaStore) SetBatch(entries []forky.MetaEntry) (err error) {
+	return s.db.Update(func(txn *badger.Txn) (err error) {
+		for _, e := range entries {
+			if e.Reclaimed {
+				err = txn.Delete(freeKey(e.Shard, e.Meta.Offset))
+				if err != nil {
+					return err
+				}
+			}
+			meta, err := e.Meta.MarshalBinary()
+			if err != nil {
+				return err
+			}
+			if err := txn.Set(chunkKey(e.Address), meta); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// WriteGroup applies all writes in a single transaction, so that the group
+// is stored atomically. It returns badger.ErrTxnTooBig if the group does not
+// fit into one transaction.
+func (s *MetaStore) WriteGroup(writes []forky.MetaWrite) (err error) {
+	return s.db.Update(func(txn *badger.Txn) (err error) {
+		for _, w := range writes {
+			if err := writeGroupEntry(txn, w); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// writeGroupEntry applies a single write of the group. Meta of removed
+// chunks includes meta set by earlier writes in the same transaction.
+func writeGroupEntry(txn *badger.Txn, w forky.MetaWrite) (err error) {
+	if w.Remove {
+		key := chunkKey(w.Address)
+		m, err := getMeta(txn, key)
+		if err != nil {
+			return err
+		}
+		if !w.NoFreeOffset {
+			if err := txn.Set(freeKey(w.Shard, m.Offset), nil); err != nil {
+				return err
+			}
+		}
+		return txn.Delete(key)
+	}
+	if w.Reclaimed {
+		if err := txn.Delete(freeKey(w.Shard, w.Meta.Offset)); err != nil {
+			return err
+		}
+	}
+	meta, err := w.Meta.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	return txn.Set(chunkKey(w.Address), meta)
+}
+
 func (s *MetaStore) FreeOffset(shard uint8) (offset int64, err error) {
 	offset = -1
 	err = s.db.View(func(txn *badger.Txn) (err error) {
@@ -82,12 +167,42 @@ func (s *MetaStore) FreeOffset(shard uint8) (offset int64, err error) {
 		if key == nil {
 			return nil
 		}
-		offset = int64(binary.BigEndian.Uint64(key[1:9]))
+		offset = int64(binary.BigEndian.Uint64(key[2:10]))
 		return err
 	})
 	return offset, err
 }
 
+func (s *MetaStore) SetFreeOffset(shard uint8, offset int64) (err error) {
+	return s.db.Update(func(txn *badger.Txn) (err error) {
+		return txn.Set(freeKey(shard, offset), nil)
+	})
+}
+
+func (s *MetaStore) RemoveFreeOffset(shard uint8, offset int64) (err error) {
+	return s.db.Update(func(txn *badger.Txn) (err error) {
+		return txn.Delete(freeKey(shard, offset))
+	})
+}
+
+func (s *MetaStore) IterateFreeOffsets(shard uint8, fn func(offset int64) (stop bool, err error)) (err error) {
+	return s.db.View(func(txn *badger.Txn) (err error) {
+		i := txn.NewIterator(badger.IteratorOptions{})
+		defer i.Close()
+		prefix := []byte{freePrefix, shard}
+		for i.Seek(prefix); i.ValidForPrefix(prefix); i.Next() {
+			stop, err := fn(int64(binary.BigEndian.Uint64(i.Item().Key()[2:10])))
+			if err != nil {
+				return err
+			}
+			if stop {
+				return nil
+			}
+		}
+		return nil
+	})
+}
+
 func (s *MetaStore) Remove(addr chunk.Address, shard uint8) (err error) {
 	return s.db.Update(func(txn *badger.Txn) (err error) {
 		key := chunkKey(addr)
@@ -103,6 +218,16 @@ func (s *MetaStore) Remove(addr chunk.Address, shard uint8) (err error) {
 	})
 }
 
+func (s *MetaStore) RemoveMeta(addr chunk.Address) (err error) {
+	return s.db.Update(func(txn *badger.Txn) (err error) {
+		key := chunkKey(addr)
+		if _, err := getMeta(txn, key); err != nil {
+			return err
+		}
+		return txn.Delete(key)
+	})
+}
+
 func (s *MetaStore) Count() (count int, err error) {
 	err = s.db.View(func(txn *badger.Txn) (err error) {
 		i := txn.NewIterator(badger.IteratorOptions{})
@@ -160,6 +285,37 @@ func (s *MetaStore) Iterate(fn func(chunk.Address, *forky.Meta) (stop bool, err
 	})
 }
 
+func (s *MetaStore) IterateFrom(start chunk.Address, fn func(chunk.Address, *forky.Meta) (stop bool, err error)) (err error) {
+	return s.db.View(func(txn *badger.Txn) (err error) {
+		i := txn.NewIterator(badger.IteratorOptions{})
+		defer i.Close()
+		prefix := []byte{chunkPrefix}
+		for i.Seek(chunkKey(start)); i.ValidForPrefix(prefix); i.Next() {
+			item := i.Item()
+			v, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			m := new(forky.Meta)
+			if err := m.UnmarshalBinary(v); err != nil {
+				return err
+			}
+			stop, err := fn(chunk.Address(item.Key()[1:]), m)
+			if err != nil {
+				return err
+			}
+			if stop {
+				return nil
+			}
+		}
+		return nil
+	})
+}
+
+func (s *MetaStore) Sync() (err error) {
+	return s.db.Sync()
+}
+
 func (s *MetaStore) Close() (err error) {
 	return s.db.Close()
 }
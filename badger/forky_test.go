@@ -18,9 +18,11 @@ package badger_test
 
 import (
 	"io/ioutil"
+	"os"
 	"path/filepath"
 	"testing"
 
+	"github.com/ethersphere/swarm/chunk"
 	"github.com/janos/forky"
 	"github.com/janos/forky/badger"
 	"github.com/janos/forky/test"
@@ -28,16 +30,111 @@ import (
 
 func TestBadgerForky(t *testing.T) {
 	test.StoreSuite(t, func(t *testing.T) (forky.Interface, func()) {
-		path, err := ioutil.TempDir("", "swarm-forky-")
-		if err != nil {
-			t.Fatal(err)
-		}
+		return newForkyStore(t)
+	})
+}
+
+func TestBadgerRangeMetaStore(t *testing.T) {
+	path, err := ioutil.TempDir("", "swarm-forky-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(path)
+
+	metaStore, err := badger.NewMetaStore(filepath.Join(path, "meta"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer metaStore.Close()
+
+	test.RangeMetaStoreSuite(t, metaStore)
+}
+
+// TestMetaStoreWriteGroup validates that a group of writes is applied
+// atomically and that removes see meta set earlier in the group.
+func TestMetaStoreWriteGroup(t *testing.T) {
+	path, err := ioutil.TempDir("", "swarm-forky-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(path)
+
+	s, err := badger.NewMetaStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
 
-		metaStore, err := badger.NewMetaStore(filepath.Join(path, "meta"))
-		if err != nil {
-			t.Fatal(err)
+	removed := test.GenerateTestRandomChunk().Address()
+	stored := test.GenerateTestRandomChunk().Address()
+	set := func(addr chunk.Address, offset int64) forky.MetaWrite {
+		return forky.MetaWrite{
+			MetaEntry: forky.MetaEntry{
+				Address: addr,
+				Meta:    &forky.Meta{Size: 10, Offset: offset},
+			},
 		}
+	}
+	remove := func(addr chunk.Address) forky.MetaWrite {
+		return forky.MetaWrite{
+			MetaEntry: forky.MetaEntry{
+				Address: addr,
+			},
+			Remove: true,
+		}
+	}
+
+	err = s.WriteGroup([]forky.MetaWrite{
+		set(stored, 0),
+		remove(test.GenerateTestRandomChunk().Address()),
+	})
+	if err != chunk.ErrChunkNotFound {
+		t.Fatalf("got error %v, want %v", err, chunk.ErrChunkNotFound)
+	}
+	if _, err := s.Get(stored); err != chunk.ErrChunkNotFound {
+		t.Fatalf("got error %v for the write of a failed group, want %v", err, chunk.ErrChunkNotFound)
+	}
+
+	if err := s.WriteGroup([]forky.MetaWrite{
+		set(removed, 4096),
+		remove(removed),
+		set(stored, 0),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Get(removed); err != chunk.ErrChunkNotFound {
+		t.Errorf("got error %v, want %v", err, chunk.ErrChunkNotFound)
+	}
+	if m, err := s.Get(stored); err != nil {
+		t.Error(err)
+	} else if m.Offset != 0 {
+		t.Errorf("got offset %v, want 0", m.Offset)
+	}
+	offset, err := s.FreeOffset(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if offset != 4096 {
+		t.Errorf("got free offset %v, want 4096", offset)
+	}
+}
 
-		return test.NewForkyStore(t, path, metaStore)
+func BenchmarkBadgerForky(b *testing.B) {
+	test.StoreBenchmarkSuite(b, func(b *testing.B) (forky.Interface, func()) {
+		return newForkyStore(b)
 	})
 }
+
+func newForkyStore(t testing.TB) (s *forky.Store, clean func()) {
+	path, err := ioutil.TempDir("", "swarm-forky-")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	metaStore, err := badger.NewMetaStore(filepath.Join(path, "meta"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return test.NewForkyStore(t, path, metaStore)
+}
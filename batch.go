@@ -0,0 +1,503 @@
+// Copyright 2019 The Swarm Authors
+// This file is part of the Swarm library.
+//
+// The Swarm library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The Swarm library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the Swarm library. If not, see <http://www.gnu.org/licenses/>.
+
+package forky
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/ethersphere/swarm/chunk"
+)
+
+// MetaEntry holds arguments of a single MetaStore Set call.
+type MetaEntry struct {
+	Address   chunk.Address
+	Shard     uint8
+	Reclaimed bool
+	Meta      *Meta
+}
+
+// BatchMetaStore is an optional MetaStore extension that sets meta of
+// multiple chunks atomically. If MetaStore does not implement it, PutMulti
+// sets chunk meta one by one.
+type BatchMetaStore interface {
+	SetBatch(entries []MetaEntry) error
+}
+
+// batchSlot is a slot allocated for a chunk by PutMulti.
+type batchSlot struct {
+	ch        chunk.Chunk
+	bin       uint8
+	meta      *Meta
+	reclaimed bool
+	reserved  bool
+	// stored is true when chunk meta is set, after which the slot must
+	// not be freed even if PutMulti fails
+	stored    bool
+	addFilter bool
+}
+
+// PutMulti stores multiple chunks. Chunks are grouped by shard files, their
+// slots are allocated from free slots first and then at the end of the files,
+// and data of slots with consecutive offsets are written with a single
+// call. All involved shards are locked for reading until chunk meta is
+// stored, which is done atomically if MetaStore implements BatchMetaStore.
+// Nothing is written if any of the chunks is not valid. Chunks with the
+// same address are stored once.
+func (s *Store) PutMulti(chunks ...chunk.Chunk) (err error) {
+	return s.PutMultiContext(context.Background(), chunks...)
+}
+
+// PutMultiContext stores multiple chunks as PutMulti does. The context is
+// honoured only until slots for all chunks are allocated.
+func (s *Store) PutMultiContext(ctx context.Context, chunks ...chunk.Chunk) (err error) {
+	done, err := s.protect()
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	slots := make([]*batchSlot, 0, len(chunks))
+	bins := make(map[uint8][]*batchSlot)
+	shards := make(map[uint8]struct{})
+	seen := make(map[string]struct{}, len(chunks))
+	for _, ch := range chunks {
+		data := ch.Data()
+		if len(data) > s.maxChunkSize {
+			return &InvalidChunkError{
+				Address: ch.Address(),
+				Err:     fmt.Errorf("data size %v exceeds maximal chunk size %v", len(data), s.maxChunkSize),
+			}
+		}
+		if err := s.validate(ch); err != nil {
+			return err
+		}
+		if s.slotFormat == SlotFormatHeader && len(ch.Address()) > maxHeaderAddressLength {
+			return errAddressTooLong
+		}
+		if _, ok := seen[string(ch.Address())]; ok {
+			continue
+		}
+		seen[string(ch.Address())] = struct{}{}
+		shard := s.getShard(ch.Address())
+		slot := &batchSlot{
+			ch:  ch,
+			bin: s.layout.bin(shard, len(data)),
+			meta: &Meta{
+				Size:     uint16(len(data)),
+				Checksum: checksum(data),
+			},
+		}
+		slots = append(slots, slot)
+		bins[slot.bin] = append(bins[slot.bin], slot)
+		shards[shard] = struct{}{}
+	}
+
+	// lock shards in the same order as Iterate to avoid deadlocks
+	locked := make([]uint8, 0, len(shards))
+	for shard := range shards {
+		locked = append(locked, shard)
+	}
+	sort.Slice(locked, func(i, j int) bool { return locked[i] < locked[j] })
+	for i, shard := range locked {
+		if err := s.shardsMu[shard].RLockContext(ctx); err != nil {
+			locked = locked[:i]
+			for _, shard := range locked {
+				s.shardsMu[shard].RUnlock()
+			}
+			return err
+		}
+	}
+	defer func() {
+		for _, shard := range locked {
+			s.shardsMu[shard].RUnlock()
+		}
+	}()
+
+	for _, slot := range slots {
+		slot.addFilter, err = s.filterAdd(ctx, slot.ch.Address())
+		if err != nil {
+			return err
+		}
+	}
+	var journalID uint64
+	defer func() {
+		err = s.endPutMulti(journalID, slots, err)
+	}()
+	for bin, binSlots := range bins {
+		if err := s.allocateBatch(ctx, bin, binSlots); err != nil {
+			return err
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if s.journal != nil {
+		records := make([]*journalRecord, len(slots))
+		for i, slot := range slots {
+			records[i] = &journalRecord{
+				typ:       journalPut,
+				shard:     slot.bin,
+				reclaimed: slot.reclaimed,
+				meta:      *slot.meta,
+				addr:      slot.ch.Address(),
+			}
+		}
+		journalID, err = s.journal.begin(records...)
+		if err != nil {
+			return err
+		}
+	}
+
+	for bin, binSlots := range bins {
+		if err := s.writeBatch(bin, binSlots); err != nil {
+			return err
+		}
+	}
+	syncBatch := s.syncMode == SyncAlways || s.syncMode == SyncBatch
+	if syncBatch {
+		for bin := range bins {
+			if err := s.syncBin(bin); err != nil {
+				return err
+			}
+		}
+	}
+
+	entries := make([]MetaEntry, len(slots))
+	for i, slot := range slots {
+		if c := s.compactions[slot.bin]; c != nil {
+			c.used(slot.meta.Offset, slot.ch.Address())
+		}
+		entries[i] = MetaEntry{
+			Address:   slot.ch.Address(),
+			Shard:     slot.bin,
+			Reclaimed: s.metaReclaimed(slot.reclaimed),
+			Meta:      slot.meta,
+		}
+	}
+	if s.committer != nil {
+		if err := s.committer.setBatch(entries); err != nil {
+			return err
+		}
+		for _, slot := range slots {
+			s.slotStored(slot)
+		}
+		if s.syncMode == SyncBatch {
+			// the committer syncs MetaStore only in SyncAlways mode
+			return s.syncMeta()
+		}
+		return nil
+	}
+	if b, ok := s.meta.(BatchMetaStore); ok {
+		if err := b.SetBatch(entries); err != nil {
+			return err
+		}
+		for _, slot := range slots {
+			s.slotStored(slot)
+		}
+	} else {
+		for i, e := range entries {
+			if err := s.meta.Set(e.Address, e.Shard, e.Reclaimed, e.Meta); err != nil {
+				return err
+			}
+			s.slotStored(slots[i])
+		}
+	}
+	if syncBatch {
+		return s.syncMeta()
+	}
+	return nil
+}
+
+// slotStored records that meta of the slot chunk is set in MetaStore and
+// adds it to the cache and the filter.
+func (s *Store) slotStored(slot *batchSlot) {
+	slot.stored = true
+	if s.metaCache != nil {
+		s.metaCache.set(slot.ch.Address(), slot.meta)
+	}
+	if slot.addFilter {
+		s.filter.add(slot.ch.Address())
+	}
+}
+
+// endPutMulti completes the journal intent of the PutMulti method and ends
+// claims of reclaimed slots. If PutMulti failed, slots of chunks without
+// stored meta are made available again.
+func (s *Store) endPutMulti(journalID uint64, slots []*batchSlot, putErr error) (err error) {
+	var freeErr error
+	for _, slot := range slots {
+		var slotErr error
+		if !slot.stored {
+			slotErr = putErr
+		}
+		if slot.reclaimed {
+			if err := s.releaseSlot(slot.bin, slot.meta.Offset, slotErr); err != nil {
+				freeErr = err
+			}
+			continue
+		}
+		if slot.reserved && slotErr != nil {
+			if err := s.freeSlot(slot.bin, slot.meta.Offset); err != nil {
+				freeErr = err
+			}
+		}
+	}
+	if journalID != 0 {
+		if err := s.journal.done(journalID); err != nil && putErr == nil {
+			return err
+		}
+	}
+	if freeErr != nil {
+		return freeErr
+	}
+	return putErr
+}
+
+func (s *Store) allocateBatch(ctx context.Context, bin uint8, slots []*batchSlot) (err error) {
+	a := s.allocators[bin]
+
+	s.freeMu.RLock()
+	_, hasFree := s.free[bin]
+	s.freeMu.RUnlock()
+
+	var i int
+	if s.bitmaps != nil {
+		for ; i < len(slots); i++ {
+			slot := s.bitmaps[bin].pop()
+			if slot < 0 {
+				break
+			}
+			slots[i].meta.Offset = slot * a.slotSize
+			slots[i].reclaimed = true
+		}
+	} else if hasFree {
+		if err := a.lookup(func() error {
+			return s.metaContext.IterateFreeOffsetsContext(ctx, bin, func(offset int64) (stop bool, err error) {
+				if !a.claim(offset) {
+					return false, nil
+				}
+				slots[i].meta.Offset = offset
+				slots[i].reclaimed = true
+				if s.freeCache != nil {
+					s.freeCache.remove(bin, offset)
+				}
+				i++
+				return i == len(slots), nil
+			})
+		}); err != nil {
+			return err
+		}
+		if i < len(slots) {
+			s.freeMu.Lock()
+			delete(s.free, bin)
+			s.freeMu.Unlock()
+		}
+	}
+	if i == len(slots) {
+		return nil
+	}
+	end, err := a.reserve(len(slots) - i)
+	if err != nil {
+		return err
+	}
+	for _, slot := range slots[i:] {
+		slot.meta.Offset = end
+		slot.reserved = true
+		end += s.layout.slotSize(bin)
+	}
+	return nil
+}
+
+func (s *Store) writeBatch(bin uint8, slots []*batchSlot) (err error) {
+	sort.Slice(slots, func(i, j int) bool { return slots[i].meta.Offset < slots[j].meta.Offset })
+	slotSize := s.layout.slotSize(bin)
+	headerSize := s.slotFormat.headerSize()
+	for start := 0; start < len(slots); {
+		end := start + 1
+		for end < len(slots) && slots[end].meta.Offset == slots[end-1].meta.Offset+slotSize {
+			end++
+		}
+		buf := s.buffer(int(int64(end-start) * slotSize))
+		for i, slot := range slots[start:end] {
+			section := buf[int64(i)*slotSize : int64(i+1)*slotSize]
+			if s.slotFormat == SlotFormatHeader {
+				header, err := (&slotHeader{
+					flags: slotFlagUsed,
+					addr:  slot.ch.Address(),
+					size:  slot.meta.Size,
+					sum:   slot.meta.Checksum,
+				}).MarshalBinary()
+				if err != nil {
+					return err
+				}
+				copy(section, header)
+			}
+			copy(section[headerSize:], slot.ch.Data())
+		}
+		if _, err := s.shards[bin].WriteAt(buf, slots[start].meta.Offset); err != nil {
+			return err
+		}
+		start = end
+	}
+	return nil
+}
+
+// BatchGetMetaStore is an optional MetaStore extension that gets meta of
+// multiple chunks in a single call. Meta of chunks that are not found must
+// be nil. If MetaStore does not implement it, GetMulti gets chunk meta one
+// by one.
+type BatchGetMetaStore interface {
+	GetBatch(addrs []chunk.Address) (metas []*Meta, err error)
+}
+
+// GetMulti returns chunks with provided addresses, in the same order. Errors
+// for chunks that can not be returned, including chunk.ErrChunkNotFound, are
+// returned at the same index in errs, while err is returned only if chunks
+// can not be retrieved at all. Chunk meta is looked up for all addresses of
+// a shard together and shards are read in parallel, with chunks ordered by
+// their offsets.
+func (s *Store) GetMulti(addrs ...chunk.Address) (chunks []chunk.Chunk, errs []error, err error) {
+	return s.GetMultiContext(context.Background(), addrs...)
+}
+
+// GetMultiContext returns chunks as GetMulti does, or the context error if
+// the context is done before all chunks are read.
+func (s *Store) GetMultiContext(ctx context.Context, addrs ...chunk.Address) (chunks []chunk.Chunk, errs []error, err error) {
+	done, err := s.protect()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer done()
+
+	chunks = make([]chunk.Chunk, len(addrs))
+	errs = make([]error, len(addrs))
+	shards := make(map[uint8][]int)
+	for i, addr := range addrs {
+		shard := s.getShard(addr)
+		shards[shard] = append(shards[shard], i)
+	}
+	errC := make(chan error, len(shards))
+	var wg sync.WaitGroup
+	for shard, indexes := range shards {
+		wg.Add(1)
+		go func(shard uint8, indexes []int) {
+			defer wg.Done()
+
+			if err := s.getShardMulti(ctx, shard, addrs, indexes, chunks, errs); err != nil {
+				errC <- err
+			}
+		}(shard, indexes)
+	}
+	wg.Wait()
+	close(errC)
+	if err := <-errC; err != nil {
+		return nil, nil, err
+	}
+	return chunks, errs, nil
+}
+
+func (s *Store) getShardMulti(ctx context.Context, shard uint8, addrs []chunk.Address, indexes []int, chunks []chunk.Chunk, errs []error) (err error) {
+	mu := s.shardsMu[shard]
+	if err := mu.RLockContext(ctx); err != nil {
+		return err
+	}
+	defer mu.RUnlock()
+
+	shardAddrs := make([]chunk.Address, len(indexes))
+	for i, index := range indexes {
+		shardAddrs[i] = addrs[index]
+	}
+	metas, err := s.getMetaMulti(ctx, shardAddrs)
+	if err != nil {
+		return err
+	}
+	order := make([]int, 0, len(indexes))
+	for i, m := range metas {
+		if m == nil {
+			errs[indexes[i]] = chunk.ErrChunkNotFound
+			continue
+		}
+		order = append(order, i)
+	}
+	sort.Slice(order, func(i, j int) bool { return metas[order[i]].Offset < metas[order[j]].Offset })
+	for _, i := range order {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		chunks[indexes[i]], errs[indexes[i]] = s.readChunk(shard, shardAddrs[i], metas[i])
+	}
+	return nil
+}
+
+func (s *Store) getMetaMulti(ctx context.Context, addrs []chunk.Address) (metas []*Meta, err error) {
+	metas = make([]*Meta, len(addrs))
+	missing := make([]int, 0, len(addrs))
+	for i, addr := range addrs {
+		if s.metaCache != nil {
+			if m := s.metaCache.get(addr); m != nil {
+				metas[i] = m
+				continue
+			}
+		}
+		if s.filter != nil && !s.filter.contains(addr) {
+			continue
+		}
+		missing = append(missing, i)
+	}
+	if len(missing) == 0 {
+		return metas, nil
+	}
+	if b, ok := s.meta.(BatchGetMetaStore); ok {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		missingAddrs := make([]chunk.Address, len(missing))
+		for i, index := range missing {
+			missingAddrs[i] = addrs[index]
+		}
+		ms, err := b.GetBatch(missingAddrs)
+		if err != nil {
+			return nil, err
+		}
+		for i, index := range missing {
+			metas[index] = ms[i]
+		}
+	} else {
+		for _, index := range missing {
+			m, err := s.metaContext.GetContext(ctx, addrs[index])
+			if err != nil {
+				if err == chunk.ErrChunkNotFound {
+					continue
+				}
+				return nil, err
+			}
+			metas[index] = m
+		}
+	}
+	if s.metaCache != nil {
+		for _, index := range missing {
+			if metas[index] != nil {
+				s.metaCache.set(addrs[index], metas[index])
+			}
+		}
+	}
+	return metas, nil
+}
@@ -0,0 +1,253 @@
+// Copyright 2019 The Swarm Authors
+// This file is part of the Swarm library.
+//
+// The Swarm library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The Swarm library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the Swarm library. If not, see <http://www.gnu.org/licenses/>.
+
+package forky_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ethersphere/swarm/chunk"
+	"github.com/janos/forky"
+	"github.com/janos/forky/mem"
+	"github.com/janos/forky/test"
+)
+
+func TestStoreGetMulti(t *testing.T) {
+	s, _, clean := newTestStore(t, chunk.DefaultSize, &forky.Options{
+		ShardCount: 4,
+	})
+	defer clean()
+
+	chunks := make([]chunk.Chunk, 20)
+	for i := range chunks {
+		chunks[i] = test.GenerateTestRandomChunk()
+		if err := s.Put(chunks[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	missing := test.GenerateTestRandomChunk()
+
+	// addresses from all shards in reverse order of their offsets, with
+	// duplicates and missing chunks
+	var want []chunk.Chunk
+	for i := len(chunks) - 1; i >= 0; i-- {
+		want = append(want, chunks[i])
+		if i%5 == 0 {
+			want = append(want, chunks[i], missing)
+		}
+	}
+	want = append(want, chunks[len(chunks)-1])
+	addrs := make([]chunk.Address, len(want))
+	for i, ch := range want {
+		addrs[i] = ch.Address()
+	}
+
+	got, errs, err := s.GetMulti(addrs...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(addrs) || len(errs) != len(addrs) {
+		t.Fatalf("got %v chunks and %v errors, want %v", len(got), len(errs), len(addrs))
+	}
+	for i, ch := range want {
+		if ch == missing {
+			if errs[i] != chunk.ErrChunkNotFound {
+				t.Errorf("got error %v at index %v, want %v", errs[i], i, chunk.ErrChunkNotFound)
+			}
+			if got[i] != nil {
+				t.Errorf("got chunk %s at index %v of missing chunk", got[i].Address(), i)
+			}
+			continue
+		}
+		if errs[i] != nil {
+			t.Fatalf("got error %v at index %v", errs[i], i)
+		}
+		if !bytes.Equal(got[i].Address(), ch.Address()) {
+			t.Errorf("got chunk %s at index %v, want %s", got[i].Address(), i, ch.Address())
+		}
+		if !bytes.Equal(got[i].Data(), ch.Data()) {
+			t.Errorf("got chunk %s data at index %v %x, want %x", ch.Address(), i, got[i].Data(), ch.Data())
+		}
+	}
+}
+
+func TestStorePutMulti(t *testing.T) {
+	path, err := ioutil.TempDir("", "swarm-forky-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(path)
+
+	o := &forky.Options{
+		ShardCount: 1,
+		SlotFormat: forky.SlotFormatHeader,
+	}
+	metaStore := mem.NewMetaStore()
+	s, err := forky.NewStore(path, chunk.DefaultSize, metaStore, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	chunks := make([]chunk.Chunk, 20)
+	for i := range chunks {
+		chunks[i] = test.GenerateTestRandomChunk()
+	}
+	if err := s.PutMulti(chunks...); err != nil {
+		t.Fatal(err)
+	}
+	for _, ch := range chunks[:5] {
+		if err := s.Delete(ch.Address()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	chunks = chunks[5:]
+
+	// free slots are reused before the file is extended
+	batch := make([]chunk.Chunk, 15)
+	for i := range batch {
+		batch[i] = test.GenerateTestRandomChunk()
+	}
+	if err := s.PutMulti(batch...); err != nil {
+		t.Fatal(err)
+	}
+	chunks = append(chunks, batch...)
+
+	for _, ch := range chunks {
+		got, err := s.Get(ch.Address())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got.Data(), ch.Data()) {
+			t.Fatalf("got chunk %s data %x, want %x", ch.Address(), got.Data(), ch.Data())
+		}
+	}
+	fi, err := os.Stat(filepath.Join(path, "chunks-0.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := int64(len(chunks)) * s.Manifest().SlotSize; fi.Size() != want {
+		t.Errorf("got shard file size %v, want %v", fi.Size(), want)
+	}
+
+	// invalid chunk rejects the whole batch
+	invalid := chunk.NewChunk(test.GenerateTestRandomChunk().Address(), make([]byte, chunk.DefaultSize+1))
+	valid := test.GenerateTestRandomChunk()
+	if err := s.PutMulti(valid, invalid); err == nil {
+		t.Error("got no error for invalid chunk")
+	}
+	if _, err := s.Get(valid.Address()); err != chunk.ErrChunkNotFound {
+		t.Errorf("got error %v, want %v", err, chunk.ErrChunkNotFound)
+	}
+
+	// the same chunk is stored only once
+	dup := test.GenerateTestRandomChunk()
+	if err := s.PutMulti(dup, dup); err != nil {
+		t.Fatal(err)
+	}
+	chunks = append(chunks, dup)
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := forky.Check(path, chunk.DefaultSize, metaStore, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Problems) != 0 || r.Chunks != len(chunks) || r.FreeSlots != 0 {
+		t.Errorf("got check report %+v", r)
+	}
+}
+
+// TestStorePutMultiRollback validates that slots reserved by PutMulti that
+// failed to store chunk meta are reused.
+func TestStorePutMultiRollback(t *testing.T) {
+	path, err := ioutil.TempDir("", "swarm-forky-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(path)
+
+	o := &forky.Options{
+		ShardCount: 1,
+		SlotFormat: forky.SlotFormatHeader,
+	}
+	metaStore := mem.NewMetaStore()
+	failing := &failingMetaStore{
+		MetaStore: metaStore,
+	}
+	s, err := forky.NewStore(path, chunk.DefaultSize, failing, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	chunks := []chunk.Chunk{test.GenerateTestRandomChunk()}
+	if err := s.Put(chunks[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	failing.fail = true
+	batch := make([]chunk.Chunk, 3)
+	for i := range batch {
+		batch[i] = test.GenerateTestRandomChunk()
+	}
+	if err := s.PutMulti(batch...); err != errFailingMetaStore {
+		t.Fatalf("got error %v, want %v", err, errFailingMetaStore)
+	}
+	failing.fail = false
+	failed := append([]chunk.Chunk(nil), batch...)
+
+	for i := range batch {
+		batch[i] = test.GenerateTestRandomChunk()
+	}
+	if err := s.PutMulti(batch...); err != nil {
+		t.Fatal(err)
+	}
+	chunks = append(chunks, batch...)
+	for _, ch := range failed {
+		has, err := s.Has(ch.Address())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if has {
+			t.Errorf("failed chunk %s found", ch.Address())
+		}
+	}
+
+	fi, err := os.Stat(filepath.Join(path, "chunks-0.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := int64(len(chunks)) * s.Manifest().SlotSize; fi.Size() != want {
+		t.Errorf("got shard file size %v, want %v", fi.Size(), want)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := forky.Check(path, chunk.DefaultSize, metaStore, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Problems) != 0 || r.Chunks != len(chunks) || r.FreeSlots != 0 {
+		t.Errorf("got check report %+v", r)
+	}
+}
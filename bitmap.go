@@ -0,0 +1,372 @@
+// Copyright 2019 The Swarm Authors
+// This file is part of the Swarm library.
+//
+// The Swarm library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The Swarm library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the Swarm library. If not, see <http://www.gnu.org/licenses/>.
+
+package forky
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"math/bits"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/ethersphere/swarm/chunk"
+)
+
+// BitmapMetaStore is an optional MetaStore extension that removes chunk meta
+// without storing its slot as a free offset, as free slots are kept in the
+// free bitmap with Options.FreeBitmap. If MetaStore does not implement it,
+// the free offset is removed after Remove.
+type BitmapMetaStore interface {
+	RemoveMeta(addr chunk.Address) error
+}
+
+// freeBitmapFilename is the name of the file with free bitmaps of all bins.
+const freeBitmapFilename = "free.db"
+
+// States of the free bitmap file. Bitmaps are written in the clean state
+// only on Close, and the file is in the dirty state while the store is
+// open, so that bitmaps are rebuilt from chunk meta if the store is not
+// closed properly.
+const (
+	freeBitmapDirty byte = iota
+	freeBitmapClean
+)
+
+// freeBitmap keeps free slots of a single bin, with a bit set for every free
+// slot, so that the lowest free slot is found in constant time on average.
+type freeBitmap struct {
+	words []uint64
+	count int
+	// first is the index of the first word that may have a set bit
+	first int
+	mu    sync.Mutex
+}
+
+func newFreeBitmap() (b *freeBitmap) {
+	return new(freeBitmap)
+}
+
+func (b *freeBitmap) set(slot int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	i := int(slot / 64)
+	for len(b.words) <= i {
+		b.words = append(b.words, 0)
+	}
+	mask := uint64(1) << uint(slot%64)
+	if b.words[i]&mask != 0 {
+		return
+	}
+	b.words[i] |= mask
+	b.count++
+	if i < b.first {
+		b.first = i
+	}
+}
+
+func (b *freeBitmap) clear(slot int64) (ok bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	i := int(slot / 64)
+	if i >= len(b.words) {
+		return false
+	}
+	mask := uint64(1) << uint(slot%64)
+	if b.words[i]&mask == 0 {
+		return false
+	}
+	b.words[i] &^= mask
+	b.count--
+	return true
+}
+
+func (b *freeBitmap) pop() (slot int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.count == 0 {
+		return -1
+	}
+	for i := b.first; i < len(b.words); i++ {
+		if w := b.words[i]; w != 0 {
+			n := bits.TrailingZeros64(w)
+			b.words[i] &^= uint64(1) << uint(n)
+			b.count--
+			b.first = i
+			return int64(i)*64 + int64(n)
+		}
+	}
+	return -1
+}
+
+func (b *freeBitmap) len() (count int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.count
+}
+
+func (b *freeBitmap) slots() (slots []int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	slots = make([]int64, 0, b.count)
+	for i := b.first; i < len(b.words); i++ {
+		for w := b.words[i]; w != 0; w &= w - 1 {
+			slots = append(slots, int64(i)*64+int64(bits.TrailingZeros64(w)))
+		}
+	}
+	return slots
+}
+
+func writeFreeBitmaps(path string, bitmaps []*freeBitmap, state byte) (err error) {
+	filename := filepath.Join(path, freeBitmapFilename)
+	f, err := os.Create(filename + ".tmp")
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	b := make([]byte, 8)
+	if err := w.WriteByte(state); err != nil {
+		f.Close()
+		return err
+	}
+	for _, bitmap := range bitmaps {
+		bitmap.mu.Lock()
+		binary.BigEndian.PutUint64(b, uint64(len(bitmap.words)))
+		_, err := w.Write(b)
+		for _, word := range bitmap.words {
+			if err != nil {
+				break
+			}
+			binary.BigEndian.PutUint64(b, word)
+			_, err = w.Write(b)
+		}
+		bitmap.mu.Unlock()
+		if err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(filename+".tmp", filename)
+}
+
+// readFreeBitmaps reads bitmaps of all bins from the free bitmap file. It
+// returns nil bitmaps if the file is not in the clean state or it does not
+// contain bitmaps for all bins, in which case they must be rebuilt.
+func readFreeBitmaps(path string, binCount int) (bitmaps []*freeBitmap, err error) {
+	f, err := os.Open(filepath.Join(path, freeBitmapFilename))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	state, err := r.ReadByte()
+	if err != nil {
+		if err == io.EOF {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if state != freeBitmapClean {
+		return nil, nil
+	}
+	b := make([]byte, 8)
+	for i := 0; i < binCount; i++ {
+		if _, err := io.ReadFull(r, b); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return nil, nil
+			}
+			return nil, err
+		}
+		bitmap := newFreeBitmap()
+		bitmap.words = make([]uint64, binary.BigEndian.Uint64(b))
+		for j := range bitmap.words {
+			if _, err := io.ReadFull(r, b); err != nil {
+				if err == io.EOF || err == io.ErrUnexpectedEOF {
+					return nil, nil
+				}
+				return nil, err
+			}
+			bitmap.words[j] = binary.BigEndian.Uint64(b)
+			bitmap.count += bits.OnesCount64(bitmap.words[j])
+		}
+		bitmaps = append(bitmaps, bitmap)
+	}
+	return bitmaps, nil
+}
+
+func hasFreeBitmap(path string) (yes bool, err error) {
+	_, err = os.Stat(filepath.Join(path, freeBitmapFilename))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+func markFreeBitmapDirty(path string) (err error) {
+	f, err := os.OpenFile(filepath.Join(path, freeBitmapFilename), os.O_RDWR, 0666)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if _, err := f.WriteAt([]byte{freeBitmapDirty}, 0); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// openFreeBitmaps loads free bitmaps of all bins or rebuilds them from chunk
+// meta, if the bitmap file is not clean or rebuild is true. The bitmap file
+// is left in the dirty state until Close.
+func (s *Store) openFreeBitmaps(path string, rebuild bool) (err error) {
+	exists, err := hasFreeBitmap(path)
+	if err != nil {
+		return err
+	}
+	var bitmaps []*freeBitmap
+	if exists && !rebuild {
+		bitmaps, err = readFreeBitmaps(path, s.layout.binCount())
+		if err != nil {
+			return err
+		}
+	}
+	if bitmaps == nil {
+		if !exists {
+			// free offsets in MetaStore are not maintained any more
+			for bin := 0; bin < s.layout.binCount(); bin++ {
+				if err := s.removeFreeOffsets(uint8(bin)); err != nil {
+					return err
+				}
+			}
+		}
+		bitmaps, err = s.rebuildFreeBitmaps()
+		if err != nil {
+			return err
+		}
+	}
+	s.bitmaps = bitmaps
+	return writeFreeBitmaps(path, bitmaps, freeBitmapDirty)
+}
+
+func (s *Store) rebuildFreeBitmaps() (bitmaps []*freeBitmap, err error) {
+	bitmaps = make([]*freeBitmap, s.layout.binCount())
+	for bin := range bitmaps {
+		bitmaps[bin] = newFreeBitmap()
+		slots := s.allocators[bin].size() / s.layout.slotSize(uint8(bin))
+		for slot := int64(0); slot < slots; slot++ {
+			bitmaps[bin].set(slot)
+		}
+	}
+	if err := s.meta.Iterate(func(addr chunk.Address, m *Meta) (stop bool, err error) {
+		bin := s.layout.bin(s.getShard(addr), int(m.Size))
+		bitmaps[bin].clear(m.Offset / s.layout.slotSize(bin))
+		return false, nil
+	}); err != nil {
+		return nil, err
+	}
+	return bitmaps, nil
+}
+
+func (s *Store) removeFreeOffsets(bin uint8) (err error) {
+	var offsets []int64
+	if err := s.meta.IterateFreeOffsets(bin, func(offset int64) (stop bool, err error) {
+		offsets = append(offsets, offset)
+		return false, nil
+	}); err != nil {
+		return err
+	}
+	for _, offset := range offsets {
+		if err := s.meta.RemoveFreeOffset(bin, offset); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Store) removeMeta(addr chunk.Address, bin uint8, m *Meta) (err error) {
+	if s.bitmaps == nil {
+		return s.meta.Remove(addr, bin)
+	}
+	if b, ok := s.meta.(BitmapMetaStore); ok {
+		return b.RemoveMeta(addr)
+	}
+	if err := s.meta.Remove(addr, bin); err != nil {
+		return err
+	}
+	return s.meta.RemoveFreeOffset(bin, m.Offset)
+}
+
+// metaReclaimed returns the reclaimed argument for MetaStore Set calls, which
+// is always false if free slots are kept in bitmaps, as there are no free
+// offsets in MetaStore to remove.
+func (s *Store) metaReclaimed(reclaimed bool) bool {
+	return reclaimed && s.bitmaps == nil
+}
+
+// FreeSlots returns the number of free slots in all shard files. With
+// Options.FreeBitmap, it is counted in memory, otherwise all free offsets
+// are iterated in MetaStore.
+func (s *Store) FreeSlots() (count int, err error) {
+	done, err := s.protect()
+	if err != nil {
+		return 0, err
+	}
+	defer done()
+
+	if s.bitmaps != nil {
+		for _, b := range s.bitmaps {
+			count += b.len()
+		}
+		return count, nil
+	}
+	for bin := 0; bin < s.layout.binCount(); bin++ {
+		if err := s.meta.IterateFreeOffsets(uint8(bin), func(int64) (stop bool, err error) {
+			count++
+			return false, nil
+		}); err != nil {
+			return 0, err
+		}
+	}
+	return count, nil
+}
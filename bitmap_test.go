@@ -0,0 +1,107 @@
+// Copyright 2019 The Swarm Authors
+// This file is part of the Swarm library.
+//
+// The Swarm library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The Swarm library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the Swarm library. If not, see <http://www.gnu.org/licenses/>.
+
+package forky
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestFreeBitmap(t *testing.T) {
+	b := newFreeBitmap()
+	for _, slot := range []int64{130, 5, 64, 5, 1000} {
+		b.set(slot)
+	}
+	if l := b.len(); l != 4 {
+		t.Errorf("got length %v, want 4", l)
+	}
+	if ok := b.clear(64); !ok {
+		t.Error("free slot not cleared")
+	}
+	if ok := b.clear(64); ok {
+		t.Error("used slot cleared")
+	}
+	if slots := b.slots(); !reflect.DeepEqual(slots, []int64{5, 130, 1000}) {
+		t.Errorf("got slots %v", slots)
+	}
+
+	// the lowest free slot is reused first
+	for _, want := range []int64{5, 3, 130, 1000, -1} {
+		if want == 3 {
+			b.set(3)
+		}
+		if slot := b.pop(); slot != want {
+			t.Errorf("got slot %v, want %v", slot, want)
+		}
+	}
+	if l := b.len(); l != 0 {
+		t.Errorf("got length %v, want 0", l)
+	}
+}
+
+func TestFreeBitmapFile(t *testing.T) {
+	path, err := ioutil.TempDir("", "swarm-forky-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(path)
+
+	bitmaps := []*freeBitmap{newFreeBitmap(), newFreeBitmap(), newFreeBitmap()}
+	bitmaps[0].set(1)
+	bitmaps[0].set(200)
+	bitmaps[2].set(64)
+
+	if err := writeFreeBitmaps(path, bitmaps, freeBitmapClean); err != nil {
+		t.Fatal(err)
+	}
+	got, err := readFreeBitmaps(path, len(bitmaps))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(bitmaps) {
+		t.Fatalf("got %v bitmaps, want %v", len(got), len(bitmaps))
+	}
+	for i := range got {
+		if !reflect.DeepEqual(got[i].slots(), bitmaps[i].slots()) {
+			t.Errorf("got bitmap %v slots %v, want %v", i, got[i].slots(), bitmaps[i].slots())
+		}
+		if got[i].len() != bitmaps[i].len() {
+			t.Errorf("got bitmap %v length %v, want %v", i, got[i].len(), bitmaps[i].len())
+		}
+	}
+
+	// bitmaps are not returned for more bins or in the dirty state
+	got, err = readFreeBitmaps(path, len(bitmaps)+1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != nil {
+		t.Error("got bitmaps for more bins")
+	}
+	if err := markFreeBitmapDirty(path); err != nil {
+		t.Fatal(err)
+	}
+	got, err = readFreeBitmaps(path, len(bitmaps))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != nil {
+		t.Error("got dirty bitmaps")
+	}
+}
@@ -24,7 +24,15 @@ import (
 	bolt "go.etcd.io/bbolt"
 )
 
-var _ forky.MetaStore = new(MetaStore)
+var (
+	_ forky.MetaStore         = new(MetaStore)
+	_ forky.BatchMetaStore    = new(MetaStore)
+	_ forky.BatchGetMetaStore = new(MetaStore)
+	_ forky.SyncMetaStore     = new(MetaStore)
+	_ forky.GroupMetaStore    = new(MetaStore)
+	_ forky.BitmapMetaStore   = new(MetaStore)
+	_ forky.RangeMetaStore    = new(MetaStore)
+)
 
 var (
 	bucketNameChunkMeta   = []byte("ChunkMeta")
@@ -63,19 +71,58 @@ func (s *MetaStore) Get(addr chunk.Address) (m *forky.Meta, err error) {
 	return m, err
 }
 
+func (s *MetaStore) GetBatch(addrs []chunk.Address) (metas []*forky.Meta, err error) {
+	metas = make([]*forky.Meta, len(addrs))
+	err = s.db.View(func(tx *bolt.Tx) (err error) {
+		b := tx.Bucket(bucketNameChunkMeta)
+		for i, addr := range addrs {
+			metas[i], err = getMeta(b, addr)
+			if err != nil && err != chunk.ErrChunkNotFound {
+				return err
+			}
+		}
+		return nil
+	})
+	return metas, err
+}
+
 func (s *MetaStore) Set(addr chunk.Address, shard uint8, reclaimed bool, m *forky.Meta) (err error) {
-	meta, err := m.MarshalBinary()
-	if err != nil {
-		return err
-	}
 	return s.db.Update(func(tx *bolt.Tx) (err error) {
-		if reclaimed {
-			err = tx.Bucket(bucketNameFreeOffsets).Delete(freeKey(shard, m.Offset))
+		return setMeta(tx, forky.MetaEntry{
+			Address:   addr,
+			Shard:     shard,
+			Reclaimed: reclaimed,
+			Meta:      m,
+		})
+	})
+}
+
+func (s *MetaStore) SetBatch(entries []forky.MetaEntry) (err error) {
+	return s.db.Update(func(tx *bolt.Tx) (err error) {
+		for _, e := range entries {
+			if err := setMeta(tx, e); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// WriteGroup applies all writes in a single transaction. Writes are already
+// grouped, so DB.Update is used instead of DB.Batch that would delay them.
+func (s *MetaStore) WriteGroup(writes []forky.MetaWrite) (err error) {
+	return s.db.Update(func(tx *bolt.Tx) (err error) {
+		for _, w := range writes {
+			if w.Remove {
+				err = removeMeta(tx, w.Address, w.Shard, !w.NoFreeOffset)
+			} else {
+				err = setMeta(tx, w.MetaEntry)
+			}
 			if err != nil {
 				return err
 			}
 		}
-		return tx.Bucket(bucketNameChunkMeta).Put(addr, meta)
+		return nil
 	})
 }
 
@@ -93,18 +140,43 @@ func (s *MetaStore) FreeOffset(shard uint8) (offset int64, err error) {
 	return offset, err
 }
 
-func (s *MetaStore) Remove(addr chunk.Address, shard uint8) (err error) {
+func (s *MetaStore) SetFreeOffset(shard uint8, offset int64) (err error) {
 	return s.db.Update(func(tx *bolt.Tx) (err error) {
-		b := tx.Bucket(bucketNameChunkMeta)
-		m, err := getMeta(b, addr)
-		if err != nil {
-			return err
-		}
-		err = tx.Bucket(bucketNameFreeOffsets).Put(freeKey(shard, m.Offset), nil)
-		if err != nil {
-			return err
+		return tx.Bucket(bucketNameFreeOffsets).Put(freeKey(shard, offset), nil)
+	})
+}
+
+func (s *MetaStore) RemoveFreeOffset(shard uint8, offset int64) (err error) {
+	return s.db.Update(func(tx *bolt.Tx) (err error) {
+		return tx.Bucket(bucketNameFreeOffsets).Delete(freeKey(shard, offset))
+	})
+}
+
+func (s *MetaStore) IterateFreeOffsets(shard uint8, fn func(offset int64) (stop bool, err error)) (err error) {
+	return s.db.View(func(tx *bolt.Tx) (err error) {
+		c := tx.Bucket(bucketNameFreeOffsets).Cursor()
+		for key, _ := c.Seek([]byte{shard}); key != nil && key[0] == shard; key, _ = c.Next() {
+			stop, err := fn(int64(binary.BigEndian.Uint64(key[1:9])))
+			if err != nil {
+				return err
+			}
+			if stop {
+				return nil
+			}
 		}
-		return b.Delete(addr)
+		return nil
+	})
+}
+
+func (s *MetaStore) Remove(addr chunk.Address, shard uint8) (err error) {
+	return s.db.Update(func(tx *bolt.Tx) (err error) {
+		return removeMeta(tx, addr, shard, true)
+	})
+}
+
+func (s *MetaStore) RemoveMeta(addr chunk.Address) (err error) {
+	return s.db.Update(func(tx *bolt.Tx) (err error) {
+		return removeMeta(tx, addr, 0, false)
 	})
 }
 
@@ -143,10 +215,71 @@ func (s *MetaStore) Iterate(fn func(chunk.Address, *forky.Meta) (stop bool, err
 	})
 }
 
+func (s *MetaStore) IterateFrom(start chunk.Address, fn func(chunk.Address, *forky.Meta) (stop bool, err error)) (err error) {
+	return s.db.View(func(tx *bolt.Tx) (err error) {
+		b := tx.Bucket(bucketNameChunkMeta)
+		if b == nil {
+			return nil
+		}
+		c := b.Cursor()
+		for k, v := c.Seek(start); k != nil; k, v = c.Next() {
+			m := new(forky.Meta)
+			if err := m.UnmarshalBinary(v); err != nil {
+				return err
+			}
+			stop, err := fn(chunk.Address(k), m)
+			if err != nil {
+				return err
+			}
+			if stop {
+				return nil
+			}
+		}
+		return nil
+	})
+}
+
+// Sync writes the database file to persistent storage, which is needed
+// only if the MetaStore is created with noSync.
+func (s *MetaStore) Sync() (err error) {
+	return s.db.Sync()
+}
+
 func (s *MetaStore) Close() (err error) {
 	return s.db.Close()
 }
 
+func setMeta(tx *bolt.Tx, e forky.MetaEntry) (err error) {
+	if e.Reclaimed {
+		err = tx.Bucket(bucketNameFreeOffsets).Delete(freeKey(e.Shard, e.Meta.Offset))
+		if err != nil {
+			return err
+		}
+	}
+	meta, err := e.Meta.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(bucketNameChunkMeta).Put(e.Address, meta)
+}
+
+// removeMeta removes chunk meta and stores its slot as a free offset of the
+// shard if freeOffset is true.
+func removeMeta(tx *bolt.Tx, addr chunk.Address, shard uint8, freeOffset bool) (err error) {
+	b := tx.Bucket(bucketNameChunkMeta)
+	m, err := getMeta(b, addr)
+	if err != nil {
+		return err
+	}
+	if freeOffset {
+		err = tx.Bucket(bucketNameFreeOffsets).Put(freeKey(shard, m.Offset), nil)
+		if err != nil {
+			return err
+		}
+	}
+	return b.Delete(addr)
+}
+
 func getMeta(b *bolt.Bucket, addr chunk.Address) (m *forky.Meta, err error) {
 	data := b.Get(addr)
 	if data == nil {
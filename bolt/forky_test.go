@@ -18,6 +18,7 @@ package bolt_test
 
 import (
 	"io/ioutil"
+	"os"
 	"path/filepath"
 	"testing"
 
@@ -38,16 +39,42 @@ func testBoltForky(t *testing.T, noSync bool) {
 	t.Helper()
 
 	test.StoreSuite(t, func(t *testing.T) (forky.Interface, func()) {
-		path, err := ioutil.TempDir("", "swarm-forky-")
-		if err != nil {
-			t.Fatal(err)
-		}
+		return newForkyStore(t, noSync)
+	})
+}
+
+func TestBoltRangeMetaStore(t *testing.T) {
+	path, err := ioutil.TempDir("", "swarm-forky-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(path)
 
-		metaStore, err := bolt.NewMetaStore(filepath.Join(path, "test.db"), noSync)
-		if err != nil {
-			t.Fatal(err)
-		}
+	metaStore, err := bolt.NewMetaStore(filepath.Join(path, "test.db"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer metaStore.Close()
+
+	test.RangeMetaStoreSuite(t, metaStore)
+}
 
-		return test.NewForkyStore(t, path, metaStore)
+func BenchmarkBoltForkyNoSync(b *testing.B) {
+	test.StoreBenchmarkSuite(b, func(b *testing.B) (forky.Interface, func()) {
+		return newForkyStore(b, true)
 	})
 }
+
+func newForkyStore(t testing.TB, noSync bool) (s *forky.Store, clean func()) {
+	path, err := ioutil.TempDir("", "swarm-forky-")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	metaStore, err := bolt.NewMetaStore(filepath.Join(path, "test.db"), noSync)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return test.NewForkyStore(t, path, metaStore)
+}
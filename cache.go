@@ -0,0 +1,221 @@
+// Copyright 2019 The Swarm Authors
+// This file is part of the Swarm library.
+//
+// The Swarm library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The Swarm library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the Swarm library. If not, see <http://www.gnu.org/licenses/>.
+
+package forky
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// CacheStats contains counters of an in-memory cache.
+type CacheStats struct {
+	Hits       uint64 `json:"hits"`
+	Misses     uint64 `json:"misses"`
+	Evictions  uint64 `json:"evictions"`
+	Rejections uint64 `json:"rejections"`
+	Entries    int    `json:"entries"`
+	Size       int64  `json:"size"`
+}
+
+type clockEntry struct {
+	key   string
+	value interface{}
+	size  int64
+	// ref is set when the entry is returned by get, so that it is
+	// skipped once by the clock hand
+	ref uint32
+}
+
+// clockCache keeps values within a memory budget, evicting entries with
+// the CLOCK policy. Entries are kept in a ring that the clock hand sweeps
+// on eviction, removing the first entry that was not accessed since the
+// previous sweep. Accessing an entry sets only its reference bit, so get
+// holds the mutex only for reading.
+type clockCache struct {
+	// counters are accessed atomically and they are the first
+	// fields to be aligned on 32-bit platforms
+	hits       uint64
+	misses     uint64
+	evictions  uint64
+	rejections uint64
+	index      map[string]int
+	entries    []clockEntry
+	// free are indexes of entries that are removed from the ring
+	free    []int
+	hand    int
+	size    int64
+	maxSize int64
+	// admit decides if a new entry with the key is added to the full
+	// cache by evicting the victim entry, which is always done if it is nil
+	admit func(key, victim string) bool
+	mu    sync.RWMutex
+}
+
+func newClockCache(maxSize int64, admit func(key, victim string) bool) (c *clockCache) {
+	return &clockCache{
+		index:   make(map[string]int),
+		maxSize: maxSize,
+		admit:   admit,
+	}
+}
+
+// get returns the value of the entry with the key. Hits and misses are not
+// counted, as callers may validate the value, and must be recorded with
+// the record method.
+func (c *clockCache) get(key string) (value interface{}, ok bool) {
+	c.mu.RLock()
+	i, ok := c.index[key]
+	if ok {
+		e := &c.entries[i]
+		value = e.value
+		if atomic.LoadUint32(&e.ref) == 0 {
+			atomic.StoreUint32(&e.ref, 1)
+		}
+	}
+	c.mu.RUnlock()
+	return value, ok
+}
+
+func (c *clockCache) record(hit bool) {
+	if hit {
+		atomic.AddUint64(&c.hits, 1)
+	} else {
+		atomic.AddUint64(&c.misses, 1)
+	}
+}
+
+func (c *clockCache) set(key string, value interface{}, size int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if i, ok := c.index[key]; ok {
+		if c.entries[i].size == size {
+			c.entries[i].value = value
+			return
+		}
+		c.removeEntry(i)
+	}
+	if size > c.maxSize {
+		return
+	}
+	for c.size+size > c.maxSize {
+		i := c.victim()
+		if c.admit != nil && !c.admit(key, c.entries[i].key) {
+			atomic.AddUint64(&c.rejections, 1)
+			return
+		}
+		c.removeEntry(i)
+		atomic.AddUint64(&c.evictions, 1)
+		// the new entry may take the slot of the victim and it must not
+		// be the next one to be evicted
+		c.hand++
+	}
+	c.insert(key, value, size)
+}
+
+// add adds the entry only if there is no entry with the key and it fits
+// into the budget without evictions. It returns full as true if the
+// entry does not fit.
+func (c *clockCache) add(key string, value interface{}, size int64) (full bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.size+size > c.maxSize {
+		return true
+	}
+	if _, ok := c.index[key]; ok {
+		return false
+	}
+	c.insert(key, value, size)
+	return false
+}
+
+// insert puts the new entry into a free place in the ring. It must be
+// called with the mutex locked.
+func (c *clockCache) insert(key string, value interface{}, size int64) {
+	var i int
+	if n := len(c.free); n > 0 {
+		i = c.free[n-1]
+		c.free = c.free[:n-1]
+	} else {
+		i = len(c.entries)
+		c.entries = append(c.entries, clockEntry{})
+	}
+	c.entries[i] = clockEntry{
+		key:   key,
+		value: value,
+		size:  size,
+	}
+	c.index[key] = i
+	c.size += size
+}
+
+func (c *clockCache) remove(key string) {
+	c.mu.Lock()
+	if i, ok := c.index[key]; ok {
+		c.removeEntry(i)
+	}
+	c.mu.Unlock()
+}
+
+// victim advances the clock hand until it points to an entry that is not
+// referenced, clearing reference bits on the way, and returns its index.
+// It must be called with the mutex locked and at least one entry in
+// the ring.
+func (c *clockCache) victim() (i int) {
+	for {
+		if c.hand >= len(c.entries) {
+			c.hand = 0
+		}
+		e := &c.entries[c.hand]
+		if e.value != nil {
+			if atomic.LoadUint32(&e.ref) == 0 {
+				return c.hand
+			}
+			atomic.StoreUint32(&e.ref, 0)
+		}
+		c.hand++
+	}
+}
+
+func (c *clockCache) removeEntry(i int) {
+	delete(c.index, c.entries[i].key)
+	c.size -= c.entries[i].size
+	c.entries[i] = clockEntry{}
+	c.free = append(c.free, i)
+}
+
+func (c *clockCache) stats() (s CacheStats) {
+	c.mu.RLock()
+	s.Entries = len(c.index)
+	s.Size = c.size
+	c.mu.RUnlock()
+	s.Hits = atomic.LoadUint64(&c.hits)
+	s.Misses = atomic.LoadUint64(&c.misses)
+	s.Evictions = atomic.LoadUint64(&c.evictions)
+	s.Rejections = atomic.LoadUint64(&c.rejections)
+	return s
+}
+
+func fnv64a(key string) (h uint64) {
+	h = 14695981039346656037
+	for i := 0; i < len(key); i++ {
+		h ^= uint64(key[i])
+		h *= 1099511628211
+	}
+	return h
+}
@@ -0,0 +1,141 @@
+// Copyright 2019 The Swarm Authors
+// This file is part of the Swarm library.
+//
+// The Swarm library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The Swarm library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the Swarm library. If not, see <http://www.gnu.org/licenses/>.
+
+package forky_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/ethersphere/swarm/chunk"
+	"github.com/janos/forky"
+	"github.com/janos/forky/test"
+)
+
+func TestStoreMetaCache(t *testing.T) {
+	const capacity = 10
+
+	// approximate size of ten cache entries with 32 byte addresses
+	s, _, clean := newTestStore(t, chunk.DefaultSize, &forky.Options{
+		MetaCacheSize: capacity * 144,
+	})
+	defer clean()
+
+	chunks := make([]chunk.Chunk, 3*capacity)
+	for i := range chunks {
+		chunks[i] = test.GenerateTestRandomChunk()
+		if err := s.Put(chunks[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, ch := range chunks {
+		got, err := s.Get(ch.Address())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got.Data(), ch.Data()) {
+			t.Fatalf("got chunk %s data %x, want %x", ch.Address().Hex(), got.Data(), ch.Data())
+		}
+	}
+
+	stats := s.MetaCacheStats()
+	if stats.Entries == 0 || stats.Entries > capacity {
+		t.Errorf("got %v cache entries, want at most %v", stats.Entries, capacity)
+	}
+	if stats.Size > capacity*144 {
+		t.Errorf("got cache size %v, want at most %v", stats.Size, capacity*144)
+	}
+	if stats.Evictions == 0 {
+		t.Error("no cache evictions")
+	}
+	if stats.Misses == 0 {
+		t.Error("no cache misses")
+	}
+
+	// the last chunk is cached by the last Get
+	if _, err := s.Get(chunks[len(chunks)-1].Address()); err != nil {
+		t.Fatal(err)
+	}
+	if got := s.MetaCacheStats().Hits; got != stats.Hits+1 {
+		t.Errorf("got %v cache hits, want %v", got, stats.Hits+1)
+	}
+
+	s, _, clean = newTestStore(t, chunk.DefaultSize, &forky.Options{
+		MetaCacheSize: -1,
+	})
+	defer clean()
+
+	if err := s.Put(chunks[0]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Get(chunks[0].Address()); err != nil {
+		t.Fatal(err)
+	}
+	if stats := s.MetaCacheStats(); stats != (forky.CacheStats{}) {
+		t.Errorf("got cache stats %+v for disabled cache", stats)
+	}
+}
+
+func TestStoreDataCache(t *testing.T) {
+	s, _, clean := newTestStore(t, chunk.DefaultSize, &forky.Options{
+		ShardCount:    1,
+		DataCacheSize: 1 << 20,
+	})
+	defer clean()
+
+	get := func(ch chunk.Chunk) {
+		t.Helper()
+
+		got, err := s.Get(ch.Address())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got.Data(), ch.Data()) {
+			t.Fatalf("got chunk %s data %x, want %x", ch.Address().Hex(), got.Data(), ch.Data())
+		}
+	}
+
+	deleted := test.GenerateTestRandomChunk()
+	if err := s.Put(deleted); err != nil {
+		t.Fatal(err)
+	}
+	get(deleted)
+	get(deleted)
+	if stats := s.DataCacheStats(); stats.Hits != 1 || stats.Misses != 1 || stats.Entries != 1 {
+		t.Errorf("got cache stats %+v, want one hit, one miss and one entry", stats)
+	}
+
+	if err := s.Delete(deleted.Address()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Get(deleted.Address()); err != chunk.ErrChunkNotFound {
+		t.Fatalf("got error %v, want %v", err, chunk.ErrChunkNotFound)
+	}
+	if stats := s.DataCacheStats(); stats.Entries != 0 {
+		t.Errorf("got %v cache entries after delete, want none", stats.Entries)
+	}
+
+	// the slot of the deleted chunk is reused by the new one
+	ch := test.GenerateTestRandomChunk()
+	if err := s.Put(ch); err != nil {
+		t.Fatal(err)
+	}
+	get(ch)
+	get(ch)
+	if stats := s.DataCacheStats(); stats.Hits != 2 {
+		t.Errorf("got %v cache hits, want %v", stats.Hits, 2)
+	}
+}
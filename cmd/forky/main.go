@@ -0,0 +1,228 @@
+// Copyright 2019 The Swarm Authors
+// This file is part of the Swarm library.
+//
+// The Swarm library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The Swarm library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the Swarm library. If not, see <http://www.gnu.org/licenses/>.
+
+// Command forky provides offline maintenance operations on forky stores.
+package main
+
+import (
+	"encoding"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/ethersphere/swarm/chunk"
+	"github.com/janos/forky"
+	"github.com/janos/forky/badger"
+	"github.com/janos/forky/bolt"
+	"github.com/janos/forky/leveldb"
+)
+
+// errProblems is returned by commands when the store has problems, and
+// results in exit code 3, without printing an error.
+var errProblems = errors.New("problems found")
+
+var commands = map[string]func(args []string) error{
+	"fsck":    fsckCmd,
+	"rebuild": rebuildCmd,
+	"reshard": reshardCmd,
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+	cmd, ok := commands[os.Args[1]]
+	if !ok {
+		usage()
+	}
+	if err := cmd(os.Args[2:]); err != nil {
+		if err == errProblems {
+			os.Exit(3)
+		}
+		fmt.Fprintln(os.Stderr, "error:", err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: forky <command> [options] <store directory>")
+	fmt.Fprintln(os.Stderr, "commands:")
+	for name := range commands {
+		fmt.Fprintln(os.Stderr, "  "+name)
+	}
+	os.Exit(2)
+}
+
+// metaStoreFlags registers flags for opening a MetaStore on the flag set
+// and returns a function that opens it.
+func metaStoreFlags(fs *flag.FlagSet) (open func() (forky.MetaStore, error)) {
+	kind := fs.String("meta", "leveldb", "MetaStore implementation: leveldb, bolt or badger.")
+	path := fs.String("meta-path", "", "Path to the MetaStore database.")
+	return func() (forky.MetaStore, error) {
+		if *path == "" {
+			return nil, fmt.Errorf("meta-path flag is required")
+		}
+		switch *kind {
+		case "leveldb":
+			return leveldb.NewMetaStore(*path)
+		case "bolt":
+			return bolt.NewMetaStore(*path, false)
+		case "badger":
+			return badger.NewMetaStore(*path)
+		}
+		return nil, fmt.Errorf("unknown meta store %q", *kind)
+	}
+}
+
+func fsckCmd(args []string) (err error) {
+	fs := flag.NewFlagSet("fsck", flag.ExitOnError)
+	openMetaStore := metaStoreFlags(fs)
+	maxChunkSize := fs.Int("max-chunk-size", chunk.DefaultSize, "Maximal chunk size of the store without the manifest.")
+	headers := fs.Bool("slot-headers", false, "Store without the manifest is created with slot headers.")
+	repair := fs.Bool("repair", false, "Repair found problems.")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return fmt.Errorf("store directory argument is required")
+	}
+
+	metaStore, err := openMetaStore()
+	if err != nil {
+		return err
+	}
+	defer metaStore.Close()
+
+	check := forky.Check
+	if *repair {
+		check = forky.Repair
+	}
+	o := new(forky.Options)
+	m, err := forky.ReadManifest(fs.Arg(0))
+	switch {
+	case err == nil:
+		*maxChunkSize = m.MaxChunkSize
+		o = &forky.Options{
+			ShardCount:    m.ShardCount,
+			ShardFunc:     m.ShardFunc,
+			SlotFormat:    m.SlotFormat,
+			SizeClasses:   m.SizeClasses,
+			SlotAlignment: m.SlotAlignment,
+		}
+	case os.IsNotExist(err):
+		// stores created before the manifest
+		if *headers {
+			o.SlotFormat = forky.SlotFormatHeader
+		}
+	default:
+		return err
+	}
+	r, err := check(fs.Arg(0), *maxChunkSize, metaStore, o)
+	if err != nil {
+		return err
+	}
+
+	e := json.NewEncoder(os.Stdout)
+	e.SetIndent("", "  ")
+	if err := e.Encode(r); err != nil {
+		return err
+	}
+	if len(r.Problems) > 0 && !r.Repaired {
+		return errProblems
+	}
+	return nil
+}
+
+func rebuildCmd(args []string) (err error) {
+	fs := flag.NewFlagSet("rebuild", flag.ExitOnError)
+	openMetaStore := metaStoreFlags(fs)
+	maxChunkSize := fs.Int("max-chunk-size", chunk.DefaultSize, "Maximal chunk size of the store.")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return fmt.Errorf("store directory argument is required")
+	}
+
+	metaStore, err := openMetaStore()
+	if err != nil {
+		return err
+	}
+	defer metaStore.Close()
+
+	r, err := forky.RebuildMetaStore(fs.Arg(0), *maxChunkSize, metaStore)
+	if err != nil {
+		return err
+	}
+	return json.NewEncoder(os.Stdout).Encode(r)
+}
+
+func reshardCmd(args []string) (err error) {
+	fs := flag.NewFlagSet("reshard", flag.ExitOnError)
+	openMetaStore := metaStoreFlags(fs)
+	shardCount := fs.Int("shards", forky.DefaultShardCount, "Target number of shard files.")
+	var shardFunc forky.ShardFunc
+	fs.Var(textFlag{&shardFunc}, "shard-func", "Target shard function: last-byte, first-byte or hash.")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return fmt.Errorf("store directory argument is required")
+	}
+
+	metaStore, err := openMetaStore()
+	if err != nil {
+		return err
+	}
+	defer metaStore.Close()
+
+	var lastPercent int
+	return forky.Reshard(fs.Arg(0), metaStore, &forky.ReshardOptions{
+		ShardCount: *shardCount,
+		ShardFunc:  shardFunc,
+		Progress: func(done, total int) {
+			if total == 0 {
+				return
+			}
+			if percent := done * 100 / total; percent != lastPercent {
+				lastPercent = percent
+				fmt.Fprintf(os.Stderr, "copied %v/%v chunks (%v%%)\n", done, total, percent)
+			}
+		},
+	})
+}
+
+// textFlag is a flag.Value for types that implement text marshalling.
+type textFlag struct {
+	v interface {
+		encoding.TextMarshaler
+		encoding.TextUnmarshaler
+	}
+}
+
+func (f textFlag) String() string {
+	if f.v == nil {
+		return ""
+	}
+	text, _ := f.v.MarshalText()
+	return string(text)
+}
+
+func (f textFlag) Set(s string) error {
+	return f.v.UnmarshalText([]byte(s))
+}
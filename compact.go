@@ -0,0 +1,390 @@
+// Copyright 2019 The Swarm Authors
+// This file is part of the Swarm library.
+//
+// The Swarm library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The Swarm library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the Swarm library. If not, see <http://www.gnu.org/licenses/>.
+
+package forky
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ethersphere/swarm/chunk"
+)
+
+// ErrCompactionInProgress is returned by Compact if another compaction of
+// the same shard is running.
+var ErrCompactionInProgress = errors.New("compaction in progress")
+
+// CompactOptions configures the Compact method.
+type CompactOptions struct {
+	// Shards to compact. If empty, all shards are compacted.
+	Shards []uint8
+	// Rate is the maximal number of chunks relocated per second.
+	// If zero, relocation is not limited.
+	Rate int
+}
+
+// CompactReport contains statistics about the Compact result.
+type CompactReport struct {
+	RelocatedChunks int   `json:"relocatedChunks"`
+	TruncatedSlots  int   `json:"truncatedSlots"`
+	ReclaimedBytes  int64 `json:"reclaimedBytes"`
+}
+
+// Compact moves chunks from the end of shard files into free slots and
+// truncates shard files when they end with free slots. Slots of all shards
+// are collected with a single MetaStore iteration and shards are compacted
+// one by one, holding the shard lock only while a single chunk is relocated,
+// so that other methods can be called during compaction. Compaction stops
+// when the context is done and the partial report is returned together with
+// the context error.
+func (s *Store) Compact(ctx context.Context, o *CompactOptions) (r *CompactReport, err error) {
+	done, err := s.protect()
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	// truncated files would invalidate mapped data returned by Get
+	if s.mmapView {
+		return nil, errors.New("compaction is not supported with mmap views")
+	}
+	if o == nil {
+		o = new(CompactOptions)
+	}
+	shards := o.Shards
+	if len(shards) == 0 {
+		for i := 0; i < s.shardCount; i++ {
+			shards = append(shards, uint8(i))
+		}
+	}
+	var interval time.Duration
+	if o.Rate > 0 {
+		interval = time.Second / time.Duration(o.Rate)
+	}
+	r = new(CompactReport)
+	var bins []uint8
+	for _, shard := range shards {
+		if int(shard) >= s.shardCount {
+			return r, fmt.Errorf("invalid shard %v", shard)
+		}
+		for class := range s.layout.classes {
+			bins = append(bins, uint8(class*s.shardCount+int(shard)))
+		}
+	}
+	snapshots, err := s.startCompaction(bins)
+	if err != nil {
+		return r, err
+	}
+	defer s.endCompaction(bins)
+
+	for _, bin := range bins {
+		if err := s.compactBin(ctx, bin, snapshots[bin], interval, r); err != nil {
+			return r, err
+		}
+	}
+	return r, nil
+}
+
+// compaction tracks slots of a single bin during compaction. Methods
+// that change slots record their changes while holding the shard lock,
+// so that they are not missed by the slot snapshot that is taken without it.
+// Puts hold the shard lock only for reading and record their slots
+// concurrently, which is guarded by the mutex.
+type compaction struct {
+	refs    map[int64]chunk.Address
+	free    map[int64]struct{}
+	holes   []int64
+	changed bool
+	mu      sync.Mutex
+}
+
+func newCompaction() (c *compaction) {
+	return &compaction{
+		refs: make(map[int64]chunk.Address),
+		free: make(map[int64]struct{}),
+	}
+}
+
+func (c *compaction) used(offset int64, addr chunk.Address) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.refs[offset] = append(chunk.Address(nil), addr...)
+	delete(c.free, offset)
+	c.changed = true
+}
+
+func (c *compaction) freed(offset int64) {
+	delete(c.refs, offset)
+	c.free[offset] = struct{}{}
+	c.changed = true
+}
+
+func (c *compaction) hole(limit int64) (offset int64) {
+	if c.changed {
+		c.holes = c.holes[:0]
+		for offset := range c.free {
+			c.holes = append(c.holes, offset)
+		}
+		sort.Slice(c.holes, func(i, j int) bool { return c.holes[i] < c.holes[j] })
+		c.changed = false
+	}
+	for len(c.holes) > 0 {
+		offset = c.holes[0]
+		if _, ok := c.free[offset]; ok && offset < limit {
+			return offset
+		}
+		if offset >= limit {
+			return -1
+		}
+		c.holes = c.holes[1:]
+	}
+	return -1
+}
+
+// startCompaction records slot changes of all bins and returns their slot
+// snapshots, taken with a single MetaStore iteration.
+func (s *Store) startCompaction(bins []uint8) (snapshots map[uint8]*compaction, err error) {
+	changes := make(map[uint8]*compaction, len(bins))
+	for i, bin := range bins {
+		mu := s.shardsMu[s.layout.shard(bin)]
+		mu.Lock()
+		if s.compactions[bin] != nil {
+			mu.Unlock()
+			s.endCompaction(bins[:i])
+			return nil, ErrCompactionInProgress
+		}
+		changes[bin] = newCompaction()
+		s.compactions[bin] = changes[bin]
+		mu.Unlock()
+	}
+
+	// changes that are recorded while snapshots are taken are applied
+	// after them, so that the latest state of every slot is preserved
+	snapshots = make(map[uint8]*compaction, len(bins))
+	for _, bin := range bins {
+		snapshot := newCompaction()
+		if s.bitmaps != nil {
+			for _, slot := range s.bitmaps[bin].slots() {
+				snapshot.freed(slot * s.layout.slotSize(bin))
+			}
+		} else if err := s.meta.IterateFreeOffsets(bin, func(offset int64) (stop bool, err error) {
+			snapshot.freed(offset)
+			return false, nil
+		}); err != nil {
+			s.endCompaction(bins)
+			return nil, err
+		}
+		snapshots[bin] = snapshot
+	}
+	if err := s.meta.Iterate(func(addr chunk.Address, m *Meta) (stop bool, err error) {
+		if snapshot, ok := snapshots[s.layout.bin(s.getShard(addr), int(m.Size))]; ok {
+			snapshot.used(m.Offset, addr)
+		}
+		return false, nil
+	}); err != nil {
+		s.endCompaction(bins)
+		return nil, err
+	}
+	for _, bin := range bins {
+		mu := s.shardsMu[s.layout.shard(bin)]
+		mu.Lock()
+		snapshot := snapshots[bin]
+		for offset, addr := range changes[bin].refs {
+			snapshot.used(offset, addr)
+		}
+		for offset := range changes[bin].free {
+			snapshot.freed(offset)
+		}
+		s.compactions[bin] = snapshot
+		mu.Unlock()
+	}
+	return snapshots, nil
+}
+
+func (s *Store) endCompaction(bins []uint8) {
+	for _, bin := range bins {
+		mu := s.shardsMu[s.layout.shard(bin)]
+		mu.Lock()
+		s.compactions[bin] = nil
+		mu.Unlock()
+	}
+}
+
+func (s *Store) compactBin(ctx context.Context, bin uint8, snapshot *compaction, interval time.Duration, r *CompactReport) (err error) {
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-s.quit:
+			return ErrDBClosed
+		default:
+		}
+		relocated, stop, err := s.compactStep(ctx, bin, snapshot, r)
+		if err != nil || stop {
+			return err
+		}
+		if relocated && interval > 0 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-s.quit:
+				return ErrDBClosed
+			case <-time.After(interval):
+			}
+		}
+	}
+}
+
+// compactStep truncates the last slot of the bin file if it is free or
+// moves its chunk to the lowest free slot. It returns stop as true when
+// the bin can not be compacted any further.
+func (s *Store) compactStep(ctx context.Context, bin uint8, c *compaction, r *CompactReport) (relocated, stop bool, err error) {
+	mu := s.shardsMu[s.layout.shard(bin)]
+	if err := mu.LockContext(ctx); err != nil {
+		return false, true, err
+	}
+	defer mu.Unlock()
+
+	// the exclusive shard lock ensures that no slots are being reserved
+	f := s.shards[bin]
+	a := s.allocators[bin]
+	size := a.size()
+	if size == 0 {
+		return false, true, nil
+	}
+	slotSize := s.layout.slotSize(bin)
+	tail := size - slotSize
+
+	if _, ok := c.free[tail]; ok {
+		if s.bitmaps != nil {
+			s.bitmaps[bin].clear(tail / slotSize)
+		} else if err := s.meta.RemoveFreeOffset(bin, tail); err != nil {
+			return false, true, err
+		}
+		if s.freeCache != nil {
+			s.freeCache.remove(bin, tail)
+		}
+		delete(c.free, tail)
+		if err := a.truncate(tail); err != nil {
+			return false, true, err
+		}
+		r.TruncatedSlots++
+		r.ReclaimedBytes += size - tail
+		return false, false, nil
+	}
+
+	hole := c.hole(tail)
+	if hole < 0 {
+		return false, true, nil
+	}
+	addr, ok := c.refs[tail]
+	if !ok {
+		// the last slot is neither referenced nor free, it may be
+		// written by Put that did not yet set its meta
+		return false, true, nil
+	}
+	m, err := s.getMeta(ctx, addr)
+	if err != nil {
+		if err == chunk.ErrChunkNotFound {
+			return false, true, nil
+		}
+		return false, true, err
+	}
+	if m.Offset != tail {
+		return false, true, nil
+	}
+
+	moved := *m
+	moved.Offset = hole
+	if s.journal != nil {
+		journalID, err := s.journal.begin(&journalRecord{
+			typ:   journalMove,
+			shard: bin,
+			meta:  moved,
+			addr:  addr,
+			from:  tail,
+		})
+		if err != nil {
+			return false, true, err
+		}
+		defer func() {
+			if e := s.journal.done(journalID); e != nil && err == nil {
+				err = e
+			}
+		}()
+	}
+
+	slot := s.getSlotBuffer(bin)
+	defer s.putSlotBuffer(bin, slot)
+	n, err := f.ReadAt(slot, tail)
+	if err != nil && !(err == io.EOF && int64(n) >= s.slotFormat.headerSize()+int64(m.Size)) {
+		return false, true, err
+	}
+	if _, err := f.WriteAt(slot, hole); err != nil {
+		return false, true, err
+	}
+	// with syncing enabled, the chunk must be durable at the new offset
+	// before the last slot is truncated
+	if s.syncMode != SyncNone {
+		if err := f.Sync(); err != nil {
+			return false, true, err
+		}
+	}
+	if s.bitmaps != nil {
+		s.bitmaps[bin].clear(hole / slotSize)
+	}
+	if err := s.meta.Set(addr, bin, s.metaReclaimed(true), &moved); err != nil {
+		return false, true, err
+	}
+	if s.syncMode != SyncNone {
+		if err := s.syncMeta(); err != nil {
+			return false, true, err
+		}
+	}
+	if s.freeCache != nil {
+		s.freeCache.remove(bin, hole)
+	}
+	if s.warmUp != nil {
+		s.warmUp.change(addr)
+	}
+	if s.metaCache != nil {
+		s.metaCache.set(addr, &moved)
+	}
+	if s.dataCache != nil {
+		s.dataCache.remove(addr)
+	}
+	c.refs[hole] = addr
+	delete(c.free, hole)
+	delete(c.refs, tail)
+
+	// the last slot is not referenced any more and it is removed
+	if err := s.markSlotFree(bin, tail); err != nil {
+		return true, true, err
+	}
+	if err := a.truncate(tail); err != nil {
+		return true, true, err
+	}
+	r.RelocatedChunks++
+	r.TruncatedSlots++
+	r.ReclaimedBytes += size - tail
+	return true, false, nil
+}
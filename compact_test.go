@@ -0,0 +1,326 @@
+// Copyright 2019 The Swarm Authors
+// This file is part of the Swarm library.
+//
+// The Swarm library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The Swarm library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the Swarm library. If not, see <http://www.gnu.org/licenses/>.
+
+package forky_test
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ethersphere/swarm/chunk"
+	"github.com/janos/forky"
+	"github.com/janos/forky/mem"
+	"github.com/janos/forky/test"
+)
+
+func TestStoreCompact(t *testing.T) {
+	for _, tc := range []struct {
+		format     forky.SlotFormat
+		freeBitmap bool
+	}{
+		{format: forky.SlotFormatRaw},
+		{format: forky.SlotFormatHeader},
+		{format: forky.SlotFormatRaw, freeBitmap: true},
+	} {
+		name := tc.format.String()
+		if tc.freeBitmap {
+			name += " free bitmap"
+		}
+		t.Run(name, func(t *testing.T) {
+			path, err := ioutil.TempDir("", "swarm-forky-")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(path)
+
+			o := &forky.Options{
+				ShardCount: 2,
+				SlotFormat: tc.format,
+				FreeBitmap: tc.freeBitmap,
+			}
+			metaStore := mem.NewMetaStore()
+			s, err := forky.NewStore(path, chunk.DefaultSize, metaStore, o)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+
+			all := make([]chunk.Chunk, 100)
+			for i := range all {
+				all[i] = test.GenerateTestRandomChunk()
+				if err := s.Put(all[i]); err != nil {
+					t.Fatal(err)
+				}
+			}
+			// delete every other chunk to leave holes in shard files
+			var chunks []chunk.Chunk
+			for i, ch := range all {
+				if i%2 == 0 {
+					if err := s.Delete(ch.Address()); err != nil {
+						t.Fatal(err)
+					}
+					continue
+				}
+				chunks = append(chunks, ch)
+			}
+
+			// get chunks during compaction
+			var wg sync.WaitGroup
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for _, ch := range chunks {
+					got, err := s.Get(ch.Address())
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					if !bytes.Equal(got.Data(), ch.Data()) {
+						t.Errorf("got chunk %s data %x, want %x", ch.Address(), got.Data(), ch.Data())
+						return
+					}
+				}
+			}()
+			r, err := s.Compact(context.Background(), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			wg.Wait()
+			if r.RelocatedChunks == 0 {
+				t.Error("no relocated chunks")
+			}
+			if r.TruncatedSlots != 50 {
+				t.Errorf("got %v truncated slots, want 50", r.TruncatedSlots)
+			}
+
+			var size int64
+			files, err := filepath.Glob(filepath.Join(path, "chunks-*.db"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, file := range files {
+				fi, err := os.Stat(file)
+				if err != nil {
+					t.Fatal(err)
+				}
+				size += fi.Size()
+			}
+			slotSize := s.Manifest().SlotSize
+			if want := int64(len(chunks)) * slotSize; size != want {
+				t.Errorf("got shard files size %v, want %v", size, want)
+			}
+
+			for _, ch := range chunks {
+				got, err := s.Get(ch.Address())
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(got.Data(), ch.Data()) {
+					t.Fatalf("got chunk %s data %x, want %x", ch.Address(), got.Data(), ch.Data())
+				}
+			}
+			ch := test.GenerateTestRandomChunk()
+			if err := s.Put(ch); err != nil {
+				t.Fatal(err)
+			}
+			chunks = append(chunks, ch)
+			if err := s.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			cr, err := forky.Check(path, chunk.DefaultSize, metaStore, o)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(cr.Problems) != 0 || cr.FreeSlots != 0 || cr.Chunks != len(chunks) {
+				t.Errorf("got check report %+v", cr)
+			}
+		})
+	}
+}
+
+// TestStoreCompactIterations validates that slots of all compacted bins are
+// collected with a single MetaStore iteration.
+func TestStoreCompactIterations(t *testing.T) {
+	path, err := ioutil.TempDir("", "swarm-forky-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(path)
+
+	metaStore := &countingMetaStore{MetaStore: mem.NewMetaStore()}
+	s, err := forky.NewStore(path, chunk.DefaultSize, metaStore, &forky.Options{
+		ShardCount:  4,
+		SizeClasses: []int{1024},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	chunks := make([]chunk.Chunk, 40)
+	for i := range chunks {
+		chunks[i] = test.GenerateTestRandomChunk()
+		if err := s.Put(chunks[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < len(chunks); i += 2 {
+		if err := s.Delete(chunks[i].Address()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	iterations := metaStore.iterations
+	r, err := s.Compact(context.Background(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := metaStore.iterations - iterations; got != 1 {
+		t.Errorf("got %v MetaStore iterations, want 1", got)
+	}
+	if r.TruncatedSlots != 20 {
+		t.Errorf("got %v truncated slots, want 20", r.TruncatedSlots)
+	}
+}
+
+func TestStoreCompactCancel(t *testing.T) {
+	s, _, clean := newTestStore(t, chunk.DefaultSize, &forky.Options{
+		ShardCount: 1,
+	})
+	defer clean()
+
+	chunks := make([]chunk.Chunk, 20)
+	for i := range chunks {
+		chunks[i] = test.GenerateTestRandomChunk()
+		if err := s.Put(chunks[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, ch := range chunks[:10] {
+		if err := s.Delete(ch.Address()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	r, err := s.Compact(ctx, &forky.CompactOptions{
+		Rate: 10,
+	})
+	if err != context.DeadlineExceeded {
+		t.Fatalf("got error %v, want %v", err, context.DeadlineExceeded)
+	}
+	if r.RelocatedChunks == 0 || r.RelocatedChunks >= 10 {
+		t.Errorf("got %v relocated chunks", r.RelocatedChunks)
+	}
+}
+
+// TestStoreCompactRecovery validates that the slot that a chunk is moved
+// from is freed on open if compaction is interrupted after chunk meta is
+// updated, so that the shard file can be compacted further.
+func TestStoreCompactRecovery(t *testing.T) {
+	path, err := ioutil.TempDir("", "swarm-forky-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(path)
+
+	o := &forky.Options{
+		ShardCount: 1,
+		SlotFormat: forky.SlotFormatHeader,
+	}
+	metaStore := mem.NewMetaStore()
+	crashing := &crashingMetaStore{
+		MetaStore: metaStore,
+		block:     make(chan struct{}),
+	}
+	defer close(crashing.block)
+
+	s, err := forky.NewStore(path, chunk.DefaultSize, crashing, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deleted := test.GenerateTestRandomChunk()
+	moved := test.GenerateTestRandomChunk()
+	for _, ch := range []chunk.Chunk{deleted, moved} {
+		if err := s.Put(ch); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Delete(deleted.Address()); err != nil {
+		t.Fatal(err)
+	}
+
+	// simulate a crash after the moved chunk meta is set
+	crashing.crash = true
+	go s.Compact(context.Background(), nil)
+	time.Sleep(100 * time.Millisecond)
+
+	s, err = forky.NewStore(path, chunk.DefaultSize, metaStore, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := s.Get(moved.Address())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got.Data(), moved.Data()) {
+		t.Fatalf("got chunk data %x, want %x", got.Data(), moved.Data())
+	}
+	r, err := s.Compact(context.Background(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.TruncatedSlots != 1 {
+		t.Errorf("got %v truncated slots, want 1", r.TruncatedSlots)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	cr, err := forky.Check(path, chunk.DefaultSize, metaStore, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cr.Problems) != 0 || cr.FreeSlots != 0 || cr.Chunks != 1 {
+		t.Errorf("got check report %+v", cr)
+	}
+}
+
+// crashingMetaStore blocks all Set calls after they are applied, if crash
+// is true, until the block channel is closed.
+type crashingMetaStore struct {
+	forky.MetaStore
+	crash bool
+	block chan struct{}
+}
+
+func (s *crashingMetaStore) Set(addr chunk.Address, shard uint8, reclaimed bool, m *forky.Meta) error {
+	if err := s.MetaStore.Set(addr, shard, reclaimed, m); err != nil {
+		return err
+	}
+	if s.crash {
+		<-s.block
+	}
+	return nil
+}
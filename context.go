@@ -0,0 +1,191 @@
+// Copyright 2019 The Swarm Authors
+// This file is part of the Swarm library.
+//
+// The Swarm library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The Swarm library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the Swarm library. If not, see <http://www.gnu.org/licenses/>.
+
+package forky
+
+import (
+	"context"
+
+	"github.com/ethersphere/swarm/chunk"
+)
+
+// ContextInterface is Interface with methods that return the context error
+// when the context is done before the operation completes.
+type ContextInterface interface {
+	Interface
+	GetContext(ctx context.Context, addr chunk.Address) (ch chunk.Chunk, err error)
+	GetMultiContext(ctx context.Context, addrs ...chunk.Address) (chunks []chunk.Chunk, errs []error, err error)
+	HasContext(ctx context.Context, addr chunk.Address) (yes bool, err error)
+	PutContext(ctx context.Context, ch chunk.Chunk) (err error)
+	PutMultiContext(ctx context.Context, chunks ...chunk.Chunk) (err error)
+	DeleteContext(ctx context.Context, addr chunk.Address) (err error)
+	CountContext(ctx context.Context) (count int, err error)
+	IterateContext(ctx context.Context, fn func(ch chunk.Chunk) (stop bool, err error)) (err error)
+	CloseContext(ctx context.Context) (err error)
+}
+
+var _ ContextInterface = new(Store)
+
+// NewContextStore returns ContextInterface for the store. If the store does
+// not implement it, the context is checked before every call and between
+// iterated chunks.
+func NewContextStore(i Interface) ContextInterface {
+	if c, ok := i.(ContextInterface); ok {
+		return c
+	}
+	return contextStore{Interface: i}
+}
+
+type contextStore struct {
+	Interface
+}
+
+func (s contextStore) GetContext(ctx context.Context, addr chunk.Address) (ch chunk.Chunk, err error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return s.Get(addr)
+}
+
+func (s contextStore) GetMultiContext(ctx context.Context, addrs ...chunk.Address) (chunks []chunk.Chunk, errs []error, err error) {
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+	return s.GetMulti(addrs...)
+}
+
+func (s contextStore) HasContext(ctx context.Context, addr chunk.Address) (yes bool, err error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	return s.Has(addr)
+}
+
+func (s contextStore) PutContext(ctx context.Context, ch chunk.Chunk) (err error) {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.Put(ch)
+}
+
+func (s contextStore) PutMultiContext(ctx context.Context, chunks ...chunk.Chunk) (err error) {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.PutMulti(chunks...)
+}
+
+func (s contextStore) DeleteContext(ctx context.Context, addr chunk.Address) (err error) {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.Delete(addr)
+}
+
+func (s contextStore) CountContext(ctx context.Context) (count int, err error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	return s.Count()
+}
+
+func (s contextStore) IterateContext(ctx context.Context, fn func(ch chunk.Chunk) (stop bool, err error)) (err error) {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.Iterate(func(ch chunk.Chunk) (stop bool, err error) {
+		if err := ctx.Err(); err != nil {
+			return true, err
+		}
+		return fn(ch)
+	})
+}
+
+func (s contextStore) CloseContext(ctx context.Context) (err error) {
+	done := make(chan error, 1)
+	go func() {
+		done <- s.Close()
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// ContextMetaStore is MetaStore with context-aware variants of methods that
+// are called by Store before it changes shard files. MetaStore that does not
+// implement it is wrapped with NewContextMetaStore.
+type ContextMetaStore interface {
+	MetaStore
+	GetContext(ctx context.Context, addr chunk.Address) (*Meta, error)
+	CountContext(ctx context.Context) (int, error)
+	IterateContext(ctx context.Context, fn func(chunk.Address, *Meta) (stop bool, err error)) error
+	IterateFreeOffsetsContext(ctx context.Context, shard uint8, fn func(offset int64) (stop bool, err error)) error
+}
+
+// NewContextMetaStore returns ContextMetaStore for the meta store. If the
+// meta store does not implement it, the context is checked before every call
+// and between iterated chunks.
+func NewContextMetaStore(m MetaStore) ContextMetaStore {
+	if c, ok := m.(ContextMetaStore); ok {
+		return c
+	}
+	return contextMetaStore{MetaStore: m}
+}
+
+type contextMetaStore struct {
+	MetaStore
+}
+
+func (s contextMetaStore) GetContext(ctx context.Context, addr chunk.Address) (*Meta, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return s.Get(addr)
+}
+
+func (s contextMetaStore) CountContext(ctx context.Context) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	return s.Count()
+}
+
+func (s contextMetaStore) IterateContext(ctx context.Context, fn func(chunk.Address, *Meta) (stop bool, err error)) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.Iterate(func(addr chunk.Address, m *Meta) (stop bool, err error) {
+		if err := ctx.Err(); err != nil {
+			return true, err
+		}
+		return fn(addr, m)
+	})
+}
+
+func (s contextMetaStore) IterateFreeOffsetsContext(ctx context.Context, shard uint8, fn func(offset int64) (stop bool, err error)) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.IterateFreeOffsets(shard, func(offset int64) (stop bool, err error) {
+		if err := ctx.Err(); err != nil {
+			return true, err
+		}
+		return fn(offset)
+	})
+}
@@ -0,0 +1,95 @@
+// Copyright 2019 The Swarm Authors
+// This file is part of the Swarm library.
+//
+// The Swarm library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The Swarm library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the Swarm library. If not, see <http://www.gnu.org/licenses/>.
+
+package forky_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/ethersphere/swarm/chunk"
+	"github.com/janos/forky"
+	"github.com/janos/forky/mem"
+	"github.com/janos/forky/test"
+)
+
+func TestStoreContext(t *testing.T) {
+	path, err := ioutil.TempDir("", "swarm-forky-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(path)
+
+	blocking := &blockingMetaStore{
+		MetaStore: mem.NewMetaStore(),
+		block:     make(chan struct{}),
+	}
+	defer close(blocking.block)
+
+	s, err := forky.NewStore(path, chunk.DefaultSize, blocking, &forky.Options{
+		ShardCount: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	chunks := make([]chunk.Chunk, 3)
+	for i := range chunks {
+		chunks[i] = test.GenerateTestRandomChunk()
+		if err := s.Put(chunks[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var count int
+	err = s.IterateContext(ctx, func(chunk.Chunk) (bool, error) {
+		count++
+		cancel()
+		return false, nil
+	})
+	if err != context.Canceled {
+		t.Errorf("got iterate error %v, want %v", err, context.Canceled)
+	}
+	if count != 1 {
+		t.Errorf("got %v iterated chunks, want 1", count)
+	}
+
+	// blocked Delete holds the lock of the only shard
+	blocking.blocked = true
+	blocking.entered = make(chan struct{})
+	go s.Delete(chunks[0].Address())
+	<-blocking.entered
+
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := s.GetContext(ctx, chunks[1].Address()); err != context.DeadlineExceeded {
+		t.Errorf("got error %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := s.CloseContext(ctx); err != context.DeadlineExceeded {
+		t.Errorf("got close error %v, want %v", err, context.DeadlineExceeded)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("close took %v", d)
+	}
+}
@@ -0,0 +1,170 @@
+// Copyright 2019 The Swarm Authors
+// This file is part of the Swarm library.
+//
+// The Swarm library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The Swarm library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the Swarm library. If not, see <http://www.gnu.org/licenses/>.
+
+package forky
+
+import (
+	"sync"
+
+	"github.com/ethersphere/swarm/chunk"
+)
+
+// dataCacheEntryOverhead is the approximate memory used by a single data
+// cache entry in addition to its address and data.
+const dataCacheEntryOverhead = 160
+
+type dataCacheEntry struct {
+	meta Meta
+	data []byte
+}
+
+// dataCache keeps data of frequently read chunks within a memory budget.
+// A new chunk is admitted to the full cache only if it is requested more
+// often than the chunk that would be evicted, as estimated by the frequency
+// sketch of recent requests, so that chunks read only once, for example by
+// a sync of the whole store, do not replace popular ones.
+type dataCache struct {
+	*clockCache
+	sketch *frequencySketch
+}
+
+func newDataCache(maxSize int64, maxChunkSize int) (c *dataCache) {
+	sketch := newFrequencySketch(int(maxSize / (int64(maxChunkSize) + dataCacheEntryOverhead)))
+	return &dataCache{
+		clockCache: newClockCache(maxSize, func(key, victim string) bool {
+			return sketch.estimate(key) > sketch.estimate(victim)
+		}),
+		sketch: sketch,
+	}
+}
+
+// get returns a copy of cached chunk data if it was cached with the same
+// meta. Data cached for a slot that is relocated or reused is never
+// returned, even if it was not removed.
+func (c *dataCache) get(addr chunk.Address, m *Meta) (data []byte, ok bool) {
+	key := string(addr)
+	c.sketch.increment(key)
+	v, ok := c.clockCache.get(key)
+	if ok {
+		e := v.(*dataCacheEntry)
+		if ok = e.meta == *m; ok {
+			data = append([]byte(nil), e.data...)
+		}
+	}
+	c.record(ok)
+	return data, ok
+}
+
+func (c *dataCache) set(addr chunk.Address, m *Meta, data []byte) {
+	key := string(addr)
+	c.clockCache.set(key, &dataCacheEntry{
+		meta: *m,
+		data: append([]byte(nil), data...),
+	}, int64(len(key)+len(data))+dataCacheEntryOverhead)
+}
+
+func (c *dataCache) remove(addr chunk.Address) {
+	c.clockCache.remove(string(addr))
+}
+
+// DataCacheStats returns counters of the chunk data cache. They are all
+// zero if the cache is disabled.
+func (s *Store) DataCacheStats() (stats CacheStats) {
+	if s.dataCache == nil {
+		return stats
+	}
+	return s.dataCache.stats()
+}
+
+// frequencySketchMaxCount is the maximal value of a sketch counter.
+const frequencySketchMaxCount = 15
+
+// frequencySketchMinWidth is the minimal number of counters in a sketch
+// row, so that estimates of small caches are not dominated by collisions.
+const frequencySketchMinWidth = 1024
+
+// frequencySketch is a count-min sketch that estimates how many times keys
+// are requested. All counters are halved after the number of increments
+// reaches ten times the sketch width, so that estimates reflect recent
+// requests.
+type frequencySketch struct {
+	rows       [4][]uint8
+	mask       uint64
+	increments int
+	resetAt    int
+	mu         sync.Mutex
+}
+
+func newFrequencySketch(width int) (s *frequencySketch) {
+	w := frequencySketchMinWidth
+	for w < width {
+		w *= 2
+	}
+	s = &frequencySketch{
+		mask:    uint64(w - 1),
+		resetAt: 10 * w,
+	}
+	for i := range s.rows {
+		s.rows[i] = make([]uint8, w)
+	}
+	return s
+}
+
+func (s *frequencySketch) indexes(key string) (indexes [4]uint64) {
+	h := fnv64a(key)
+	h1, h2 := h&0xffffffff, h>>32|1
+	for i := range indexes {
+		indexes[i] = (h1 + uint64(i)*h2) & s.mask
+	}
+	return indexes
+}
+
+func (s *frequencySketch) increment(key string) {
+	indexes := s.indexes(key)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, j := range indexes {
+		if s.rows[i][j] < frequencySketchMaxCount {
+			s.rows[i][j]++
+		}
+	}
+	s.increments++
+	if s.increments >= s.resetAt {
+		for _, row := range s.rows {
+			for j := range row {
+				row[j] /= 2
+			}
+		}
+		s.increments /= 2
+	}
+}
+
+func (s *frequencySketch) estimate(key string) (count uint8) {
+	indexes := s.indexes(key)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	count = frequencySketchMaxCount
+	for i, j := range indexes {
+		if c := s.rows[i][j]; c < count {
+			count = c
+		}
+	}
+	return count
+}
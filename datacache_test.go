@@ -0,0 +1,104 @@
+// Copyright 2019 The Swarm Authors
+// This file is part of the Swarm library.
+//
+// The Swarm library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The Swarm library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the Swarm library. If not, see <http://www.gnu.org/licenses/>.
+
+package forky
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestFrequencySketch(t *testing.T) {
+	s := newFrequencySketch(64)
+
+	hot := string(generateRandomAddress(32))
+	cold := string(generateRandomAddress(32))
+	for i := 0; i < 5; i++ {
+		s.increment(hot)
+	}
+	s.increment(cold)
+
+	if got := s.estimate(hot); got < 5 {
+		t.Errorf("got hot estimate %v, want at least %v", got, 5)
+	}
+	if got := s.estimate(cold); got < 1 {
+		t.Errorf("got cold estimate %v, want at least %v", got, 1)
+	}
+	for i := 0; i < 100; i++ {
+		s.increment(hot)
+	}
+	if got := s.estimate(hot); got != frequencySketchMaxCount {
+		t.Errorf("got saturated estimate %v, want %v", got, frequencySketchMaxCount)
+	}
+
+	// counters are halved after many increments of other keys
+	for i := 0; i < s.resetAt; i++ {
+		s.increment(string(generateRandomAddress(32)))
+	}
+	if got := s.estimate(hot); got >= frequencySketchMaxCount {
+		t.Errorf("got estimate %v after reset, want less than %v", got, frequencySketchMaxCount)
+	}
+}
+
+func TestDataCacheAdmission(t *testing.T) {
+	const (
+		capacity  = 4
+		chunkSize = 100
+	)
+	addrSize := int64(32)
+	c := newDataCache(capacity*(addrSize+chunkSize+dataCacheEntryOverhead), chunkSize)
+
+	data := make([]byte, chunkSize)
+	m := &Meta{Size: chunkSize}
+	get := func(i int, addr []byte) (ok bool) {
+		t.Helper()
+
+		got, ok := c.get(addr, m)
+		if ok && !bytes.Equal(got, data) {
+			t.Fatalf("got data %v %x, want %x", i, got, data)
+		}
+		if !ok {
+			c.set(addr, m, data)
+		}
+		return ok
+	}
+
+	hot := make([][]byte, capacity)
+	for i := range hot {
+		hot[i] = generateRandomAddress(32)
+		for j := 0; j < 3; j++ {
+			get(i, hot[i])
+		}
+	}
+
+	// chunks that are read once are not admitted to the full cache
+	for i := 0; i < 10*capacity; i++ {
+		get(i, generateRandomAddress(32))
+	}
+	for i, addr := range hot {
+		if !get(i, addr) {
+			t.Errorf("hot chunk %v is evicted", i)
+		}
+	}
+	if stats := c.stats(); stats.Rejections == 0 {
+		t.Error("no rejected chunks")
+	}
+
+	// data cached with different meta is not returned
+	if _, ok := c.get(hot[0], &Meta{Size: chunkSize, Offset: 4096}); ok {
+		t.Error("got data for different meta")
+	}
+}
@@ -0,0 +1,78 @@
+// Copyright 2019 The Swarm Authors
+// This file is part of the Swarm library.
+//
+// The Swarm library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The Swarm library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the Swarm library. If not, see <http://www.gnu.org/licenses/>.
+
+package forky
+
+import (
+	"sync"
+	"unsafe"
+)
+
+func alignedBuffer(size, alignment int) (b []byte) {
+	if alignment <= 1 {
+		return make([]byte, size)
+	}
+	b = make([]byte, size+alignment)
+	o := int(uintptr(unsafe.Pointer(&b[0])) & uintptr(alignment-1))
+	if o != 0 {
+		o = alignment - o
+	}
+	return b[o : o+size : o+size]
+}
+
+// bufferPool reuses aligned buffers of a single size.
+type bufferPool struct {
+	pool sync.Pool
+}
+
+func newBufferPool(size, alignment int) (p *bufferPool) {
+	return &bufferPool{
+		pool: sync.Pool{
+			New: func() interface{} {
+				return alignedBuffer(size, alignment)
+			},
+		},
+	}
+}
+
+func (p *bufferPool) get() (b []byte) {
+	return p.pool.Get().([]byte)
+}
+
+func (p *bufferPool) put(b []byte) {
+	p.pool.Put(b)
+}
+
+func (s *Store) getSlotBuffer(bin uint8) (b []byte) {
+	if s.slotBuffers == nil {
+		return make([]byte, s.layout.slotSize(bin))
+	}
+	return s.slotBuffers[int(bin)/s.shardCount].get()
+}
+
+func (s *Store) putSlotBuffer(bin uint8, b []byte) {
+	if s.slotBuffers == nil {
+		return
+	}
+	s.slotBuffers[int(bin)/s.shardCount].put(b)
+}
+
+func (s *Store) buffer(size int) (b []byte) {
+	if !s.directIO {
+		return make([]byte, size)
+	}
+	return alignedBuffer(size, int(s.layout.slotAlignment))
+}
@@ -0,0 +1,139 @@
+// Copyright 2019 The Swarm Authors
+// This file is part of the Swarm library.
+//
+// The Swarm library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The Swarm library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the Swarm library. If not, see <http://www.gnu.org/licenses/>.
+
+package forky_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"syscall"
+	"testing"
+
+	"github.com/ethersphere/swarm/chunk"
+	"github.com/janos/forky"
+	"github.com/janos/forky/mem"
+	"github.com/janos/forky/test"
+)
+
+func TestStoreDirectIO(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("direct i/o is supported only on linux")
+	}
+	path, err := ioutil.TempDir("", "swarm-forky-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(path)
+
+	o := &forky.Options{
+		ShardCount:    2,
+		SizeClasses:   []int{256},
+		SlotFormat:    forky.SlotFormatHeader,
+		SlotAlignment: 4096,
+		DirectIO:      true,
+	}
+	metaStore := mem.NewMetaStore()
+	s, err := forky.NewStore(path, chunk.DefaultSize, metaStore, o)
+	if err != nil {
+		if e, ok := err.(*os.PathError); ok && e.Err == syscall.EINVAL {
+			t.Skip("direct i/o is not supported by the file system")
+		}
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if m := s.Manifest(); m.SlotSize != 8192 || m.SlotAlignment != 4096 {
+		t.Errorf("got manifest slot size %v and alignment %v, want 8192 and 4096", m.SlotSize, m.SlotAlignment)
+	}
+
+	var chunks []chunk.Chunk
+	for i := 0; i < 40; i++ {
+		ch := test.GenerateTestRandomChunk()
+		if i%2 == 0 {
+			ch = chunk.NewChunk(ch.Address(), ch.Data()[:100])
+		}
+		chunks = append(chunks, ch)
+	}
+	for _, ch := range chunks[:20] {
+		if err := s.Put(ch); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.PutMulti(chunks[20:]...); err != nil {
+		t.Fatal(err)
+	}
+	// deleted slots are marked as free and reused
+	for _, ch := range chunks[:10] {
+		if err := s.Delete(ch.Address()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 10; i++ {
+		ch := test.GenerateTestRandomChunk()
+		if i%2 == 0 {
+			ch = chunk.NewChunk(ch.Address(), ch.Data()[:100])
+		}
+		if err := s.Put(ch); err != nil {
+			t.Fatal(err)
+		}
+		chunks[i] = ch
+	}
+	for _, ch := range chunks {
+		got, err := s.Get(ch.Address())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got.Data(), ch.Data()) {
+			t.Fatalf("got chunk %s data %x, want %x", ch.Address(), got.Data(), ch.Data())
+		}
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := filepath.Glob(filepath.Join(path, "chunks-*.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range files {
+		fi, err := os.Stat(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Size()%4096 != 0 {
+			t.Errorf("file %s size %v is not aligned", file, fi.Size())
+		}
+	}
+	r, err := forky.Check(path, chunk.DefaultSize, metaStore, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Problems) != 0 || r.Chunks != len(chunks) {
+		t.Errorf("got check report %+v", r)
+	}
+
+	_, err = forky.NewStore(path, chunk.DefaultSize, mem.NewMetaStore(), &forky.Options{
+		ShardCount:  2,
+		SizeClasses: []int{256},
+		SlotFormat:  forky.SlotFormatHeader,
+	})
+	if _, ok := err.(*forky.ManifestMismatchError); !ok {
+		t.Errorf("got error %v, want manifest mismatch error", err)
+	}
+}
@@ -0,0 +1,330 @@
+// Copyright 2019 The Swarm Authors
+// This file is part of the Swarm library.
+//
+// The Swarm library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The Swarm library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the Swarm library. If not, see <http://www.gnu.org/licenses/>.
+
+package forky
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/ethersphere/swarm/chunk"
+)
+
+// filterFilename is the name of the file with the persisted filter.
+const filterFilename = "filter.db"
+
+const (
+	// filterBucketSize is the number of fingerprints in a bucket.
+	filterBucketSize = 4
+	// filterMaxKicks is the maximal number of fingerprints relocated by
+	// a single insertion before the filter is considered full.
+	filterMaxKicks = 500
+)
+
+// cuckooFilter is an approximate set of stored chunk addresses that
+// supports removals. Every address is represented by a 16 bit fingerprint
+// in one of its two buckets, so that absent addresses are reported as
+// stored with the probability of about 0.01%, while stored addresses are
+// always reported. If a fingerprint can not be inserted, the filter becomes
+// full and reports all addresses as possibly stored until it is rebuilt.
+type cuckooFilter struct {
+	buckets []uint16
+	mask    uint64
+	count   int
+	full    bool
+	rand    *rand.Rand
+	mu      sync.RWMutex
+}
+
+func newCuckooFilter(capacity int) (f *cuckooFilter) {
+	n := 1
+	for n*filterBucketSize*9/10 < capacity {
+		n *= 2
+	}
+	return &cuckooFilter{
+		buckets: make([]uint16, n*filterBucketSize),
+		mask:    uint64(n - 1),
+		rand:    rand.New(rand.NewSource(rand.Int63())),
+	}
+}
+
+func (f *cuckooFilter) capacity() (c int) {
+	return len(f.buckets) * 9 / 10
+}
+
+func (f *cuckooFilter) locate(addr chunk.Address) (fp uint16, i1, i2 uint64) {
+	h := fnv64a(string(addr))
+	fp = uint16(h >> 48)
+	if fp == 0 {
+		fp = 1
+	}
+	i1 = h & f.mask
+	return fp, i1, f.alternate(i1, fp)
+}
+
+// alternate returns the other bucket index of the fingerprint in the
+// bucket i, so that a fingerprint can be relocated without its address.
+func (f *cuckooFilter) alternate(i uint64, fp uint16) uint64 {
+	return (i ^ uint64(fp)*0x5bd1e995) & f.mask
+}
+
+func (f *cuckooFilter) bucket(i uint64) (b []uint16) {
+	return f.buckets[i*filterBucketSize : (i+1)*filterBucketSize]
+}
+
+func (f *cuckooFilter) contains(addr chunk.Address) (yes bool) {
+	fp, i1, i2 := f.locate(addr)
+
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	if f.full {
+		return true
+	}
+	for _, i := range []uint64{i1, i2} {
+		for _, v := range f.bucket(i) {
+			if v == fp {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (f *cuckooFilter) add(addr chunk.Address) {
+	fp, i1, i2 := f.locate(addr)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.full {
+		return
+	}
+	if f.insert(i1, fp) || f.insert(i2, fp) {
+		f.count++
+		return
+	}
+	i := i1
+	if f.rand.Intn(2) == 1 {
+		i = i2
+	}
+	for k := 0; k < filterMaxKicks; k++ {
+		b := f.bucket(i)
+		j := f.rand.Intn(filterBucketSize)
+		fp, b[j] = b[j], fp
+		i = f.alternate(i, fp)
+		if f.insert(i, fp) {
+			f.count++
+			return
+		}
+	}
+	// the last relocated fingerprint is lost
+	f.full = true
+}
+
+func (f *cuckooFilter) insert(i uint64, fp uint16) (ok bool) {
+	b := f.bucket(i)
+	for j, v := range b {
+		if v == 0 {
+			b[j] = fp
+			return true
+		}
+	}
+	return false
+}
+
+// remove removes a single fingerprint of the address, which must be added
+// before, as otherwise a fingerprint of another address may be removed.
+func (f *cuckooFilter) remove(addr chunk.Address) {
+	fp, i1, i2 := f.locate(addr)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.full {
+		return
+	}
+	for _, i := range []uint64{i1, i2} {
+		b := f.bucket(i)
+		for j, v := range b {
+			if v == fp {
+				b[j] = 0
+				f.count--
+				return
+			}
+		}
+	}
+}
+
+// writeFilter writes the filter to the filter file in the store directory.
+// The file is written completely before it replaces the previous one. A full
+// filter is not written, so that it is rebuilt larger on open.
+func writeFilter(path string, filter *cuckooFilter) (err error) {
+	filter.mu.RLock()
+	defer filter.mu.RUnlock()
+
+	if filter.full {
+		return nil
+	}
+
+	filename := filepath.Join(path, filterFilename)
+	f, err := os.Create(filename + ".tmp")
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(len(filter.buckets)))
+	_, err = w.Write(b)
+	if err == nil {
+		binary.BigEndian.PutUint64(b, uint64(filter.count))
+		_, err = w.Write(b)
+	}
+	for _, v := range filter.buckets {
+		if err != nil {
+			break
+		}
+		binary.BigEndian.PutUint16(b, v)
+		_, err = w.Write(b[:2])
+	}
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(filename+".tmp", filename)
+}
+
+func readFilter(path string) (filter *cuckooFilter, err error) {
+	f, err := os.Open(filepath.Join(path, filterFilename))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	b := make([]byte, 16)
+	if _, err := io.ReadFull(r, b); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, nil
+		}
+		return nil, err
+	}
+	size := binary.BigEndian.Uint64(b[:8])
+	n := size / filterBucketSize
+	if n == 0 || n&(n-1) != 0 || size%filterBucketSize != 0 {
+		return nil, nil
+	}
+	filter = &cuckooFilter{
+		buckets: make([]uint16, size),
+		mask:    n - 1,
+		count:   int(binary.BigEndian.Uint64(b[8:])),
+		rand:    rand.New(rand.NewSource(rand.Int63())),
+	}
+	for i := range filter.buckets {
+		if _, err := io.ReadFull(r, b[:2]); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return nil, nil
+			}
+			return nil, err
+		}
+		filter.buckets[i] = binary.BigEndian.Uint16(b[:2])
+	}
+	return filter, nil
+}
+
+func removeFilter(path string) (err error) {
+	err = os.Remove(filepath.Join(path, filterFilename))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// openFilter loads the persisted filter or rebuilds it from chunk meta, if
+// it is not persisted, it can not hold the capacity or rebuild is true. The
+// filter file is removed until Close, so that the filter is rebuilt if the
+// store is not closed properly.
+func (s *Store) openFilter(path string, capacity int, rebuild bool) (err error) {
+	var filter *cuckooFilter
+	if !rebuild {
+		filter, err = readFilter(path)
+		if err != nil {
+			return err
+		}
+	}
+	if err := removeFilter(path); err != nil {
+		return err
+	}
+	if filter == nil || filter.full || filter.capacity() < capacity {
+		count, err := s.meta.Count()
+		if err != nil {
+			return err
+		}
+		// leave room for new chunks
+		if 2*count > capacity {
+			capacity = 2 * count
+		}
+		filter = newCuckooFilter(capacity)
+		if err := s.meta.Iterate(func(addr chunk.Address, _ *Meta) (stop bool, err error) {
+			filter.add(addr)
+			return false, nil
+		}); err != nil {
+			return err
+		}
+	}
+	s.filter = filter
+	return nil
+}
+
+// filterAdd returns true if Put must add the address to the filter, which
+// is when the chunk is not already stored, so that fingerprints of chunks
+// that are stored more than once are not duplicated. The shard lock must
+// be held at least for reading.
+func (s *Store) filterAdd(ctx context.Context, addr chunk.Address) (add bool, err error) {
+	if s.filter == nil {
+		return false, nil
+	}
+	if !s.filter.contains(addr) {
+		return true, nil
+	}
+	if _, err := s.getMeta(ctx, addr); err != nil {
+		if err == chunk.ErrChunkNotFound {
+			return true, nil
+		}
+		return false, err
+	}
+	return false, nil
+}
@@ -0,0 +1,154 @@
+// Copyright 2019 The Swarm Authors
+// This file is part of the Swarm library.
+//
+// The Swarm library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The Swarm library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the Swarm library. If not, see <http://www.gnu.org/licenses/>.
+
+package forky_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ethersphere/swarm/chunk"
+	"github.com/janos/forky"
+	"github.com/janos/forky/mem"
+	"github.com/janos/forky/test"
+)
+
+func TestStoreFilter(t *testing.T) {
+	path, err := ioutil.TempDir("", "swarm-forky-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(path)
+
+	metaStore := &countingMetaStore{MetaStore: mem.NewMetaStore()}
+	o := &forky.Options{
+		MetaCacheSize:  -1,
+		FilterCapacity: 1000,
+		PersistFilter:  true,
+	}
+	s, err := forky.NewStore(path, chunk.DefaultSize, metaStore, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	chunks := make([]chunk.Chunk, 10)
+	for i := range chunks {
+		chunks[i] = test.GenerateTestRandomChunk()
+	}
+	if err := s.PutMulti(chunks[:5]...); err != nil {
+		t.Fatal(err)
+	}
+	for _, ch := range chunks[5:] {
+		if err := s.Put(ch); err != nil {
+			t.Fatal(err)
+		}
+	}
+	deleted := chunks[0]
+	if err := s.Delete(deleted.Address()); err != nil {
+		t.Fatal(err)
+	}
+
+	// absent chunks are mostly not looked up in MetaStore
+	check := func(s *forky.Store) {
+		t.Helper()
+
+		for _, ch := range chunks[1:] {
+			if _, err := s.Get(ch.Address()); err != nil {
+				t.Fatal(err)
+			}
+		}
+		gets := metaStore.gets
+		if _, err := s.Get(deleted.Address()); err != chunk.ErrChunkNotFound {
+			t.Fatalf("got error %v, want %v", err, chunk.ErrChunkNotFound)
+		}
+		for i := 0; i < 100; i++ {
+			has, err := s.Has(test.GenerateTestRandomChunk().Address())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if has {
+				t.Fatal("absent chunk found")
+			}
+		}
+		if got := metaStore.gets - gets; got > 1 {
+			t.Errorf("got %v MetaStore gets for absent chunks", got)
+		}
+	}
+	check(s)
+
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(path, "filter.db")); err != nil {
+		t.Fatal(err)
+	}
+
+	// the persisted filter is loaded without iterating over MetaStore
+	metaStore.iterations = 0
+	s, err = forky.NewStore(path, chunk.DefaultSize, metaStore, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metaStore.iterations != 0 {
+		t.Error("filter is rebuilt")
+	}
+	check(s)
+
+	// the persisted filter does not contain chunks stored without it
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	s, err = forky.NewStore(path, chunk.DefaultSize, metaStore, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	added := test.GenerateTestRandomChunk()
+	if err := s.Put(added); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	s, err = forky.NewStore(path, chunk.DefaultSize, metaStore, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if _, err := s.Get(added.Address()); err != nil {
+		t.Fatal(err)
+	}
+	check(s)
+}
+
+// countingMetaStore counts Get and Iterate calls.
+type countingMetaStore struct {
+	forky.MetaStore
+	gets       int
+	iterations int
+}
+
+func (s *countingMetaStore) Get(addr chunk.Address) (*forky.Meta, error) {
+	s.gets++
+	return s.MetaStore.Get(addr)
+}
+
+func (s *countingMetaStore) Iterate(fn func(chunk.Address, *forky.Meta) (stop bool, err error)) error {
+	s.iterations++
+	return s.MetaStore.Iterate(fn)
+}
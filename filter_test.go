@@ -0,0 +1,129 @@
+// Copyright 2019 The Swarm Authors
+// This file is part of the Swarm library.
+//
+// The Swarm library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The Swarm library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the Swarm library. If not, see <http://www.gnu.org/licenses/>.
+
+package forky
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/ethersphere/swarm/chunk"
+)
+
+func TestCuckooFilter(t *testing.T) {
+	const capacity = 10000
+
+	f := newCuckooFilter(capacity)
+	if f.capacity() < capacity {
+		t.Fatalf("got capacity %v, want at least %v", f.capacity(), capacity)
+	}
+
+	addrs := make([]chunk.Address, capacity)
+	for i := range addrs {
+		addrs[i] = generateRandomAddress(32)
+		f.add(addrs[i])
+	}
+	if f.full {
+		t.Fatal("filter is full")
+	}
+	for i, addr := range addrs {
+		if !f.contains(addr) {
+			t.Fatalf("address %v not found", i)
+		}
+	}
+
+	var falsePositives int
+	for i := 0; i < capacity; i++ {
+		if f.contains(generateRandomAddress(32)) {
+			falsePositives++
+		}
+	}
+	// the expected rate is about 0.01%
+	if falsePositives > capacity/1000 {
+		t.Errorf("got %v false positives of %v", falsePositives, capacity)
+	}
+
+	for _, addr := range addrs[:capacity/2] {
+		f.remove(addr)
+	}
+	if f.count != capacity-capacity/2 {
+		t.Errorf("got count %v, want %v", f.count, capacity-capacity/2)
+	}
+	for i, addr := range addrs[capacity/2:] {
+		if !f.contains(addr) {
+			t.Fatalf("address %v not found after removals", i)
+		}
+	}
+
+	// full filter reports all addresses as possibly stored
+	f = newCuckooFilter(1)
+	for !f.full {
+		f.add(generateRandomAddress(32))
+	}
+	if !f.contains(generateRandomAddress(32)) {
+		t.Error("address not found in full filter")
+	}
+}
+
+func TestCuckooFilterFile(t *testing.T) {
+	path, err := ioutil.TempDir("", "swarm-forky-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(path)
+
+	if f, err := readFilter(path); err != nil || f != nil {
+		t.Fatalf("got filter %v and error %v, want none", f, err)
+	}
+
+	f := newCuckooFilter(100)
+	for i := 0; i < 50; i++ {
+		f.add(generateRandomAddress(32))
+	}
+	if err := writeFilter(path, f); err != nil {
+		t.Fatal(err)
+	}
+	got, err := readFilter(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got.buckets, f.buckets) || got.mask != f.mask || got.count != f.count {
+		t.Error("read filter is not the same as written")
+	}
+
+	// incomplete file is ignored
+	filename := filepath.Join(path, filterFilename)
+	fi, err := os.Stat(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(filename, fi.Size()-1); err != nil {
+		t.Fatal(err)
+	}
+	if f, err := readFilter(path); err != nil || f != nil {
+		t.Errorf("got filter %v and error %v for incomplete file, want none", f, err)
+	}
+
+	if err := removeFilter(path); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filename); !os.IsNotExist(err) {
+		t.Errorf("got error %v, want not exist", err)
+	}
+}
@@ -17,9 +17,11 @@
 package forky
 
 import (
+	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
 	"os"
 	"path/filepath"
@@ -31,102 +33,462 @@ import (
 
 type Interface interface {
 	Get(addr chunk.Address) (ch chunk.Chunk, err error)
+	GetMulti(addrs ...chunk.Address) (chunks []chunk.Chunk, errs []error, err error)
 	Has(addr chunk.Address) (yes bool, err error)
 	Put(ch chunk.Chunk) (err error)
+	PutMulti(chunks ...chunk.Chunk) (err error)
 	Delete(addr chunk.Address) (err error)
 	Count() (count int, err error)
 	Iterate(func(ch chunk.Chunk) (stop bool, err error)) (err error)
 	Close() (err error)
 }
 
-const shardCount = 32
-
-var ErrDBClosed = errors.New("closed database")
+var (
+	ErrDBClosed       = errors.New("closed database")
+	ErrChunkCorrupted = errors.New("corrupted chunk")
+)
 
 var _ Interface = new(Store)
 
 type Store struct {
-	shards       map[uint8]*os.File
-	shardsMu     map[uint8]*sync.Mutex
-	meta         MetaStore
-	free         map[uint8]struct{}
-	freeMu       sync.RWMutex
-	metaCache    *metaCache
-	freeCache    *offsetCache
-	wg           sync.WaitGroup
-	maxChunkSize int
-	quit         chan struct{}
-	quitOnce     sync.Once
-}
-
-func NewStore(path string, maxChunkSize int, metaStore MetaStore, noCache bool) (s *Store, err error) {
-	shards := make(map[byte]*os.File, shardCount)
-	shardsMu := make(map[uint8]*sync.Mutex)
-	for i := byte(0); i < shardCount; i++ {
-		shards[i], err = os.OpenFile(filepath.Join(path, fmt.Sprintf("chunks-%v.db", i)), os.O_CREATE|os.O_RDWR, 0666)
+	// shards are files for every bin of the layout
+	shards        []*os.File
+	shardsMu      []shardLock
+	shardCount    int
+	shardFunc     ShardFunc
+	layout        layout
+	allocators    []*allocator
+	meta          MetaStore
+	metaContext   ContextMetaStore
+	free          map[uint8]struct{}
+	freeMu        sync.RWMutex
+	metaCache     *metaCache
+	freeCache     *offsetCache
+	dataCache     *dataCache
+	filter        *cuckooFilter
+	persistFilter bool
+	warmUp        *warmUp
+	wg            sync.WaitGroup
+	maxChunkSize  int
+	slotFormat    SlotFormat
+	validators    []Validator
+	validateOnGet bool
+	journal       *journal
+	manifest      *Manifest
+	compactions   []*compaction
+	syncMode      SyncMode
+	committer     *groupCommitter
+	mmaps         []*mmapReader
+	mmapView      bool
+	directIO      bool
+	slotBuffers   []*bufferPool
+	ends          *dataEnds
+	bitmaps       []*freeBitmap
+	path          string
+	quit          chan struct{}
+	quitOnce      sync.Once
+}
+
+type Options struct {
+	// MetaCacheSize is the approximate memory budget in bytes of the chunk
+	// meta cache. If zero, DefaultMetaCacheSize is used, and if negative,
+	// chunk meta is not cached.
+	MetaCacheSize int64
+	// FreeCacheSize is the maximal number of cached free offsets. If zero,
+	// DefaultFreeCacheSize is used, and if negative, free offsets are not
+	// cached.
+	FreeCacheSize int
+	// DataCacheSize is the approximate memory budget in bytes of the cache
+	// of data of frequently read chunks. Chunk data is cached only if it
+	// is positive.
+	DataCacheSize int64
+	// FilterCapacity enables an in-memory cuckoo filter of stored chunks
+	// with room for at least this number of chunks, so that Has and Get of
+	// absent chunks mostly do not read MetaStore. The filter is rebuilt from
+	// MetaStore when the store is opened, with room for at least twice the
+	// number of stored chunks.
+	FilterCapacity int
+	// PersistFilter writes the filter to a file on Close, so that it is
+	// loaded instead of rebuilt when the store is opened again.
+	PersistFilter bool
+	// WarmUp fills the chunk meta cache with meta from MetaStore in the
+	// background after the store is opened, until the cache is full.
+	WarmUp bool
+	// WarmUpRate is the maximal number of chunks per second iterated over
+	// by the warm-up. If zero, the warm-up is not limited.
+	WarmUpRate int
+	// Validators are called for every chunk on Put.
+	Validators []Validator
+	// ValidateOnGet enables validation of chunks returned by Get and Iterate.
+	ValidateOnGet bool
+	// ShardCount is the number of shard files. If zero, DefaultShardCount
+	// is used.
+	ShardCount int
+	// ShardFunc selects the shard file for the chunk address.
+	ShardFunc ShardFunc
+	// SlotFormat defines if slots in shard files contain headers.
+	SlotFormat SlotFormat
+	// SizeClasses are data sizes smaller than the maximal chunk size with
+	// separate shard files, so that small chunks are written into smaller
+	// slots.
+	SizeClasses []int
+	// NoJournal disables the intent journal that is used to recover
+	// from interrupted Put and Delete calls.
+	NoJournal bool
+	// SyncMode defines when shard files and MetaStore are synced.
+	SyncMode SyncMode
+	// SyncInterval is the period of SyncInterval mode. If zero,
+	// DefaultSyncInterval is used.
+	SyncInterval time.Duration
+	// GroupCommit enables coalescing of MetaStore writes of concurrent Puts
+	// and Deletes. MetaStore must implement GroupMetaStore.
+	GroupCommit bool
+	// SlotAlignment rounds sizes of slots of all size classes up to its
+	// multiple, which must be a power of two. It is recorded in the store
+	// manifest and can not be changed for an existing store.
+	SlotAlignment int
+	// DirectIO opens shard files with O_DIRECT, so that chunk data bypasses
+	// the page cache, which is supported only on Linux. If SlotAlignment is
+	// zero, the block size of the file system is used.
+	DirectIO bool
+	// PreallocateSize is the size of extents by which shard files are
+	// preallocated, so that they grow in large contiguous parts and Put
+	// returns ErrDiskFull before chunk data is written if there is not
+	// enough disk space. Disk space is allocated only on Linux. The end of
+	// data in shard files is recorded separately from their sizes, and it
+	// is also maintained when the store is opened again without
+	// preallocation.
+	PreallocateSize int64
+	// FreeBitmap keeps free slots of every shard file in a bitmap in memory,
+	// instead of free offsets in MetaStore, so that the lowest free slot is
+	// reused first without MetaStore lookups. Bitmaps are written to disk on
+	// Close and rebuilt from chunk meta if the store is not closed properly.
+	// Once enabled, bitmaps are used whenever the store is opened.
+	FreeBitmap bool
+	// Mmap enables reading chunk data from memory mapped shard files,
+	// which is supported only on Linux.
+	Mmap bool
+	// MmapView makes Get, GetMulti and Iterate return chunks with data that
+	// references the mapped shard file instead of a copy. Chunk data must
+	// not be modified, and not used after the chunk is deleted, as its slot
+	// may be reused. Compaction is not supported with views. It requires
+	// Mmap to be true.
+	MmapView bool
+}
+
+func NewStore(path string, maxChunkSize int, metaStore MetaStore, o *Options) (s *Store, err error) {
+	if o == nil {
+		o = new(Options)
+	}
+	if _, err := os.Stat(filepath.Join(path, reshardDirname)); err == nil {
+		return nil, ErrReshardInProgress
+	}
+	if o.SyncMode > SyncBatch {
+		return nil, fmt.Errorf("invalid sync mode %v", o.SyncMode)
+	}
+	if o.MmapView && !o.Mmap {
+		return nil, errors.New("mmap view requires mmap")
+	}
+	if o.Mmap && !mmapSupported {
+		return nil, errors.New("mmap is not supported on this platform")
+	}
+	openFlag := os.O_CREATE | os.O_RDWR
+	if o.DirectIO {
+		if !directIOSupported {
+			return nil, errors.New("direct i/o is not supported on this platform")
+		}
+		if o.Mmap {
+			return nil, errors.New("mmap can not be used with direct i/o")
+		}
+		if o.SlotAlignment == 0 {
+			size, err := blockSize(path)
+			if err != nil {
+				return nil, err
+			}
+			opts := *o
+			opts.SlotAlignment = size
+			o = &opts
+		}
+		openFlag |= directIOFlag
+	}
+	var groupMetaStore GroupMetaStore
+	if o.GroupCommit {
+		var ok bool
+		groupMetaStore, ok = metaStore.(GroupMetaStore)
+		if !ok {
+			return nil, errors.New("group commit is not supported by meta store")
+		}
+	}
+	manifest, err := openManifest(path, maxChunkSize, o)
+	if err != nil {
+		return nil, err
+	}
+	l, err := newLayout(maxChunkSize, o)
+	if err != nil {
+		return nil, err
+	}
+	shards := make([]*os.File, l.binCount())
+	for i := range shards {
+		shards[i], err = os.OpenFile(filepath.Join(path, l.filename(uint8(i))), openFlag, 0666)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if o.PreallocateSize < 0 {
+		return nil, fmt.Errorf("invalid preallocate size %v", o.PreallocateSize)
+	}
+	var ends *dataEnds
+	if _, err := os.Stat(filepath.Join(path, endsFilename)); err == nil || o.PreallocateSize > 0 {
+		ends, err = openDataEnds(path)
 		if err != nil {
 			return nil, err
 		}
-		shardsMu[i] = new(sync.Mutex)
+	}
+	allocators := make([]*allocator, l.binCount())
+	for i := range allocators {
+		allocators[i], err = newAllocator(shards[i], uint8(i), l.slotSize(uint8(i)), ends, o.PreallocateSize)
+		if err != nil {
+			return nil, err
+		}
+	}
+	shardsMu := make([]shardLock, l.shardCount)
+	for i := range shardsMu {
+		shardsMu[i] = newShardLock()
 	}
 	var (
 		metaCache *metaCache
 		freeCache *offsetCache
 	)
-	if !noCache {
-		metaCache = newMetaCache()
-		freeCache = newOffsetCache(shardCount)
-	}
-	return &Store{
-		shards:       shards,
-		shardsMu:     shardsMu,
-		meta:         metaStore,
-		metaCache:    metaCache,
-		freeCache:    freeCache,
-		free:         make(map[uint8]struct{}),
-		maxChunkSize: maxChunkSize,
-		quit:         make(chan struct{}),
-	}, nil
+	if size := o.MetaCacheSize; size >= 0 {
+		if size == 0 {
+			size = DefaultMetaCacheSize
+		}
+		metaCache = newMetaCache(size)
+	}
+	if size := o.FreeCacheSize; size >= 0 {
+		if size == 0 {
+			size = DefaultFreeCacheSize
+		}
+		freeCache = newOffsetCache(l.binCount(), size)
+	}
+	var dataCache *dataCache
+	if o.DataCacheSize > 0 {
+		dataCache = newDataCache(o.DataCacheSize, maxChunkSize)
+	}
+	s = &Store{
+		shards:        shards,
+		shardsMu:      shardsMu,
+		shardCount:    l.shardCount,
+		shardFunc:     o.ShardFunc,
+		layout:        l,
+		allocators:    allocators,
+		meta:          metaStore,
+		metaContext:   NewContextMetaStore(metaStore),
+		metaCache:     metaCache,
+		freeCache:     freeCache,
+		dataCache:     dataCache,
+		free:          make(map[uint8]struct{}),
+		maxChunkSize:  maxChunkSize,
+		slotFormat:    o.SlotFormat,
+		validators:    o.Validators,
+		validateOnGet: o.ValidateOnGet,
+		manifest:      manifest,
+		compactions:   make([]*compaction, l.binCount()),
+		syncMode:      o.SyncMode,
+		mmapView:      o.MmapView,
+		directIO:      o.DirectIO,
+		ends:          ends,
+		persistFilter: o.PersistFilter,
+		path:          path,
+		quit:          make(chan struct{}),
+	}
+	if o.DirectIO {
+		s.slotBuffers = make([]*bufferPool, len(l.classes))
+		for class := range s.slotBuffers {
+			s.slotBuffers[class] = newBufferPool(int(l.slotSize(uint8(class*l.shardCount))), o.SlotAlignment)
+		}
+	}
+	if o.Mmap {
+		s.mmaps = make([]*mmapReader, len(shards))
+		for i, f := range shards {
+			s.mmaps[i] = newMmapReader(f, o.MmapView)
+		}
+	}
+	var pending []*journalRecord
+	if !o.NoJournal {
+		var j *journal
+		// intents must be durable before the slots are written if chunks
+		// are expected to be durable after Put returns
+		j, pending, err = openJournal(filepath.Join(path, journalFilename), s.syncMode == SyncAlways || s.syncMode == SyncBatch)
+		if err != nil {
+			return nil, err
+		}
+		s.journal = j
+	}
+	freeBitmap := o.FreeBitmap
+	if !freeBitmap {
+		freeBitmap, err = hasFreeBitmap(path)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if freeBitmap {
+		// stores with pending journal records are not closed properly
+		if err := s.openFreeBitmaps(path, len(pending) > 0); err != nil {
+			return nil, err
+		}
+		s.freeCache = nil
+	}
+	if s.journal != nil {
+		if err := s.recover(pending); err != nil {
+			return nil, err
+		}
+	}
+	if o.FilterCapacity > 0 {
+		if err := s.openFilter(path, o.FilterCapacity, !o.PersistFilter); err != nil {
+			return nil, err
+		}
+	} else if err := removeFilter(path); err != nil {
+		// the filter file would not be updated until the next open
+		return nil, err
+	}
+	if groupMetaStore != nil {
+		var syncFunc func() error
+		if o.SyncMode == SyncAlways {
+			syncFunc = s.syncMeta
+		}
+		s.committer = newGroupCommitter(groupMetaStore, syncFunc)
+	}
+	if o.SyncMode == SyncInterval {
+		interval := o.SyncInterval
+		if interval <= 0 {
+			interval = DefaultSyncInterval
+		}
+		s.wg.Add(1)
+		go s.syncLoop(interval)
+	}
+	if o.WarmUp && s.metaCache != nil {
+		s.warmUp = newWarmUp()
+		s.wg.Add(1)
+		go s.warmUpMetaCache(o.WarmUpRate)
+	}
+	return s, nil
+}
+
+// Manifest returns the layout description of the store.
+func (s *Store) Manifest() (m Manifest) {
+	return *s.manifest
 }
 
 func (s *Store) Get(addr chunk.Address) (ch chunk.Chunk, err error) {
+	return s.GetContext(context.Background(), addr)
+}
+
+// GetContext returns the chunk with the address, or the context error if the
+// context is done while waiting for the shard lock or chunk meta. The shard
+// is locked only for reading, so that Gets do not block each other and wait
+// only for methods that change slots of the shard.
+func (s *Store) GetContext(ctx context.Context, addr chunk.Address) (ch chunk.Chunk, err error) {
 	done, err := s.protect()
 	if err != nil {
 		return nil, err
 	}
 	defer done()
 
-	mu := s.shardsMu[getShard(addr)]
-	mu.Lock()
-	defer mu.Unlock()
+	shard := s.getShard(addr)
+	mu := s.shardsMu[shard]
+	if err := mu.RLockContext(ctx); err != nil {
+		return nil, err
+	}
+	defer mu.RUnlock()
 
-	m, err := s.getMeta(addr)
+	m, err := s.getMeta(ctx, addr)
 	if err != nil {
 		return nil, err
 	}
-	data := make([]byte, m.Size)
-	n, err := s.shards[getShard(addr)].ReadAt(data, m.Offset)
+	return s.readChunk(shard, addr, m)
+}
+
+// readChunk reads and verifies data of the chunk with the meta, or returns
+// its data from the data cache. The shard lock must be held at least
+// for reading.
+func (s *Store) readChunk(shard uint8, addr chunk.Address, m *Meta) (ch chunk.Chunk, err error) {
+	var (
+		data   []byte
+		cached bool
+	)
+	if s.dataCache != nil {
+		data, cached = s.dataCache.get(addr, m)
+	}
+	if !cached {
+		data, err = s.readData(s.layout.bin(shard, int(m.Size)), m)
+		if err != nil {
+			return nil, err
+		}
+		if !m.valid(data) {
+			return nil, ErrChunkCorrupted
+		}
+	}
+	ch = chunk.NewChunk(addr, data)
+	if s.validateOnGet {
+		if err := s.validate(ch); err != nil {
+			return nil, err
+		}
+	}
+	if !cached && s.dataCache != nil {
+		s.dataCache.set(addr, m, data)
+	}
+	return ch, nil
+}
+
+func (s *Store) readData(bin uint8, m *Meta) (data []byte, err error) {
+	offset := m.Offset + s.slotFormat.headerSize()
+	if s.mmaps != nil {
+		return s.mmaps[bin].read(offset, int(m.Size), s.mmapView)
+	}
+	if s.directIO {
+		// direct i/o reads whole aligned slots
+		slot := s.getSlotBuffer(bin)
+		defer s.putSlotBuffer(bin, slot)
+
+		n, err := s.shards[bin].ReadAt(slot, m.Offset)
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		if n < int(s.slotFormat.headerSize())+int(m.Size) {
+			return nil, fmt.Errorf("incomplete chunk data, read %v of %v", n, m.Size)
+		}
+		return append([]byte(nil), slot[offset-m.Offset:][:m.Size]...), nil
+	}
+	data = make([]byte, m.Size)
+	n, err := s.shards[bin].ReadAt(data, offset)
 	if err != nil && err != io.EOF {
 		return nil, err
 	}
 	if n != int(m.Size) {
 		return nil, fmt.Errorf("incomplete chunk data, read %v of %v", n, m.Size)
 	}
-	return chunk.NewChunk(addr, data), nil
+	return data, nil
 }
 
 func (s *Store) Has(addr chunk.Address) (yes bool, err error) {
+	return s.HasContext(context.Background(), addr)
+}
+
+func (s *Store) HasContext(ctx context.Context, addr chunk.Address) (yes bool, err error) {
 	done, err := s.protect()
 	if err != nil {
 		return false, err
 	}
 	defer done()
 
-	mu := s.shardsMu[getShard(addr)]
-	mu.Lock()
-	defer mu.Unlock()
+	mu := s.shardsMu[s.getShard(addr)]
+	if err := mu.RLockContext(ctx); err != nil {
+		return false, err
+	}
+	defer mu.RUnlock()
 
-	m, err := s.getMeta(addr)
+	m, err := s.getMeta(ctx, addr)
 	if err != nil {
 		if err == chunk.ErrChunkNotFound {
 			return false, nil
@@ -140,6 +502,15 @@ func (s *Store) Has(addr chunk.Address) (yes bool, err error) {
 }
 
 func (s *Store) Put(ch chunk.Chunk) (err error) {
+	return s.PutContext(context.Background(), ch)
+}
+
+// PutContext stores the chunk. The context is honoured only until the slot
+// for the chunk is allocated, after that the chunk is stored regardless
+// of it, so that shard files and MetaStore remain consistent. Puts to the
+// same shard write chunk data concurrently and wait only for Deletes and
+// compaction of the shard.
+func (s *Store) PutContext(ctx context.Context, ch chunk.Chunk) (err error) {
 	done, err := s.protect()
 	if err != nil {
 		return err
@@ -147,138 +518,302 @@ func (s *Store) Put(ch chunk.Chunk) (err error) {
 	defer done()
 
 	addr := ch.Address()
-	shard := getShard(addr)
-	f := s.shards[shard]
 	data := ch.Data()
-	section := make([]byte, s.maxChunkSize)
-	copy(section, data)
-
-	s.freeMu.RLock()
-	_, hasFree := s.free[shard]
-	s.freeMu.RUnlock()
-
-	var offset int64
-	var reclaimed bool
-	mu := s.shardsMu[shard]
-	mu.Lock()
-	if hasFree {
-		var freeOffset int64 = -1
-		if s.freeCache != nil {
-			freeOffset = s.freeCache.get(shard)
-		}
-		if freeOffset < 0 {
-			freeOffset, err = s.meta.FreeOffset(shard)
-			if err != nil {
-				return err
-			}
+	if len(data) > s.maxChunkSize {
+		return &InvalidChunkError{
+			Address: addr,
+			Err:     fmt.Errorf("data size %v exceeds maximal chunk size %v", len(data), s.maxChunkSize),
 		}
-		if freeOffset < 0 {
-			offset, err = f.Seek(0, io.SeekEnd)
-			if err != nil {
-				mu.Unlock()
-				return err
-			}
-			s.freeMu.Lock()
-			delete(s.free, shard)
-			s.freeMu.Unlock()
-		} else {
-			offset, err = f.Seek(freeOffset, io.SeekStart)
-			if err != nil {
-				mu.Unlock()
-				return err
-			}
-			reclaimed = true
+	}
+	if err := s.validate(ch); err != nil {
+		return err
+	}
+	sum := checksum(data)
+	shard := s.getShard(addr)
+	bin := s.layout.bin(shard, len(data))
+	section := s.getSlotBuffer(bin)
+	defer s.putSlotBuffer(bin, section)
+	if s.directIO {
+		// reused buffers contain data of previous chunks
+		for i := range section {
+			section[i] = 0
 		}
-	} else {
-		offset, err = f.Seek(0, io.SeekEnd)
+	}
+	if s.slotFormat == SlotFormatHeader {
+		header, err := (&slotHeader{
+			flags: slotFlagUsed,
+			addr:  addr,
+			size:  uint16(len(data)),
+			sum:   sum,
+		}).MarshalBinary()
 		if err != nil {
-			mu.Unlock()
 			return err
 		}
+		copy(section, header)
+	}
+	copy(section[s.slotFormat.headerSize():], data)
+
+	// the shard is locked only for reading, as slots are reserved by the
+	// allocator and written only by this Put
+	mu := s.shardsMu[shard]
+	if err := mu.RLockContext(ctx); err != nil {
+		return err
 	}
-	_, err = f.Write(section)
+	defer mu.RUnlock()
+
+	addFilter, err := s.filterAdd(ctx, addr)
 	if err != nil {
-		mu.Unlock()
 		return err
 	}
-	if reclaimed {
-		if s.freeCache != nil {
-			s.freeCache.remove(shard, offset)
-		}
-		defer mu.Unlock()
-	} else {
-		mu.Unlock()
+	offset, reclaimed, err := s.allocate(ctx, bin)
+	if err != nil {
+		return err
 	}
+	var (
+		journalID uint64
+		stored    bool
+	)
+	defer func() {
+		err = s.endPut(journalID, bin, offset, reclaimed, stored, err)
+	}()
 	m := &Meta{
-		Size:   uint16(len(data)),
-		Offset: offset,
+		Size:     uint16(len(data)),
+		Offset:   offset,
+		Checksum: sum,
+	}
+	if c := s.compactions[bin]; c != nil {
+		c.used(offset, addr)
+	}
+	if s.journal != nil {
+		journalID, err = s.journal.begin(&journalRecord{
+			typ:       journalPut,
+			shard:     bin,
+			reclaimed: reclaimed,
+			meta:      *m,
+			addr:      addr,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if _, err := s.shards[bin].WriteAt(section, offset); err != nil {
+		return err
+	}
+	if s.syncMode == SyncAlways {
+		if err := s.syncBin(bin); err != nil {
+			return err
+		}
+	}
+	if s.committer != nil {
+		// MetaStore is synced by the committer
+		if err := s.committer.set(addr, bin, s.metaReclaimed(reclaimed), m); err != nil {
+			return err
+		}
+	} else if err := s.meta.Set(addr, bin, s.metaReclaimed(reclaimed), m); err != nil {
+		return err
 	}
+	stored = true
 	if s.metaCache != nil {
 		s.metaCache.set(addr, m)
 	}
-	return s.meta.Set(addr, shard, reclaimed, m)
+	if addFilter {
+		s.filter.add(addr)
+	}
+	if s.committer == nil && s.syncMode == SyncAlways {
+		return s.syncMeta()
+	}
+	return nil
+}
+
+// endPut completes the journal intent of the Put method and ends the claim
+// of the reclaimed slot. If the Put failed before chunk meta is stored, the
+// slot is made available again, as nothing references it. The intent is
+// completed even if the slot can not be freed, returning the free error.
+func (s *Store) endPut(journalID uint64, bin uint8, offset int64, reclaimed, stored bool, putErr error) (err error) {
+	var slotErr error
+	if !stored {
+		slotErr = putErr
+	}
+	var freeErr error
+	if reclaimed {
+		freeErr = s.releaseSlot(bin, offset, slotErr)
+	} else if slotErr != nil {
+		freeErr = s.freeSlot(bin, offset)
+	}
+	if journalID != 0 {
+		if err := s.journal.done(journalID); err != nil && putErr == nil {
+			return err
+		}
+	}
+	if freeErr != nil {
+		return freeErr
+	}
+	return putErr
 }
 
 func (s *Store) Delete(addr chunk.Address) (err error) {
+	return s.DeleteContext(context.Background(), addr)
+}
+
+// DeleteContext removes the chunk. The context is honoured only until chunk
+// meta is found, after that the chunk is removed regardless of it.
+func (s *Store) DeleteContext(ctx context.Context, addr chunk.Address) (err error) {
 	done, err := s.protect()
 	if err != nil {
 		return err
 	}
 	defer done()
 
-	shard := getShard(addr)
-	s.freeMu.Lock()
-	s.free[shard] = struct{}{}
-	s.freeMu.Unlock()
+	shard := s.getShard(addr)
 
 	mu := s.shardsMu[shard]
-	mu.Lock()
+	if err := mu.LockContext(ctx); err != nil {
+		return err
+	}
 	defer mu.Unlock()
 
-	if s.freeCache != nil {
-		m, err := s.getMeta(addr)
+	// meta is needed to find the bin of the chunk
+	m, err := s.getMeta(ctx, addr)
+	if err != nil {
+		return err
+	}
+	bin := s.layout.bin(shard, int(m.Size))
+	if s.journal != nil {
+		journalID, err := s.journal.begin(&journalRecord{
+			typ:   journalDelete,
+			shard: bin,
+			meta:  *m,
+			addr:  addr,
+		})
 		if err != nil {
 			return err
 		}
-		s.freeCache.set(shard, m.Offset)
+		defer func() {
+			if e := s.journal.done(journalID); e != nil && err == nil {
+				err = e
+			}
+		}()
+	}
+
+	if s.bitmaps == nil {
+		s.freeMu.Lock()
+		s.free[bin] = struct{}{}
+		s.freeMu.Unlock()
+
+		if s.freeCache != nil {
+			s.freeCache.set(bin, m.Offset)
+		}
+	}
+	if c := s.compactions[bin]; c != nil {
+		c.freed(m.Offset)
+	}
+	if s.warmUp != nil {
+		s.warmUp.change(addr)
 	}
 	if s.metaCache != nil {
 		s.metaCache.remove(addr)
 	}
-	return s.meta.Remove(addr, shard)
+	if s.dataCache != nil {
+		s.dataCache.remove(addr)
+	}
+	if err := s.markSlotFree(bin, m.Offset); err != nil {
+		return err
+	}
+	if s.syncMode == SyncAlways && s.slotFormat == SlotFormatHeader {
+		if err := s.shards[bin].Sync(); err != nil {
+			return err
+		}
+	}
+	if s.committer != nil {
+		err = s.committer.remove(addr, bin, s.bitmaps != nil)
+	} else {
+		err = s.removeMeta(addr, bin, m)
+		if err == nil && s.syncMode == SyncAlways {
+			err = s.syncMeta()
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if s.bitmaps != nil {
+		// the slot is reused only after its meta is removed
+		s.bitmaps[bin].set(m.Offset / s.layout.slotSize(bin))
+	}
+	if s.filter != nil {
+		s.filter.remove(addr)
+	}
+	return nil
 }
 
 func (s *Store) Count() (count int, err error) {
-	return s.meta.Count()
+	return s.CountContext(context.Background())
+}
+
+func (s *Store) CountContext(ctx context.Context) (count int, err error) {
+	return s.metaContext.CountContext(ctx)
 }
 
 func (s *Store) Iterate(fn func(chunk.Chunk) (stop bool, err error)) (err error) {
+	return s.IterateContext(context.Background(), fn)
+}
+
+// IterateContext calls fn for every chunk until the context is done, in which
+// case the context error is returned.
+func (s *Store) IterateContext(ctx context.Context, fn func(chunk.Chunk) (stop bool, err error)) (err error) {
 	done, err := s.protect()
 	if err != nil {
 		return err
 	}
 	defer done()
 
-	for _, mu := range s.shardsMu {
-		mu.Lock()
+	for i, mu := range s.shardsMu {
+		if err := mu.RLockContext(ctx); err != nil {
+			for _, mu := range s.shardsMu[:i] {
+				mu.RUnlock()
+			}
+			return err
+		}
 	}
 	defer func() {
 		for _, mu := range s.shardsMu {
-			mu.Unlock()
+			mu.RUnlock()
 		}
 	}()
 
-	return s.meta.Iterate(func(addr chunk.Address, m *Meta) (stop bool, err error) {
-		data := make([]byte, m.Size)
-		_, err = s.shards[getShard(addr)].ReadAt(data, m.Offset)
+	return s.metaContext.IterateContext(ctx, func(addr chunk.Address, m *Meta) (stop bool, err error) {
+		data, err := s.readData(s.layout.bin(s.getShard(addr), int(m.Size)), m)
 		if err != nil {
 			return true, err
 		}
-		return fn(chunk.NewChunk(addr, data))
+		if !m.valid(data) {
+			return true, ErrChunkCorrupted
+		}
+		ch := chunk.NewChunk(addr, data)
+		if s.validateOnGet {
+			if err := s.validate(ch); err != nil {
+				return true, err
+			}
+		}
+		return fn(ch)
 	})
 }
 
+// Close closes the store, waiting at most 15 seconds for running
+// operations to complete.
 func (s *Store) Close() (err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
+	if err := s.CloseContext(ctx); err != nil && err != context.DeadlineExceeded {
+		return err
+	}
+	return nil
+}
+
+// CloseContext closes the store, waiting for running operations to complete
+// until the context is done. Files and MetaStore are closed in both cases,
+// with the context error returned if operations did not complete.
+func (s *Store) CloseContext(ctx context.Context) (err error) {
 	s.quitOnce.Do(func() {
 		close(s.quit)
 	})
@@ -288,17 +823,57 @@ func (s *Store) Close() (err error) {
 		s.wg.Wait()
 		close(done)
 	}()
+	var waitErr error
 	select {
 	case <-done:
-	case <-time.After(15 * time.Second):
+	case <-ctx.Done():
+		waitErr = ctx.Err()
+	}
+
+	if s.committer != nil {
+		s.committer.close()
+	}
+
+	// files are closed even if they can not be synced
+	var syncErr error
+	if s.syncMode != SyncNone {
+		syncErr = s.sync()
+	}
+	// bitmaps are rebuilt on open if operations did not complete
+	if s.bitmaps != nil && waitErr == nil && syncErr == nil {
+		syncErr = writeFreeBitmaps(s.path, s.bitmaps, freeBitmapClean)
+	}
+	if s.persistFilter && s.filter != nil && waitErr == nil && syncErr == nil {
+		syncErr = writeFilter(s.path, s.filter)
 	}
 
+	for _, r := range s.mmaps {
+		if err := r.close(); err != nil {
+			return err
+		}
+	}
 	for _, f := range s.shards {
 		if err := f.Close(); err != nil {
 			return err
 		}
 	}
-	return s.meta.Close()
+	if s.ends != nil {
+		if err := s.ends.close(); err != nil {
+			return err
+		}
+	}
+	if s.journal != nil {
+		if err := s.journal.close(); err != nil {
+			return err
+		}
+	}
+	if err := s.meta.Close(); err != nil {
+		return err
+	}
+	if syncErr != nil {
+		return syncErr
+	}
+	return waitErr
 }
 
 func (s *Store) protect() (done func(), err error) {
@@ -311,14 +886,17 @@ func (s *Store) protect() (done func(), err error) {
 	return s.wg.Done, nil
 }
 
-func (s *Store) getMeta(addr chunk.Address) (m *Meta, err error) {
+func (s *Store) getMeta(ctx context.Context, addr chunk.Address) (m *Meta, err error) {
 	if s.metaCache != nil {
 		m = s.metaCache.get(addr)
 		if m != nil {
 			return m, nil
 		}
 	}
-	m, err = s.meta.Get(addr)
+	if s.filter != nil && !s.filter.contains(addr) {
+		return nil, chunk.ErrChunkNotFound
+	}
+	m, err = s.metaContext.GetContext(ctx, addr)
 	if err != nil {
 		return nil, err
 	}
@@ -328,10 +906,13 @@ func (s *Store) getMeta(addr chunk.Address) (m *Meta, err error) {
 	return m, nil
 }
 
-func getShard(addr chunk.Address) (shard uint8) {
-	return addr[len(addr)-1] % shardCount
+func (s *Store) getShard(addr chunk.Address) (shard uint8) {
+	return s.shardFunc.shard(addr, s.shardCount)
 }
 
+// MetaStore keeps chunk meta and free slot offsets. The shard argument of
+// its methods identifies the shard file of a size class, with offsets that
+// are independent from the ones in other files.
 type MetaStore interface {
 	Get(addr chunk.Address) (*Meta, error)
 	Set(addr chunk.Address, shard uint8, reclaimed bool, m *Meta) error
@@ -339,30 +920,68 @@ type MetaStore interface {
 	Count() (int, error)
 	Iterate(func(chunk.Address, *Meta) (stop bool, err error)) error
 	FreeOffset(shard uint8) (int64, error)
+	SetFreeOffset(shard uint8, offset int64) error
+	RemoveFreeOffset(shard uint8, offset int64) error
+	IterateFreeOffsets(shard uint8, fn func(offset int64) (stop bool, err error)) error
 	Close() error
 }
 
 type Meta struct {
-	Size   uint16
-	Offset int64
+	Size     uint16
+	Offset   int64
+	Checksum uint32
+
+	// noChecksum is set for entries written before checksums were
+	// introduced, for which data is not verified on read.
+	noChecksum bool
 }
 
+const (
+	metaSize       = 14
+	legacyMetaSize = 10
+)
+
 func (m *Meta) MarshalBinary() (data []byte, err error) {
-	data = make([]byte, 10)
+	if m.noChecksum {
+		data = make([]byte, legacyMetaSize)
+	} else {
+		data = make([]byte, metaSize)
+		binary.BigEndian.PutUint32(data[10:14], m.Checksum)
+	}
 	binary.BigEndian.PutUint64(data[:8], uint64(m.Offset))
 	binary.BigEndian.PutUint16(data[8:10], uint16(m.Size))
 	return data, nil
 }
 
 func (m *Meta) UnmarshalBinary(data []byte) error {
+	if len(data) < legacyMetaSize {
+		return fmt.Errorf("invalid meta data length %v", len(data))
+	}
 	m.Offset = int64(binary.BigEndian.Uint64(data[:8]))
 	m.Size = binary.BigEndian.Uint16(data[8:10])
+	if len(data) < metaSize {
+		m.Checksum = 0
+		m.noChecksum = true
+		return nil
+	}
+	m.Checksum = binary.BigEndian.Uint32(data[10:14])
+	m.noChecksum = false
 	return nil
 }
 
+func (m *Meta) valid(data []byte) bool {
+	return m.noChecksum || checksum(data) == m.Checksum
+}
+
 func (m *Meta) String() (s string) {
 	if m == nil {
 		return "<nil>"
 	}
-	return fmt.Sprintf("{Size: %v, Offset %v}", m.Size, m.Offset)
+	return fmt.Sprintf("{Size: %v, Offset %v, Checksum %08x}", m.Size, m.Offset, m.Checksum)
+}
+
+var castagnoliTable = crc32.MakeTable(crc32.Castagnoli)
+
+func checksum(data []byte) uint32 {
+	return crc32.Checksum(data, castagnoliTable)
 }
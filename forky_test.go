@@ -0,0 +1,549 @@
+// Copyright 2019 The Swarm Authors
+// This file is part of the Swarm library.
+//
+// The Swarm library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The Swarm library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the Swarm library. If not, see <http://www.gnu.org/licenses/>.
+
+package forky_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ethersphere/swarm/chunk"
+	"github.com/janos/forky"
+	"github.com/janos/forky/mem"
+	"github.com/janos/forky/test"
+)
+
+func TestMetaBinary(t *testing.T) {
+	m := &forky.Meta{
+		Size:     4096,
+		Offset:   1 << 40,
+		Checksum: 0xdeadbeef,
+	}
+	data, err := m.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := new(forky.Meta)
+	if err := got.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, m) {
+		t.Errorf("got meta %s, want %s", got, m)
+	}
+	if err := got.UnmarshalBinary(data[:9]); err == nil {
+		t.Error("expected error for short meta data")
+	}
+
+	// meta without checksum written by the previous format version
+	if err := got.UnmarshalBinary(data[:10]); err != nil {
+		t.Fatal(err)
+	}
+	if got.Size != m.Size || got.Offset != m.Offset || got.Checksum != 0 {
+		t.Errorf("got legacy meta %s, want size %v and offset %v", got, m.Size, m.Offset)
+	}
+	legacy, err := got.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(legacy, data[:10]) {
+		t.Errorf("got legacy meta data %x, want %x", legacy, data[:10])
+	}
+}
+
+// TestStoreBaselineFormat validates that a store written by the first
+// format version, with raw slots, meta entries without checksums and
+// without the manifest, can be opened and read.
+func TestStoreBaselineFormat(t *testing.T) {
+	path, err := ioutil.TempDir("", "swarm-forky-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(path)
+
+	const shardCount = 32
+
+	metaStore := mem.NewMetaStore()
+	chunks := make([]chunk.Chunk, 100)
+	ends := make(map[uint8]int64)
+	for i := range chunks {
+		ch := test.GenerateTestRandomChunk()
+		chunks[i] = ch
+		addr := ch.Address()
+		shard := addr[len(addr)-1] % shardCount
+
+		f, err := os.OpenFile(filepath.Join(path, fmt.Sprintf("chunks-%v.db", shard)), os.O_CREATE|os.O_RDWR, 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.WriteAt(ch.Data(), ends[shard]); err != nil {
+			t.Fatal(err)
+		}
+		if err := f.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		data := make([]byte, 10)
+		binary.BigEndian.PutUint64(data[:8], uint64(ends[shard]))
+		binary.BigEndian.PutUint16(data[8:10], uint16(len(ch.Data())))
+		m := new(forky.Meta)
+		if err := m.UnmarshalBinary(data); err != nil {
+			t.Fatal(err)
+		}
+		if err := metaStore.Set(addr, shard, false, m); err != nil {
+			t.Fatal(err)
+		}
+		ends[shard] += chunk.DefaultSize
+	}
+
+	s, err := forky.NewStore(path, chunk.DefaultSize, metaStore, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	for _, ch := range chunks {
+		got, err := s.Get(ch.Address())
+		if err != nil {
+			t.Fatalf("get %s: %v", ch.Address().Hex(), err)
+		}
+		if !bytes.Equal(got.Data(), ch.Data()) {
+			t.Fatalf("got chunk %s data %x, want %x", ch.Address().Hex(), got.Data()[:8], ch.Data()[:8])
+		}
+	}
+
+	var count int
+	if err := s.Iterate(func(ch chunk.Chunk) (stop bool, err error) {
+		count++
+		return false, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if count != len(chunks) {
+		t.Errorf("iterated %v chunks, want %v", count, len(chunks))
+	}
+
+	ch := test.GenerateTestRandomChunk()
+	if err := s.Put(ch); err != nil {
+		t.Fatal(err)
+	}
+	got, err := s.Get(ch.Address())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got.Data(), ch.Data()) {
+		t.Errorf("got new chunk data %x, want %x", got.Data()[:8], ch.Data()[:8])
+	}
+}
+
+func TestStoreChunkCorrupted(t *testing.T) {
+	s, path, clean := newTestStore(t, chunk.DefaultSize, &forky.Options{
+		MetaCacheSize: -1,
+		FreeCacheSize: -1,
+	})
+	defer clean()
+
+	ch := test.GenerateTestRandomChunk()
+	if err := s.Put(ch); err != nil {
+		t.Fatal(err)
+	}
+
+	corruptShardFiles(t, path)
+
+	_, err := s.Get(ch.Address())
+	if err != forky.ErrChunkCorrupted {
+		t.Fatalf("got error %v, want %v", err, forky.ErrChunkCorrupted)
+	}
+
+	err = s.Iterate(func(chunk.Chunk) (bool, error) {
+		return false, nil
+	})
+	if err != forky.ErrChunkCorrupted {
+		t.Fatalf("got iterate error %v, want %v", err, forky.ErrChunkCorrupted)
+	}
+}
+
+func newTestStore(t *testing.T, maxChunkSize int, o *forky.Options) (s *forky.Store, path string, clean func()) {
+	t.Helper()
+
+	path, err := ioutil.TempDir("", "swarm-forky-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err = forky.NewStore(path, maxChunkSize, mem.NewMetaStore(), o)
+	if err != nil {
+		os.RemoveAll(path)
+		t.Fatal(err)
+	}
+	return s, path, func() {
+		s.Close()
+		os.RemoveAll(path)
+	}
+}
+
+// corruptShardFiles flips the first byte of every non-empty shard file.
+func corruptShardFiles(t *testing.T, path string) {
+	t.Helper()
+
+	files, err := filepath.Glob(filepath.Join(path, "chunks-*.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range files {
+		f, err := os.OpenFile(file, os.O_RDWR, 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b := make([]byte, 1)
+		if _, err := f.ReadAt(b, 0); err != nil {
+			f.Close()
+			continue
+		}
+		b[0] ^= 0xff
+		if _, err := f.WriteAt(b, 0); err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+	}
+}
+
+func TestStoreJournalRecovery(t *testing.T) {
+	path, err := ioutil.TempDir("", "swarm-forky-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(path)
+
+	metaStore := mem.NewMetaStore()
+	blocking := &blockingMetaStore{
+		MetaStore: metaStore,
+		block:     make(chan struct{}),
+	}
+	defer close(blocking.block)
+
+	s, err := forky.NewStore(path, chunk.DefaultSize, blocking, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deleted := test.GenerateTestRandomChunk()
+	if err := s.Put(deleted); err != nil {
+		t.Fatal(err)
+	}
+
+	// simulate a crash in the middle of Put and Delete
+	blocking.blocked = true
+	interrupted := test.GenerateTestRandomChunk()
+	go s.Put(interrupted)
+	go s.Delete(deleted.Address())
+	time.Sleep(100 * time.Millisecond)
+
+	s, err = forky.NewStore(path, chunk.DefaultSize, metaStore, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if _, err := s.Get(interrupted.Address()); err != chunk.ErrChunkNotFound {
+		t.Errorf("got error %v, want %v", err, chunk.ErrChunkNotFound)
+	}
+	if _, err := s.Get(deleted.Address()); err != chunk.ErrChunkNotFound {
+		t.Errorf("got error %v, want %v", err, chunk.ErrChunkNotFound)
+	}
+	var freeCount int
+	for shard := 0; shard < 32; shard++ {
+		offset, err := metaStore.FreeOffset(uint8(shard))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if offset >= 0 {
+			freeCount++
+		}
+	}
+	wantFreeCount := 2
+	if deleted.Address()[31]%32 == interrupted.Address()[31]%32 {
+		wantFreeCount = 1
+	}
+	if freeCount != wantFreeCount {
+		t.Errorf("got %v shards with free offsets, want %v", freeCount, wantFreeCount)
+	}
+}
+
+// blockingMetaStore blocks Set and Remove calls until the block channel is
+// closed, if blocked is true. Blocked calls are signalled on the entered
+// channel, if it is set.
+type blockingMetaStore struct {
+	forky.MetaStore
+	blocked bool
+	block   chan struct{}
+	entered chan struct{}
+}
+
+func (s *blockingMetaStore) Set(addr chunk.Address, shard uint8, reclaimed bool, m *forky.Meta) error {
+	if s.blocked {
+		if s.entered != nil {
+			s.entered <- struct{}{}
+		}
+		<-s.block
+		return errors.New("blocked")
+	}
+	return s.MetaStore.Set(addr, shard, reclaimed, m)
+}
+
+func (s *blockingMetaStore) Remove(addr chunk.Address, shard uint8) error {
+	if s.blocked {
+		if s.entered != nil {
+			s.entered <- struct{}{}
+		}
+		<-s.block
+		return errors.New("blocked")
+	}
+	return s.MetaStore.Remove(addr, shard)
+}
+
+// TestStorePutRollback validates that the slot of a failed Put is reused.
+func TestStorePutRollback(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		o    forky.Options
+	}{
+		{name: "journal"},
+		{name: "no journal", o: forky.Options{NoJournal: true}},
+		{name: "free bitmap", o: forky.Options{FreeBitmap: true}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			path, err := ioutil.TempDir("", "swarm-forky-")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(path)
+
+			o := tc.o
+			o.ShardCount = 1
+			o.SlotFormat = forky.SlotFormatHeader
+			metaStore := mem.NewMetaStore()
+			failing := &failingMetaStore{
+				MetaStore: metaStore,
+			}
+			s, err := forky.NewStore(path, chunk.DefaultSize, failing, &o)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+
+			failing.fail = true
+			failed := test.GenerateTestRandomChunk()
+			if err := s.Put(failed); err != errFailingMetaStore {
+				t.Fatalf("got error %v, want %v", err, errFailingMetaStore)
+			}
+			failing.fail = false
+
+			ch := test.GenerateTestRandomChunk()
+			if err := s.Put(ch); err != nil {
+				t.Fatal(err)
+			}
+			// the failed chunk is not found after its slot is reused
+			has, err := s.Has(failed.Address())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if has {
+				t.Error("failed chunk found")
+			}
+			if _, err := s.Get(failed.Address()); err != chunk.ErrChunkNotFound {
+				t.Errorf("got error %v, want %v", err, chunk.ErrChunkNotFound)
+			}
+			fi, err := os.Stat(filepath.Join(path, "chunks-0.db"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := s.Manifest().SlotSize; fi.Size() != want {
+				t.Errorf("got shard file size %v, want %v", fi.Size(), want)
+			}
+			if err := s.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			r, err := forky.Check(path, chunk.DefaultSize, metaStore, &o)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(r.Problems) != 0 || r.Chunks != 1 || r.FreeSlots != 0 {
+				t.Errorf("got check report %+v", r)
+			}
+		})
+	}
+}
+
+var errFailingMetaStore = errors.New("failing meta store")
+
+var errFailingFreeOffset = errors.New("failing free offset")
+
+// failingMetaStore returns an error on Set calls if fail is true and on
+// SetFreeOffset calls if failFree is true.
+type failingMetaStore struct {
+	forky.MetaStore
+	fail     bool
+	failFree bool
+}
+
+func (s *failingMetaStore) Set(addr chunk.Address, shard uint8, reclaimed bool, m *forky.Meta) error {
+	if s.fail {
+		return errFailingMetaStore
+	}
+	return s.MetaStore.Set(addr, shard, reclaimed, m)
+}
+
+func (s *failingMetaStore) SetFreeOffset(shard uint8, offset int64) error {
+	if s.failFree {
+		return errFailingFreeOffset
+	}
+	return s.MetaStore.SetFreeOffset(shard, offset)
+}
+
+// TestStorePutFreeError validates that the journal intent of a failed Put is
+// completed even if its slot can not be freed.
+func TestStorePutFreeError(t *testing.T) {
+	path, err := ioutil.TempDir("", "swarm-forky-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(path)
+
+	o := &forky.Options{
+		ShardCount: 1,
+	}
+	failing := &failingMetaStore{
+		MetaStore: mem.NewMetaStore(),
+	}
+	s, err := forky.NewStore(path, chunk.DefaultSize, failing, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		s.Close()
+	}()
+
+	failing.fail = true
+	failing.failFree = true
+	if err := s.Put(test.GenerateTestRandomChunk()); err != errFailingFreeOffset {
+		t.Fatalf("got error %v, want %v", err, errFailingFreeOffset)
+	}
+	if err := s.PutMulti(test.GenerateTestRandomChunk(), test.GenerateTestRandomChunk()); err != errFailingFreeOffset {
+		t.Fatalf("got error %v, want %v", err, errFailingFreeOffset)
+	}
+	failing.fail = false
+	failing.failFree = false
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// completed intents are not recovered on open
+	s, err = forky.NewStore(path, chunk.DefaultSize, failing, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	count, err := s.FreeSlots()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 0 {
+		t.Errorf("got %v free slots recovered from the journal, want 0", count)
+	}
+}
+
+func TestStoreConcurrentPut(t *testing.T) {
+	path, err := ioutil.TempDir("", "swarm-forky-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(path)
+
+	o := &forky.Options{
+		ShardCount: 1,
+		SlotFormat: forky.SlotFormatHeader,
+	}
+	metaStore := mem.NewMetaStore()
+	s, err := forky.NewStore(path, chunk.DefaultSize, metaStore, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	chunks := make([]chunk.Chunk, 200)
+	for i := range chunks {
+		chunks[i] = test.GenerateTestRandomChunk()
+	}
+	put := func(chunks []chunk.Chunk) {
+		t.Helper()
+
+		errC := make(chan error, len(chunks))
+		for _, ch := range chunks {
+			go func(ch chunk.Chunk) {
+				errC <- s.Put(ch)
+			}(ch)
+		}
+		for range chunks {
+			if err := <-errC; err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	put(chunks[:150])
+	for _, ch := range chunks[:50] {
+		if err := s.Delete(ch.Address()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// concurrent puts reclaim every free slot only once
+	put(chunks[150:])
+	chunks = chunks[50:]
+
+	for _, ch := range chunks {
+		got, err := s.Get(ch.Address())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got.Data(), ch.Data()) {
+			t.Fatalf("got chunk %s data %x, want %x", ch.Address(), got.Data(), ch.Data())
+		}
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	fi, err := os.Stat(filepath.Join(path, "chunks-0.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := int64(len(chunks)) * s.Manifest().SlotSize; fi.Size() != want {
+		t.Errorf("got shard file size %v, want %v", fi.Size(), want)
+	}
+	r, err := forky.Check(path, chunk.DefaultSize, metaStore, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Problems) != 0 || r.Chunks != len(chunks) || r.FreeSlots != 0 {
+		t.Errorf("got check report %+v", r)
+	}
+}
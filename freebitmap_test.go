@@ -0,0 +1,128 @@
+// Copyright 2019 The Swarm Authors
+// This file is part of the Swarm library.
+//
+// The Swarm library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The Swarm library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the Swarm library. If not, see <http://www.gnu.org/licenses/>.
+
+package forky_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ethersphere/swarm/chunk"
+	"github.com/janos/forky"
+	"github.com/janos/forky/mem"
+	"github.com/janos/forky/test"
+)
+
+func TestStoreFreeBitmap(t *testing.T) {
+	path, err := ioutil.TempDir("", "swarm-forky-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(path)
+
+	o := &forky.Options{
+		ShardCount: 1,
+		FreeBitmap: true,
+	}
+	metaStore := mem.NewMetaStore()
+	s, err := forky.NewStore(path, chunk.DefaultSize, metaStore, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	chunks := make([]chunk.Chunk, 20)
+	for i := range chunks {
+		chunks[i] = test.GenerateTestRandomChunk()
+		if err := s.Put(chunks[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, i := range []int{15, 3, 7} {
+		if err := s.Delete(chunks[i].Address()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	freeSlots := func(want int) {
+		t.Helper()
+
+		count, err := s.FreeSlots()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count != want {
+			t.Errorf("got %v free slots, want %v", count, want)
+		}
+	}
+	freeSlots(3)
+	if err := metaStore.IterateFreeOffsets(0, func(offset int64) (bool, error) {
+		t.Errorf("got free offset %v in meta store", offset)
+		return false, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the lowest free slot is reused first
+	ch := test.GenerateTestRandomChunk()
+	if err := s.Put(ch); err != nil {
+		t.Fatal(err)
+	}
+	m, err := metaStore.Get(ch.Address())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := 3 * s.Manifest().SlotSize; m.Offset != want {
+		t.Errorf("got offset %v, want %v", m.Offset, want)
+	}
+	freeSlots(2)
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := forky.Check(path, chunk.DefaultSize, metaStore, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Problems) != 0 || r.FreeSlots != 2 {
+		t.Errorf("got check report %+v", r)
+	}
+
+	// bitmaps are used without the option and rebuilt if not closed properly
+	for _, dirty := range []bool{false, true} {
+		if dirty {
+			f, err := os.OpenFile(filepath.Join(path, "free.db"), os.O_RDWR, 0666)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := f.WriteAt([]byte{0}, 0); err != nil {
+				t.Fatal(err)
+			}
+			f.Close()
+		}
+		s, err = forky.NewStore(path, chunk.DefaultSize, metaStore, &forky.Options{
+			ShardCount: 1,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		freeSlots(2)
+		if err := s.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,390 @@
+// Copyright 2019 The Swarm Authors
+// This file is part of the Swarm library.
+//
+// The Swarm library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The Swarm library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the Swarm library. If not, see <http://www.gnu.org/licenses/>.
+
+package forky
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/ethersphere/swarm/chunk"
+)
+
+// ProblemType identifies an inconsistency found by Check.
+type ProblemType string
+
+const (
+	// ProblemMisalignedOffset is reported for chunk meta with the offset
+	// that is not at the start of a slot.
+	ProblemMisalignedOffset ProblemType = "misaligned-offset"
+	// ProblemOffsetOutOfRange is reported for chunk meta that references
+	// data beyond the end of the shard file.
+	ProblemOffsetOutOfRange ProblemType = "offset-out-of-range"
+	// ProblemInvalidSize is reported for chunk meta with the size larger
+	// than the maximal chunk size.
+	ProblemInvalidSize ProblemType = "invalid-size"
+	// ProblemCorruptedChunk is reported for chunks with data that do not
+	// match the checksum from meta.
+	ProblemCorruptedChunk ProblemType = "corrupted-chunk"
+	// ProblemDuplicateSlot is reported when more then one address
+	// references the same slot.
+	ProblemDuplicateSlot ProblemType = "duplicate-slot"
+	// ProblemReferencedFreeSlot is reported for free offsets that are
+	// referenced by chunk meta.
+	ProblemReferencedFreeSlot ProblemType = "referenced-free-slot"
+	// ProblemInvalidFreeSlot is reported for free offsets that are not
+	// aligned to slots or are beyond the end of the shard file.
+	ProblemInvalidFreeSlot ProblemType = "invalid-free-slot"
+	// ProblemUnreferencedSlot is reported for slots that are neither
+	// referenced nor free.
+	ProblemUnreferencedSlot ProblemType = "unreferenced-slot"
+	// ProblemPendingJournal is reported when the journal contains intents
+	// that will be recovered when the store is opened.
+	ProblemPendingJournal ProblemType = "pending-journal"
+)
+
+// Problem is a single inconsistency between shard files and MetaStore.
+type Problem struct {
+	Type      ProblemType     `json:"type"`
+	Shard     uint8           `json:"shard"`
+	SizeClass int             `json:"sizeClass"`
+	Offset    int64           `json:"offset"`
+	Addresses []chunk.Address `json:"addresses,omitempty"`
+}
+
+func (p Problem) String() string {
+	return fmt.Sprintf("%s: shard %v size class %v offset %v addresses %v", p.Type, p.Shard, p.SizeClass, p.Offset, p.Addresses)
+}
+
+// CheckReport is the result of Check and Repair functions.
+type CheckReport struct {
+	Chunks    int       `json:"chunks"`
+	FreeSlots int       `json:"freeSlots"`
+	Problems  []Problem `json:"problems"`
+	Repaired  bool      `json:"repaired"`
+}
+
+// Check validates that MetaStore entries and free offsets are consistent
+// with shard files in the store directory. Options must have the same shard
+// and slot configuration as the ones used to create the store. The store must
+// not be open.
+func Check(path string, maxChunkSize int, metaStore MetaStore, o *Options) (r *CheckReport, err error) {
+	return check(path, maxChunkSize, metaStore, o, false)
+}
+
+// Repair performs the same checks as Check and fixes found problems by
+// removing invalid and corrupted chunk meta entries, keeping only a single
+// valid reference to every slot and rebuilding free offsets from slots
+// that are not referenced. The store must not be open.
+func Repair(path string, maxChunkSize int, metaStore MetaStore, o *Options) (r *CheckReport, err error) {
+	return check(path, maxChunkSize, metaStore, o, true)
+}
+
+// checkEntry is the chunk meta referencing a slot.
+type checkEntry struct {
+	addr  chunk.Address
+	meta  *Meta
+	bin   uint8
+	valid bool
+}
+
+func check(path string, maxChunkSize int, metaStore MetaStore, o *Options, repair bool) (r *CheckReport, err error) {
+	if o == nil {
+		o = new(Options)
+	}
+	if err := checkManifest(path, maxChunkSize, o); err != nil {
+		return nil, err
+	}
+	l, err := newLayout(maxChunkSize, o)
+	if err != nil {
+		return nil, err
+	}
+	r = &CheckReport{
+		Problems: make([]Problem, 0),
+	}
+	headerSize := o.SlotFormat.headerSize()
+	// problem returns the problem of the type in the slot of the bin
+	problem := func(typ ProblemType, bin uint8, offset int64, addrs ...chunk.Address) Problem {
+		return Problem{
+			Type:      typ,
+			Shard:     l.shard(bin),
+			SizeClass: l.classSize(bin),
+			Offset:    offset,
+			Addresses: addrs,
+		}
+	}
+
+	if f, err := os.Open(filepath.Join(path, journalFilename)); err == nil {
+		pending, err := readJournal(f)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		for _, rec := range pending {
+			r.Problems = append(r.Problems, problem(ProblemPendingJournal, rec.shard, rec.meta.Offset, rec.addr))
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	bins := make([]*os.File, l.binCount())
+	sizes := make([]int64, l.binCount())
+	defer func() {
+		for _, f := range bins {
+			if f != nil {
+				f.Close()
+			}
+		}
+	}()
+	for i := range bins {
+		f, err := os.Open(filepath.Join(path, l.filename(uint8(i))))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		bins[i] = f
+		fi, err := f.Stat()
+		if err != nil {
+			return nil, err
+		}
+		sizes[i] = fi.Size()
+	}
+	// preallocated shard files have data ends separate from their sizes
+	ends, err := readDataEnds(path, l.binCount())
+	if err != nil {
+		return nil, err
+	}
+	for i, end := range ends {
+		if end >= 0 && end < sizes[i] {
+			sizes[i] = end
+		}
+	}
+
+	// slots maps referenced offsets to chunk meta for every bin
+	slots := make([]map[int64][]*checkEntry, l.binCount())
+	for i := range slots {
+		slots[i] = make(map[int64][]*checkEntry)
+	}
+	// invalid are chunk meta entries that must be removed on repair
+	var invalid []*checkEntry
+
+	if err := metaStore.Iterate(func(addr chunk.Address, m *Meta) (stop bool, err error) {
+		r.Chunks++
+		bin := l.bin(o.ShardFunc.shard(addr, l.shardCount), int(m.Size))
+		slotSize := l.slotSize(bin)
+		e := &checkEntry{
+			addr: append(chunk.Address(nil), addr...),
+			meta: m,
+			bin:  bin,
+		}
+		var typ ProblemType
+		switch {
+		case m.Offset%slotSize != 0:
+			typ = ProblemMisalignedOffset
+		case m.Offset < 0 || m.Offset+slotSize > sizes[bin]:
+			typ = ProblemOffsetOutOfRange
+		case int(m.Size) > maxChunkSize:
+			typ = ProblemInvalidSize
+		}
+		if typ != "" {
+			r.Problems = append(r.Problems, problem(typ, bin, m.Offset, e.addr))
+			invalid = append(invalid, e)
+			return false, nil
+		}
+		slot := make([]byte, headerSize+int64(m.Size))
+		if _, err := bins[bin].ReadAt(slot, m.Offset); err != nil && err != io.EOF {
+			return true, err
+		}
+		e.valid = m.valid(slot[headerSize:])
+		if e.valid && o.SlotFormat == SlotFormatHeader {
+			var h slotHeader
+			e.valid = h.UnmarshalBinary(slot) == nil && h.flags&slotFlagUsed != 0 && bytes.Equal(h.addr, addr)
+		}
+		if !e.valid {
+			r.Problems = append(r.Problems, problem(ProblemCorruptedChunk, bin, m.Offset, e.addr))
+		}
+		slots[bin][m.Offset] = append(slots[bin][m.Offset], e)
+		return false, nil
+	}); err != nil {
+		return nil, err
+	}
+
+	for bin := range slots {
+		for offset, entries := range slots[bin] {
+			if len(entries) > 1 {
+				addrs := make([]chunk.Address, 0, len(entries))
+				for _, e := range entries {
+					addrs = append(addrs, e.addr)
+				}
+				r.Problems = append(r.Problems, problem(ProblemDuplicateSlot, uint8(bin), offset, addrs...))
+			}
+			// keep only the first valid reference to the slot
+			var kept bool
+			for _, e := range entries {
+				if e.valid && !kept {
+					kept = true
+					continue
+				}
+				invalid = append(invalid, e)
+			}
+			if !kept {
+				delete(slots[bin], offset)
+			}
+		}
+	}
+
+	// stores with free bitmaps do not keep free offsets in MetaStore
+	bitmap, err := hasFreeBitmap(path)
+	if err != nil {
+		return nil, err
+	}
+	var bitmaps []*freeBitmap
+	if bitmap {
+		bitmaps, err = readFreeBitmaps(path, l.binCount())
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	free := make([]map[int64]struct{}, l.binCount())
+	for bin := range free {
+		slotSize := l.slotSize(uint8(bin))
+		free[bin] = make(map[int64]struct{})
+		iterateFree := func(fn func(offset int64) (stop bool, err error)) error {
+			return metaStore.IterateFreeOffsets(uint8(bin), fn)
+		}
+		if bitmap {
+			referenced := slots[bin]
+			size := sizes[bin]
+			iterateFree = func(fn func(offset int64) (stop bool, err error)) error {
+				if bitmaps == nil {
+					// bitmaps that are not clean are rebuilt with all
+					// unreferenced slots marked as free
+					for offset := int64(0); offset+slotSize <= size; offset += slotSize {
+						if _, ok := referenced[offset]; !ok {
+							fn(offset)
+						}
+					}
+					return nil
+				}
+				for _, slot := range bitmaps[bin].slots() {
+					fn(slot * slotSize)
+				}
+				return nil
+			}
+		}
+		if err := iterateFree(func(offset int64) (stop bool, err error) {
+			r.FreeSlots++
+			free[bin][offset] = struct{}{}
+			switch {
+			case offset%slotSize != 0 || offset < 0 || offset+slotSize > sizes[bin]:
+				r.Problems = append(r.Problems, problem(ProblemInvalidFreeSlot, uint8(bin), offset))
+			case len(slots[bin][offset]) > 0:
+				var addrs []chunk.Address
+				for _, e := range slots[bin][offset] {
+					addrs = append(addrs, e.addr)
+				}
+				r.Problems = append(r.Problems, problem(ProblemReferencedFreeSlot, uint8(bin), offset, addrs...))
+			}
+			return false, nil
+		}); err != nil {
+			return nil, err
+		}
+		for offset := int64(0); offset+slotSize <= sizes[bin]; offset += slotSize {
+			if _, ok := free[bin][offset]; ok {
+				continue
+			}
+			if _, ok := slots[bin][offset]; ok {
+				continue
+			}
+			r.Problems = append(r.Problems, problem(ProblemUnreferencedSlot, uint8(bin), offset))
+		}
+	}
+
+	if !repair {
+		return r, nil
+	}
+
+	for _, e := range invalid {
+		if err := removeInvalid(metaStore, e, bitmap); err != nil && err != chunk.ErrChunkNotFound {
+			return nil, err
+		}
+	}
+	if bitmap {
+		r.Repaired = true
+		return r, markFreeBitmapDirty(path)
+	}
+	for bin := range slots {
+		referenced := slots[bin]
+		if err := rebuildFreeOffsets(metaStore, uint8(bin), func(offset int64) bool {
+			_, ok := referenced[offset]
+			return ok
+		}, l.slotSize(uint8(bin)), sizes[bin]); err != nil {
+			return nil, err
+		}
+	}
+	r.Repaired = true
+	return r, nil
+}
+
+func removeInvalid(metaStore MetaStore, e *checkEntry, bitmap bool) (err error) {
+	if !bitmap {
+		return metaStore.Remove(e.addr, e.bin)
+	}
+	if b, ok := metaStore.(BitmapMetaStore); ok {
+		return b.RemoveMeta(e.addr)
+	}
+	if err := metaStore.Remove(e.addr, e.bin); err != nil {
+		return err
+	}
+	return metaStore.RemoveFreeOffset(e.bin, e.meta.Offset)
+}
+
+func rebuildFreeOffsets(metaStore MetaStore, bin uint8, referenced func(offset int64) bool, slotSize, size int64) (err error) {
+	var remove []int64
+	current := make(map[int64]struct{})
+	if err := metaStore.IterateFreeOffsets(bin, func(offset int64) (stop bool, err error) {
+		current[offset] = struct{}{}
+		if referenced(offset) || offset%slotSize != 0 || offset < 0 || offset+slotSize > size {
+			remove = append(remove, offset)
+		}
+		return false, nil
+	}); err != nil {
+		return err
+	}
+	for _, offset := range remove {
+		if err := metaStore.RemoveFreeOffset(bin, offset); err != nil {
+			return err
+		}
+	}
+	for offset := int64(0); offset+slotSize <= size; offset += slotSize {
+		if referenced(offset) {
+			continue
+		}
+		if _, ok := current[offset]; ok {
+			continue
+		}
+		if err := metaStore.SetFreeOffset(bin, offset); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,194 @@
+// Copyright 2019 The Swarm Authors
+// This file is part of the Swarm library.
+//
+// The Swarm library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The Swarm library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the Swarm library. If not, see <http://www.gnu.org/licenses/>.
+
+package forky_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ethersphere/swarm/chunk"
+	"github.com/janos/forky"
+	"github.com/janos/forky/mem"
+	"github.com/janos/forky/test"
+)
+
+func TestCheckRepair(t *testing.T) {
+	path, err := ioutil.TempDir("", "swarm-forky-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(path)
+
+	metaStore := mem.NewMetaStore()
+	s, err := forky.NewStore(path, chunk.DefaultSize, metaStore, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chunks := make([]chunk.Chunk, 10)
+	for i := range chunks {
+		chunks[i] = test.GenerateTestRandomChunk()
+		if err := s.Put(chunks[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Delete(chunks[0].Address()); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := forky.Check(path, chunk.DefaultSize, metaStore, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Problems) != 0 {
+		t.Fatalf("got problems %v", r.Problems)
+	}
+	if r.Chunks != 9 {
+		t.Errorf("got %v chunks, want 9", r.Chunks)
+	}
+	if r.FreeSlots != 1 {
+		t.Errorf("got %v free slots, want 1", r.FreeSlots)
+	}
+
+	m1, err := metaStore.Get(chunks[1].Address())
+	if err != nil {
+		t.Fatal(err)
+	}
+	duplicate := append(chunk.Address(nil), chunks[1].Address()...)
+	duplicate[0]++
+	if err := metaStore.Set(duplicate, 0, false, m1); err != nil {
+		t.Fatal(err)
+	}
+	misaligned := test.GenerateTestRandomChunk().Address()
+	if err := metaStore.Set(misaligned, 0, false, &forky.Meta{Offset: 10}); err != nil {
+		t.Fatal(err)
+	}
+	m2, err := metaStore.Get(chunks[2].Address())
+	if err != nil {
+		t.Fatal(err)
+	}
+	shard2 := chunks[2].Address()[31] % 32
+	if err := metaStore.SetFreeOffset(shard2, m2.Offset); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(filepath.Join(path, "chunks-0.db"), os.O_APPEND|os.O_WRONLY, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write(make([]byte, chunk.DefaultSize)); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	r, err = forky.Repair(path, chunk.DefaultSize, metaStore, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[forky.ProblemType]int)
+	for _, p := range r.Problems {
+		got[p.Type]++
+	}
+	for _, typ := range []forky.ProblemType{
+		forky.ProblemDuplicateSlot,
+		forky.ProblemMisalignedOffset,
+		forky.ProblemReferencedFreeSlot,
+		forky.ProblemUnreferencedSlot,
+	} {
+		if got[typ] != 1 {
+			t.Errorf("got %v %s problems, want 1", got[typ], typ)
+		}
+	}
+	if !r.Repaired {
+		t.Error("not repaired")
+	}
+
+	r, err = forky.Check(path, chunk.DefaultSize, metaStore, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Problems) != 0 {
+		t.Fatalf("got problems after repair %v", r.Problems)
+	}
+	for _, ch := range chunks[2:] {
+		if _, err := metaStore.Get(ch.Address()); err != nil {
+			t.Errorf("chunk %s: %v", ch.Address(), err)
+		}
+	}
+	// only one of the addresses that reference the same slot is kept
+	var kept int
+	for _, addr := range []chunk.Address{chunks[1].Address(), duplicate} {
+		if _, err := metaStore.Get(addr); err == nil {
+			kept++
+		}
+	}
+	if kept != 1 {
+		t.Errorf("got %v addresses referencing the duplicate slot, want 1", kept)
+	}
+}
+
+func TestCheckRepairFreeBitmap(t *testing.T) {
+	path, err := ioutil.TempDir("", "swarm-forky-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(path)
+
+	o := &forky.Options{
+		ShardCount: 1,
+		FreeBitmap: true,
+	}
+	metaStore := mem.NewMetaStore()
+	s, err := forky.NewStore(path, chunk.DefaultSize, metaStore, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		if err := s.Put(test.GenerateTestRandomChunk()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	misaligned := test.GenerateTestRandomChunk().Address()
+	if err := metaStore.Set(misaligned, 0, false, &forky.Meta{Offset: 10}); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := forky.Repair(path, chunk.DefaultSize, metaStore, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !r.Repaired {
+		t.Error("not repaired")
+	}
+	if _, err := metaStore.Get(misaligned); err != chunk.ErrChunkNotFound {
+		t.Errorf("got error %v, want %v", err, chunk.ErrChunkNotFound)
+	}
+	// removed entries must not leave free offsets in MetaStore
+	if err := metaStore.IterateFreeOffsets(0, func(offset int64) (bool, error) {
+		t.Errorf("got free offset %v in meta store", offset)
+		return false, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
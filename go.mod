@@ -7,4 +7,5 @@ require (
 	github.com/ethersphere/swarm v0.4.4-0.20190903123039-506ab973a6f9
 	github.com/syndtr/goleveldb v0.0.0-20190318030020-c3a204f8e965
 	go.etcd.io/bbolt v1.3.3
+	golang.org/x/sync v0.0.0-20190423024810-112230192c58
 )
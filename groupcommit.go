@@ -0,0 +1,188 @@
+// Copyright 2019 The Swarm Authors
+// This file is part of the Swarm library.
+//
+// The Swarm library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The Swarm library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the Swarm library. If not, see <http://www.gnu.org/licenses/>.
+
+package forky
+
+import (
+	"sync"
+
+	"github.com/ethersphere/swarm/chunk"
+)
+
+// MetaWrite holds arguments of a single MetaStore Set or Remove call.
+type MetaWrite struct {
+	MetaEntry
+	// Remove is true for Remove calls, which use only Address and Shard.
+	Remove bool
+	// NoFreeOffset is true for removes that do not store the slot as a free
+	// offset, as free slots are kept in bitmaps.
+	NoFreeOffset bool
+}
+
+// GroupMetaStore is an optional MetaStore extension that applies Set and
+// Remove calls of multiple Puts and Deletes with a single write, in the
+// provided order. It is used if Options.GroupCommit is true.
+type GroupMetaStore interface {
+	WriteGroup(writes []MetaWrite) error
+}
+
+// maxGroupSize is the maximal number of writes in a group. Writes of a single
+// PutMulti that has more of them are committed in a group of their own.
+const maxGroupSize = 256
+
+// groupCommitter coalesces MetaStore writes of concurrent Puts and Deletes.
+// Writes that are sent while a group is committed are committed together
+// in the next group.
+type groupCommitter struct {
+	store    GroupMetaStore
+	syncFunc func() error
+	writes   chan *groupWrite
+	quit     chan struct{}
+	quitOnce sync.Once
+	done     chan struct{}
+}
+
+// groupWrite holds writes that are committed together, as they are all
+// part of the same PutMulti, or none of them.
+type groupWrite struct {
+	writes []MetaWrite
+	errC   chan error
+}
+
+func newGroupCommitter(store GroupMetaStore, syncFunc func() error) (c *groupCommitter) {
+	c = &groupCommitter{
+		store:    store,
+		syncFunc: syncFunc,
+		writes:   make(chan *groupWrite),
+		quit:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go c.run()
+	return c
+}
+
+func (c *groupCommitter) set(addr chunk.Address, shard uint8, reclaimed bool, m *Meta) (err error) {
+	return c.write(MetaWrite{
+		MetaEntry: MetaEntry{
+			Address:   addr,
+			Shard:     shard,
+			Reclaimed: reclaimed,
+			Meta:      m,
+		},
+	})
+}
+
+func (c *groupCommitter) setBatch(entries []MetaEntry) (err error) {
+	writes := make([]MetaWrite, len(entries))
+	for i, e := range entries {
+		writes[i] = MetaWrite{MetaEntry: e}
+	}
+	return c.write(writes...)
+}
+
+func (c *groupCommitter) remove(addr chunk.Address, shard uint8, noFreeOffset bool) (err error) {
+	return c.write(MetaWrite{
+		MetaEntry: MetaEntry{
+			Address: addr,
+			Shard:   shard,
+		},
+		Remove:       true,
+		NoFreeOffset: noFreeOffset,
+	})
+}
+
+func (c *groupCommitter) write(writes ...MetaWrite) (err error) {
+	gw := &groupWrite{
+		writes: writes,
+		errC:   make(chan error, 1),
+	}
+	select {
+	case c.writes <- gw:
+	case <-c.quit:
+		return ErrDBClosed
+	}
+	return <-gw.errC
+}
+
+func (c *groupCommitter) run() {
+	defer close(c.done)
+
+	group := make([]*groupWrite, 0, maxGroupSize)
+	writes := make([]MetaWrite, 0, maxGroupSize)
+	// next is the write that did not fit into the previous group
+	var next *groupWrite
+	for {
+		group = group[:0]
+		if next != nil {
+			group = append(group, next)
+			next = nil
+		} else {
+			select {
+			case w := <-c.writes:
+				group = append(group, w)
+			case <-c.quit:
+				return
+			}
+		}
+		writes = append(writes[:0], group[0].writes...)
+	collect:
+		for len(writes) < maxGroupSize {
+			select {
+			case w := <-c.writes:
+				if len(writes)+len(w.writes) > maxGroupSize {
+					next = w
+					break collect
+				}
+				group = append(group, w)
+				writes = append(writes, w.writes...)
+			default:
+				break collect
+			}
+		}
+		errs := make([]error, len(group))
+		if err := c.store.WriteGroup(writes); err != nil {
+			if len(group) == 1 {
+				errs[0] = err
+			} else {
+				// every write is committed separately to get its own error
+				for i, w := range group {
+					errs[i] = c.store.WriteGroup(w.writes)
+				}
+			}
+		}
+		if c.syncFunc != nil {
+			if err := c.syncFunc(); err != nil {
+				for i := range errs {
+					if errs[i] == nil {
+						errs[i] = err
+					}
+				}
+			}
+		}
+		for i, w := range group {
+			w.errC <- errs[i]
+		}
+	}
+}
+
+// close stops committing writes. Writes that are not yet part of a group
+// return ErrDBClosed.
+func (c *groupCommitter) close() {
+	c.quitOnce.Do(func() {
+		close(c.quit)
+	})
+	<-c.done
+}
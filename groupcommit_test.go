@@ -0,0 +1,234 @@
+// Copyright 2019 The Swarm Authors
+// This file is part of the Swarm library.
+//
+// The Swarm library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The Swarm library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the Swarm library. If not, see <http://www.gnu.org/licenses/>.
+
+package forky
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ethersphere/swarm/chunk"
+)
+
+func TestGroupCommitter(t *testing.T) {
+	store := &groupTestMetaStore{
+		failing: generateRandomAddress(32),
+		entered: make(chan struct{}),
+		block:   make(chan struct{}),
+	}
+	var syncs int
+	c := newGroupCommitter(store, func() error {
+		syncs++
+		return nil
+	})
+
+	// the first write blocks the committer, so that others are grouped
+	first := make(chan error)
+	go func() {
+		first <- c.set(generateRandomAddress(32), 0, false, new(Meta))
+	}()
+	<-store.entered
+
+	const count = 10
+	errC := make(chan error, count)
+	for i := 0; i < count; i++ {
+		addr := generateRandomAddress(32)
+		if i == 0 {
+			addr = store.failing
+		}
+		go func(addr chunk.Address) {
+			errC <- c.remove(addr, 0, false)
+		}(addr)
+	}
+	// wait for writes to be sent
+	time.Sleep(100 * time.Millisecond)
+	close(store.block)
+
+	if err := <-first; err != nil {
+		t.Fatal(err)
+	}
+	var failed int
+	for i := 0; i < count; i++ {
+		if err := <-errC; err != nil {
+			if err != errGroupTestFailing {
+				t.Fatal(err)
+			}
+			failed++
+		}
+	}
+	if failed != 1 {
+		t.Errorf("got %v failed writes, want 1", failed)
+	}
+
+	c.close()
+
+	// the failed group is retried with a separate group for every write
+	wantGroups := []int{1, count}
+	for i := 0; i < count; i++ {
+		wantGroups = append(wantGroups, 1)
+	}
+	if groups := store.groupSizes(); !reflect.DeepEqual(groups, wantGroups) {
+		t.Errorf("got group sizes %v, want %v", groups, wantGroups)
+	}
+	if syncs != 2 {
+		t.Errorf("got %v syncs, want 2", syncs)
+	}
+	if err := c.set(generateRandomAddress(32), 0, false, new(Meta)); err != ErrDBClosed {
+		t.Errorf("got error %v, want %v", err, ErrDBClosed)
+	}
+}
+
+var errGroupTestFailing = errors.New("failing write")
+
+// groupTestMetaStore records sizes of write groups and fails groups with the
+// failing address. The first group blocks until the block channel is closed.
+type groupTestMetaStore struct {
+	failing chunk.Address
+	entered chan struct{}
+	block   chan struct{}
+	groups  []int
+	mu      sync.Mutex
+}
+
+func (s *groupTestMetaStore) WriteGroup(writes []MetaWrite) error {
+	s.mu.Lock()
+	first := len(s.groups) == 0
+	s.groups = append(s.groups, len(writes))
+	s.mu.Unlock()
+
+	if first {
+		close(s.entered)
+		<-s.block
+	}
+	for _, w := range writes {
+		if bytes.Equal(w.Address, s.failing) {
+			return errGroupTestFailing
+		}
+	}
+	return nil
+}
+
+func (s *groupTestMetaStore) groupSizes() (sizes []int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]int(nil), s.groups...)
+}
+
+func TestGroupCommitterBatch(t *testing.T) {
+	store := &groupTestMetaStore{
+		failing: generateRandomAddress(32),
+		entered: make(chan struct{}),
+		block:   make(chan struct{}),
+	}
+	c := newGroupCommitter(store, nil)
+	defer c.close()
+
+	first := make(chan error)
+	go func() {
+		first <- c.set(generateRandomAddress(32), 0, false, new(Meta))
+	}()
+	<-store.entered
+
+	// entries of a batch are committed and retried together
+	batches := [][]MetaEntry{
+		{
+			{Address: generateRandomAddress(32), Meta: new(Meta)},
+			{Address: store.failing, Meta: new(Meta)},
+		},
+		{
+			{Address: generateRandomAddress(32), Meta: new(Meta)},
+			{Address: generateRandomAddress(32), Meta: new(Meta)},
+			{Address: generateRandomAddress(32), Meta: new(Meta)},
+		},
+	}
+	errC := make(chan error, len(batches))
+	for _, b := range batches {
+		go func(b []MetaEntry) {
+			errC <- c.setBatch(b)
+		}(b)
+		// wait for the batch to be sent
+		time.Sleep(50 * time.Millisecond)
+	}
+	close(store.block)
+
+	if err := <-first; err != nil {
+		t.Fatal(err)
+	}
+	var failed int
+	for range batches {
+		if err := <-errC; err != nil {
+			if err != errGroupTestFailing {
+				t.Fatal(err)
+			}
+			failed++
+		}
+	}
+	if failed != 1 {
+		t.Errorf("got %v failed batches, want 1", failed)
+	}
+	if groups, want := store.groupSizes(), []int{1, 5, 2, 3}; !reflect.DeepEqual(groups, want) {
+		t.Errorf("got group sizes %v, want %v", groups, want)
+	}
+}
+
+func TestGroupCommitterMaxGroupSize(t *testing.T) {
+	store := &groupTestMetaStore{
+		failing: generateRandomAddress(32),
+		entered: make(chan struct{}),
+		block:   make(chan struct{}),
+	}
+	c := newGroupCommitter(store, nil)
+	defer c.close()
+
+	first := make(chan error)
+	go func() {
+		first <- c.set(generateRandomAddress(32), 0, false, new(Meta))
+	}()
+	<-store.entered
+
+	// the second batch does not fit into the group with the first one
+	sizes := []int{maxGroupSize - 1, 2, maxGroupSize + 1}
+	errC := make(chan error, len(sizes))
+	for _, size := range sizes {
+		b := make([]MetaEntry, size)
+		for i := range b {
+			b[i] = MetaEntry{Address: generateRandomAddress(32), Meta: new(Meta)}
+		}
+		go func(b []MetaEntry) {
+			errC <- c.setBatch(b)
+		}(b)
+		// wait for the batch to be sent
+		time.Sleep(50 * time.Millisecond)
+	}
+	close(store.block)
+
+	if err := <-first; err != nil {
+		t.Fatal(err)
+	}
+	for range sizes {
+		if err := <-errC; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if groups, want := store.groupSizes(), []int{1, maxGroupSize - 1, 2, maxGroupSize + 1}; !reflect.DeepEqual(groups, want) {
+		t.Errorf("got group sizes %v, want %v", groups, want)
+	}
+}
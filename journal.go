@@ -0,0 +1,376 @@
+// Copyright 2019 The Swarm Authors
+// This file is part of the Swarm library.
+//
+// The Swarm library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The Swarm library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the Swarm library. If not, see <http://www.gnu.org/licenses/>.
+
+package forky
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/ethersphere/swarm/chunk"
+)
+
+const journalFilename = "journal"
+
+// journalTruncateSize is the size of the journal file after which it is
+// truncated as soon as there are no pending intents.
+const journalTruncateSize = 1 << 20
+
+const (
+	journalPut    byte = 1
+	journalDelete byte = 2
+	journalDone   byte = 3
+	journalMove   byte = 4
+)
+
+var errJournalRecord = errors.New("invalid journal record")
+
+// journalRecord is an intent to allocate a slot for a chunk or to free it.
+// Every put and delete intent is followed by a done record with the same id
+// once the shard file and MetaStore are both updated.
+type journalRecord struct {
+	typ       byte
+	id        uint64
+	shard     uint8 // bin of the slot
+	reclaimed bool
+	meta      Meta
+	addr      chunk.Address
+	// from is the offset of the slot that the chunk is moved from by
+	// compaction, encoded only in move records
+	from int64
+}
+
+// Journal record flags.
+const (
+	journalFlagReclaimed uint8 = 1 << iota
+	journalFlagNoChecksum
+)
+
+// journalRecordHeaderSize is the length of the encoded record without address
+// and checksum: type, id, shard, reclaimed, meta and address length.
+const journalRecordHeaderSize = 1 + 8 + 1 + 1 + metaSize + 1
+
+func (r *journalRecord) MarshalBinary() (data []byte, err error) {
+	l := journalRecordHeaderSize + len(r.addr)
+	if r.typ == journalMove {
+		l += 8
+	}
+	data = make([]byte, l+4)
+	data[0] = r.typ
+	binary.BigEndian.PutUint64(data[1:9], r.id)
+	data[9] = r.shard
+	if r.reclaimed {
+		data[10] |= journalFlagReclaimed
+	}
+	if r.meta.noChecksum {
+		data[10] |= journalFlagNoChecksum
+	}
+	meta, err := r.meta.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	copy(data[11:11+metaSize], meta)
+	data[11+metaSize] = uint8(len(r.addr))
+	copy(data[journalRecordHeaderSize:], r.addr)
+	if r.typ == journalMove {
+		binary.BigEndian.PutUint64(data[l-8:l], uint64(r.from))
+	}
+	binary.BigEndian.PutUint32(data[l:], crc32.Checksum(data[:l], castagnoliTable))
+	return data, nil
+}
+
+// readJournalRecord reads a single record from the reader. It returns
+// errJournalRecord if the record is incomplete or its checksum is not valid,
+// which is expected for the last record of a journal after a crash.
+func readJournalRecord(r io.Reader) (rec *journalRecord, err error) {
+	data := make([]byte, journalRecordHeaderSize)
+	if _, err := io.ReadFull(r, data); err != nil {
+		if err == io.EOF {
+			return nil, err
+		}
+		return nil, errJournalRecord
+	}
+	addrLen := int(data[journalRecordHeaderSize-1])
+	n := addrLen + 4
+	if data[0] == journalMove {
+		n += 8
+	}
+	data = append(data, make([]byte, n)...)
+	if _, err := io.ReadFull(r, data[journalRecordHeaderSize:]); err != nil {
+		return nil, errJournalRecord
+	}
+	l := len(data) - 4
+	if crc32.Checksum(data[:l], castagnoliTable) != binary.BigEndian.Uint32(data[l:]) {
+		return nil, errJournalRecord
+	}
+	rec = &journalRecord{
+		typ:       data[0],
+		id:        binary.BigEndian.Uint64(data[1:9]),
+		shard:     data[9],
+		reclaimed: data[10]&journalFlagReclaimed != 0,
+		addr:      chunk.Address(append([]byte(nil), data[journalRecordHeaderSize:journalRecordHeaderSize+addrLen]...)),
+	}
+	if rec.typ == journalMove {
+		rec.from = int64(binary.BigEndian.Uint64(data[l-8 : l]))
+	}
+	if err := rec.meta.UnmarshalBinary(data[11 : 11+metaSize]); err != nil {
+		return nil, err
+	}
+	if data[10]&journalFlagNoChecksum != 0 {
+		rec.meta.Checksum = 0
+		rec.meta.noChecksum = true
+	}
+	return rec, nil
+}
+
+// journal is an append only write-ahead log of slot allocations and frees
+// that are not yet recorded in MetaStore. Done records are buffered and
+// written together with the next intent, as losing them only makes the
+// recovery of already completed intents a no-op.
+type journal struct {
+	f       *os.File
+	size    int64
+	id      uint64
+	pending int
+	dones   []byte
+	// sync is true if intents are synced to persistent storage before
+	// they are returned by begin.
+	sync bool
+	mu   sync.Mutex
+}
+
+func openJournal(filename string, durable bool) (j *journal, pending []*journalRecord, err error) {
+	f, err := os.OpenFile(filename, os.O_CREATE|os.O_RDWR, 0666)
+	if err != nil {
+		return nil, nil, err
+	}
+	pending, err = readJournal(f)
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	return &journal{f: f, sync: durable}, pending, nil
+}
+
+func readJournal(reader io.Reader) (pending []*journalRecord, err error) {
+	r := bufio.NewReader(reader)
+	records := make(map[uint64][]*journalRecord)
+	var ids []uint64
+	for {
+		rec, err := readJournalRecord(r)
+		if err != nil {
+			if err == io.EOF || err == errJournalRecord {
+				break
+			}
+			return nil, err
+		}
+		switch rec.typ {
+		case journalPut, journalDelete, journalMove:
+			if _, ok := records[rec.id]; !ok {
+				ids = append(ids, rec.id)
+			}
+			records[rec.id] = append(records[rec.id], rec)
+		case journalDone:
+			delete(records, rec.id)
+		}
+	}
+	for _, id := range ids {
+		pending = append(pending, records[id]...)
+	}
+	return pending, nil
+}
+
+// begin writes intents to the journal with a single id that must be passed
+// to the done method once all of them are completed.
+func (j *journal) begin(records ...*journalRecord) (id uint64, err error) {
+	j.mu.Lock()
+	j.id++
+	id = j.id
+	data := j.dones
+	for _, r := range records {
+		r.id = id
+		d, err := r.MarshalBinary()
+		if err != nil {
+			j.mu.Unlock()
+			return 0, err
+		}
+		data = append(data, d...)
+	}
+	if err := j.write(data); err != nil {
+		j.mu.Unlock()
+		return 0, err
+	}
+	j.dones = data[:0]
+	j.pending++
+	j.mu.Unlock()
+
+	if j.sync {
+		// concurrent intents are synced by the same call
+		if err := j.f.Sync(); err != nil {
+			j.done(id)
+			return 0, err
+		}
+	}
+	return id, nil
+}
+
+func (j *journal) done(id uint64) (err error) {
+	data, err := (&journalRecord{
+		typ: journalDone,
+		id:  id,
+	}).MarshalBinary()
+	if err != nil {
+		return err
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.dones = append(j.dones, data...)
+	j.pending--
+	if j.pending == 0 && j.size >= journalTruncateSize {
+		return j.truncate()
+	}
+	return nil
+}
+
+func (j *journal) flush() (err error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if len(j.dones) == 0 {
+		return nil
+	}
+	if err := j.write(j.dones); err != nil {
+		return err
+	}
+	j.dones = j.dones[:0]
+	return nil
+}
+
+func (j *journal) write(data []byte) (err error) {
+	n, err := j.f.WriteAt(data, j.size)
+	j.size += int64(n)
+	return err
+}
+
+func (j *journal) truncate() (err error) {
+	if err := j.f.Truncate(0); err != nil {
+		return err
+	}
+	j.size = 0
+	j.dones = j.dones[:0]
+	return nil
+}
+
+func (j *journal) syncFile() (err error) {
+	if err := j.flush(); err != nil {
+		return err
+	}
+	return j.f.Sync()
+}
+
+func (j *journal) close() (err error) {
+	if err := j.flush(); err != nil {
+		j.f.Close()
+		return err
+	}
+	return j.f.Close()
+}
+
+// recover brings MetaStore and shard files to a consistent state for every
+// intent that was not completed before the store was closed. Incomplete slot
+// allocations are rolled back by marking the slot as free, incomplete
+// deletions are rolled forward and the slot that is not referenced after an
+// incomplete compaction move is marked as free.
+func (s *Store) recover(pending []*journalRecord) (err error) {
+	for _, r := range pending {
+		m, err := s.meta.Get(r.addr)
+		if err != nil && err != chunk.ErrChunkNotFound {
+			return err
+		}
+		referenced := err == nil && m.Offset == r.meta.Offset
+		switch r.typ {
+		case journalPut:
+			if referenced {
+				// the slot may not be included in the recorded data end
+				if err := s.allocators[r.shard].cover(r.meta.Offset); err != nil {
+					return err
+				}
+				continue
+			}
+			if !r.reclaimed && r.meta.Offset >= s.allocators[r.shard].size() {
+				// the slot is not reserved, as the data end was not recorded
+				continue
+			}
+			if err := s.markSlotFree(r.shard, r.meta.Offset); err != nil {
+				return err
+			}
+			if r.reclaimed || s.bitmaps != nil {
+				// the reclaimed slot was not removed from free offsets and
+				// unreferenced slots are free in rebuilt bitmaps
+				continue
+			}
+			if err := s.meta.SetFreeOffset(r.shard, r.meta.Offset); err != nil {
+				return err
+			}
+			s.free[r.shard] = struct{}{}
+		case journalDelete:
+			if !referenced {
+				continue
+			}
+			if err := s.markSlotFree(r.shard, m.Offset); err != nil {
+				return err
+			}
+			if err := s.removeMeta(r.addr, r.shard, m); err != nil {
+				return err
+			}
+			if s.bitmaps != nil {
+				s.bitmaps[r.shard].set(m.Offset / s.layout.slotSize(r.shard))
+			}
+			s.free[r.shard] = struct{}{}
+		case journalMove:
+			if !referenced {
+				// meta still references the old slot and the copy in the
+				// new slot, which is still free, must not be rebuilt
+				if err := s.markSlotFree(r.shard, r.meta.Offset); err != nil {
+					return err
+				}
+				continue
+			}
+			if r.from >= s.allocators[r.shard].size() {
+				// the old slot is already truncated
+				continue
+			}
+			if err := s.markSlotFree(r.shard, r.from); err != nil {
+				return err
+			}
+			if s.bitmaps != nil {
+				continue
+			}
+			if err := s.meta.SetFreeOffset(r.shard, r.from); err != nil {
+				return err
+			}
+			s.free[r.shard] = struct{}{}
+		}
+	}
+	return s.journal.truncate()
+}
@@ -0,0 +1,92 @@
+// Copyright 2019 The Swarm Authors
+// This file is part of the Swarm library.
+//
+// The Swarm library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The Swarm library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the Swarm library. If not, see <http://www.gnu.org/licenses/>.
+
+package forky
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestJournalDoneRecords(t *testing.T) {
+	dir, err := ioutil.TempDir("", "swarm-forky-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, journalFilename)
+
+	j, _, err := openJournal(filename, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, err := j.begin(&journalRecord{
+		typ:  journalPut,
+		meta: Meta{Size: 10},
+		addr: generateRandomAddress(32),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := j.done(first); err != nil {
+		t.Fatal(err)
+	}
+	size := j.size
+
+	// the done record is buffered until the next intent
+	second, err := j.begin(&journalRecord{
+		typ:  journalDelete,
+		meta: Meta{Size: 10, noChecksum: true},
+		addr: generateRandomAddress(32),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := int64(journalRecordHeaderSize+4) + journalRecordHeaderSize + 32 + 4
+	if got := j.size - size; got != want {
+		t.Errorf("got written size %v, want %v", got, want)
+	}
+
+	f, err := os.Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pending, err := readJournal(f)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 1 || pending[0].id != second || pending[0].typ != journalDelete || !pending[0].meta.noChecksum {
+		t.Fatalf("got pending records %+v, want only delete %v", pending, second)
+	}
+
+	if err := j.done(second); err != nil {
+		t.Fatal(err)
+	}
+	if err := j.close(); err != nil {
+		t.Fatal(err)
+	}
+	j, pending, err = openJournal(filename, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.close()
+	if len(pending) != 0 {
+		t.Errorf("got %v pending records after close, want none", len(pending))
+	}
+}
@@ -23,9 +23,18 @@ import (
 	"github.com/janos/forky"
 	"github.com/syndtr/goleveldb/leveldb"
 	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/util"
 )
 
-var _ forky.MetaStore = new(MetaStore)
+var (
+	_ forky.MetaStore         = new(MetaStore)
+	_ forky.BatchMetaStore    = new(MetaStore)
+	_ forky.BatchGetMetaStore = new(MetaStore)
+	_ forky.SyncMetaStore     = new(MetaStore)
+	_ forky.GroupMetaStore    = new(MetaStore)
+	_ forky.BitmapMetaStore   = new(MetaStore)
+	_ forky.RangeMetaStore    = new(MetaStore)
+)
 
 type MetaStore struct {
 	db *leveldb.DB
@@ -56,6 +65,30 @@ func (s *MetaStore) Get(addr chunk.Address) (m *forky.Meta, err error) {
 	return m, nil
 }
 
+func (s *MetaStore) GetBatch(addrs []chunk.Address) (metas []*forky.Meta, err error) {
+	snapshot, err := s.db.GetSnapshot()
+	if err != nil {
+		return nil, err
+	}
+	defer snapshot.Release()
+
+	metas = make([]*forky.Meta, len(addrs))
+	for i, addr := range addrs {
+		data, err := snapshot.Get(chunkKey(addr), nil)
+		if err != nil {
+			if err == leveldb.ErrNotFound {
+				continue
+			}
+			return nil, err
+		}
+		metas[i] = new(forky.Meta)
+		if err := metas[i].UnmarshalBinary(data); err != nil {
+			return nil, err
+		}
+	}
+	return metas, nil
+}
+
 func (s *MetaStore) Set(addr chunk.Address, shard uint8, reclaimed bool, m *forky.Meta) (err error) {
 	batch := new(leveldb.Batch)
 	if reclaimed {
@@ -69,6 +102,60 @@ func (s *MetaStore) Set(addr chunk.Address, shard uint8, reclaimed bool, m *fork
 	return s.db.Write(batch, nil)
 }
 
+func (s *MetaStore) SetBatch(entries []forky.MetaEntry) (err error) {
+	batch := new(leveldb.Batch)
+	for _, e := range entries {
+		if e.Reclaimed {
+			batch.Delete(freeKey(e.Shard, e.Meta.Offset))
+		}
+		meta, err := e.Meta.MarshalBinary()
+		if err != nil {
+			return err
+		}
+		batch.Put(chunkKey(e.Address), meta)
+	}
+	return s.db.Write(batch, nil)
+}
+
+// WriteGroup applies all writes with a single batch. Meta of removed chunks
+// is read before the batch is written, including meta set by earlier writes
+// in the group.
+func (s *MetaStore) WriteGroup(writes []forky.MetaWrite) (err error) {
+	batch := new(leveldb.Batch)
+	metas := make(map[string]*forky.Meta)
+	for _, w := range writes {
+		key := string(w.Address)
+		if w.Remove {
+			m, ok := metas[key]
+			if !ok {
+				m, err = s.Get(w.Address)
+				if err != nil {
+					return err
+				}
+			}
+			if m == nil {
+				return chunk.ErrChunkNotFound
+			}
+			if !w.NoFreeOffset {
+				batch.Put(freeKey(w.Shard, m.Offset), nil)
+			}
+			batch.Delete(chunkKey(w.Address))
+			metas[key] = nil
+			continue
+		}
+		if w.Reclaimed {
+			batch.Delete(freeKey(w.Shard, w.Meta.Offset))
+		}
+		meta, err := w.Meta.MarshalBinary()
+		if err != nil {
+			return err
+		}
+		batch.Put(chunkKey(w.Address), meta)
+		metas[key] = w.Meta
+	}
+	return s.db.Write(batch, nil)
+}
+
 func (s *MetaStore) FreeOffset(shard uint8) (offset int64, err error) {
 	i := s.db.NewIterator(nil, nil)
 	defer i.Release()
@@ -82,6 +169,30 @@ func (s *MetaStore) FreeOffset(shard uint8) (offset int64, err error) {
 	return offset, nil
 }
 
+func (s *MetaStore) SetFreeOffset(shard uint8, offset int64) (err error) {
+	return s.db.Put(freeKey(shard, offset), nil, nil)
+}
+
+func (s *MetaStore) RemoveFreeOffset(shard uint8, offset int64) (err error) {
+	return s.db.Delete(freeKey(shard, offset), nil)
+}
+
+func (s *MetaStore) IterateFreeOffsets(shard uint8, fn func(offset int64) (stop bool, err error)) (err error) {
+	it := s.db.NewIterator(util.BytesPrefix([]byte{freePrefix, shard}), nil)
+	defer it.Release()
+
+	for ok := it.First(); ok; ok = it.Next() {
+		stop, err := fn(int64(binary.BigEndian.Uint64(it.Key()[2:10])))
+		if err != nil {
+			return err
+		}
+		if stop {
+			return nil
+		}
+	}
+	return it.Error()
+}
+
 func (s *MetaStore) Remove(addr chunk.Address, shard uint8) (err error) {
 	m, err := s.Get(addr)
 	if err != nil {
@@ -93,6 +204,13 @@ func (s *MetaStore) Remove(addr chunk.Address, shard uint8) (err error) {
 	return s.db.Write(batch, nil)
 }
 
+func (s *MetaStore) RemoveMeta(addr chunk.Address) (err error) {
+	if _, err := s.Get(addr); err != nil {
+		return err
+	}
+	return s.db.Delete(chunkKey(addr), nil)
+}
+
 func (s *MetaStore) Count() (count int, err error) {
 	it := s.db.NewIterator(nil, nil)
 	defer it.Release()
@@ -139,6 +257,32 @@ func (s *MetaStore) Iterate(fn func(chunk.Address, *forky.Meta) (stop bool, err
 	return it.Error()
 }
 
+func (s *MetaStore) IterateFrom(start chunk.Address, fn func(chunk.Address, *forky.Meta) (stop bool, err error)) (err error) {
+	it := s.db.NewIterator(util.BytesPrefix([]byte{chunkPrefix}), nil)
+	defer it.Release()
+
+	for ok := it.Seek(chunkKey(start)); ok; ok = it.Next() {
+		m := new(forky.Meta)
+		if err := m.UnmarshalBinary(it.Value()); err != nil {
+			return err
+		}
+		stop, err := fn(chunk.Address(it.Key()[1:]), m)
+		if err != nil {
+			return err
+		}
+		if stop {
+			return nil
+		}
+	}
+	return it.Error()
+}
+
+// Sync writes the database journal to persistent storage, by writing a
+// sync marker that is ignored by other methods.
+func (s *MetaStore) Sync() (err error) {
+	return s.db.Put(syncKey, nil, &opt.WriteOptions{Sync: true})
+}
+
 func (s *MetaStore) Close() (err error) {
 	return s.db.Close()
 }
@@ -146,8 +290,11 @@ func (s *MetaStore) Close() (err error) {
 const (
 	chunkPrefix = 0
 	freePrefix  = 1
+	syncPrefix  = 2
 )
 
+var syncKey = []byte{syncPrefix}
+
 func chunkKey(addr chunk.Address) (key []byte) {
 	return append([]byte{chunkPrefix}, addr...)
 }
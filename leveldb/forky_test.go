@@ -18,6 +18,7 @@ package leveldb_test
 
 import (
 	"io/ioutil"
+	"os"
 	"path/filepath"
 	"testing"
 
@@ -28,16 +29,42 @@ import (
 
 func TestLevelDBForky(t *testing.T) {
 	test.StoreSuite(t, func(t *testing.T) (forky.Interface, func()) {
-		path, err := ioutil.TempDir("", "swarm-forky-")
-		if err != nil {
-			t.Fatal(err)
-		}
+		return newForkyStore(t)
+	})
+}
+
+func TestLevelDBRangeMetaStore(t *testing.T) {
+	path, err := ioutil.TempDir("", "swarm-forky-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(path)
 
-		metaStore, err := leveldb.NewMetaStore(filepath.Join(path, "meta"))
-		if err != nil {
-			t.Fatal(err)
-		}
+	metaStore, err := leveldb.NewMetaStore(filepath.Join(path, "meta"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer metaStore.Close()
+
+	test.RangeMetaStoreSuite(t, metaStore)
+}
 
-		return test.NewForkyStore(t, path, metaStore)
+func BenchmarkLevelDBForky(b *testing.B) {
+	test.StoreBenchmarkSuite(b, func(b *testing.B) (forky.Interface, func()) {
+		return newForkyStore(b)
 	})
 }
+
+func newForkyStore(t testing.TB) (s *forky.Store, clean func()) {
+	path, err := ioutil.TempDir("", "swarm-forky-")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	metaStore, err := leveldb.NewMetaStore(filepath.Join(path, "meta"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return test.NewForkyStore(t, path, metaStore)
+}
@@ -52,6 +52,29 @@ func (s *LevelDBStore) Get(addr chunk.Address) (c chunk.Chunk, err error) {
 	return chunk.NewChunk(addr, data), nil
 }
 
+func (s *LevelDBStore) GetMulti(addrs ...chunk.Address) (chunks []chunk.Chunk, errs []error, err error) {
+	snapshot, err := s.db.GetSnapshot()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer snapshot.Release()
+
+	chunks = make([]chunk.Chunk, len(addrs))
+	errs = make([]error, len(addrs))
+	for i, addr := range addrs {
+		data, err := snapshot.Get(addr, nil)
+		if err != nil {
+			if err == leveldb.ErrNotFound {
+				err = chunk.ErrChunkNotFound
+			}
+			errs[i] = err
+			continue
+		}
+		chunks[i] = chunk.NewChunk(addr, data)
+	}
+	return chunks, errs, nil
+}
+
 func (s *LevelDBStore) Has(addr chunk.Address) (yes bool, err error) {
 	return s.db.Has(addr, nil)
 }
@@ -60,6 +83,14 @@ func (s *LevelDBStore) Put(ch chunk.Chunk) (err error) {
 	return s.db.Put(ch.Address(), ch.Data(), nil)
 }
 
+func (s *LevelDBStore) PutMulti(chunks ...chunk.Chunk) (err error) {
+	batch := new(leveldb.Batch)
+	for _, ch := range chunks {
+		batch.Put(ch.Address(), ch.Data())
+	}
+	return s.db.Write(batch, nil)
+}
+
 func (s *LevelDBStore) Delete(addr chunk.Address) (err error) {
 	return s.db.Delete(addr, nil)
 }
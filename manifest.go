@@ -0,0 +1,286 @@
+// Copyright 2019 The Swarm Authors
+// This file is part of the Swarm library.
+//
+// The Swarm library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The Swarm library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the Swarm library. If not, see <http://www.gnu.org/licenses/>.
+
+package forky
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const manifestFilename = "manifest.json"
+
+// FormatVersion is the version of the on-disk store layout that is written
+// by this package.
+const FormatVersion = 1
+
+// Manifest describes the layout of the store directory. It is written when
+// the store is created and validated every time it is opened.
+type Manifest struct {
+	Version       int        `json:"version"`
+	ShardCount    int        `json:"shardCount"`
+	ShardFunc     ShardFunc  `json:"shardFunc"`
+	MaxChunkSize  int        `json:"maxChunkSize"`
+	SlotSize      int64      `json:"slotSize"`
+	SlotFormat    SlotFormat `json:"slotFormat"`
+	SizeClasses   []int      `json:"sizeClasses,omitempty"`
+	SlotAlignment int        `json:"slotAlignment,omitempty"`
+	Created       time.Time  `json:"created"`
+	UUID          string     `json:"uuid"`
+}
+
+// ManifestMismatchError is returned when the store is opened with
+// parameters that are different from the ones in the store manifest.
+type ManifestMismatchError struct {
+	Field    string
+	Manifest interface{}
+	Options  interface{}
+}
+
+func (e *ManifestMismatchError) Error() string {
+	return fmt.Sprintf("store manifest %s is %v, but %v is configured", e.Field, e.Manifest, e.Options)
+}
+
+// migrations upgrade the store in the directory from the format version of
+// the key to the next one, also updating the manifest fields.
+var migrations = map[int]func(path string, m *Manifest) error{
+	// stores without the manifest have the layout of the first release
+	0: func(path string, m *Manifest) (err error) {
+		uuid, err := newUUID()
+		if err != nil {
+			return err
+		}
+		*m = *legacyManifest(m.MaxChunkSize)
+		m.UUID = uuid
+		return nil
+	},
+}
+
+func legacyManifest(maxChunkSize int) (m *Manifest) {
+	return &Manifest{
+		Version:      0,
+		ShardCount:   32,
+		ShardFunc:    ShardLastByte,
+		MaxChunkSize: maxChunkSize,
+		SlotSize:     slotSize(maxChunkSize, SlotFormatRaw, 0),
+		SlotFormat:   SlotFormatRaw,
+		Created:      time.Now().UTC(),
+	}
+}
+
+func hasShardFiles(path string) (ok bool, err error) {
+	matches, err := filepath.Glob(filepath.Join(path, "chunks-*.db"))
+	if err != nil {
+		return false, err
+	}
+	return len(matches) > 0, nil
+}
+
+// readStoreManifest reads the manifest from the store directory or returns
+// the manifest with version 0 if the store was created before manifests
+// were introduced. It returns os.ErrNotExist error if there is no store in
+// the directory.
+func readStoreManifest(path string, maxChunkSize int) (m *Manifest, err error) {
+	m, err = ReadManifest(path)
+	if err == nil || !os.IsNotExist(err) {
+		return m, err
+	}
+	ok, e := hasShardFiles(path)
+	if e != nil {
+		return nil, e
+	}
+	if !ok {
+		return nil, err
+	}
+	return &Manifest{
+		Version:      0,
+		MaxChunkSize: maxChunkSize,
+	}, nil
+}
+
+// ReadManifest reads the manifest from the store directory.
+func ReadManifest(path string) (m *Manifest, err error) {
+	data, err := ioutil.ReadFile(filepath.Join(path, manifestFilename))
+	if err != nil {
+		return nil, err
+	}
+	m = new(Manifest)
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, fmt.Errorf("manifest: %v", err)
+	}
+	return m, nil
+}
+
+func newManifest(maxChunkSize int, o *Options) (m *Manifest, err error) {
+	l, err := newLayout(maxChunkSize, o)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := o.ShardFunc.MarshalText(); err != nil {
+		return nil, err
+	}
+	if _, err := o.SlotFormat.MarshalText(); err != nil {
+		return nil, err
+	}
+	uuid, err := newUUID()
+	if err != nil {
+		return nil, err
+	}
+	return &Manifest{
+		Version:       FormatVersion,
+		ShardCount:    l.shardCount,
+		ShardFunc:     o.ShardFunc,
+		MaxChunkSize:  maxChunkSize,
+		SlotSize:      slotSize(maxChunkSize, o.SlotFormat, l.slotAlignment),
+		SlotFormat:    o.SlotFormat,
+		SizeClasses:   l.classes[:len(l.classes)-1],
+		SlotAlignment: o.SlotAlignment,
+		Created:       time.Now().UTC(),
+		UUID:          uuid,
+	}, nil
+}
+
+func newUUID() (uuid string, err error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
+
+func (m *Manifest) validate(want *Manifest) (err error) {
+	for _, f := range []struct {
+		name           string
+		manifest, want interface{}
+	}{
+		{"shard count", m.ShardCount, want.ShardCount},
+		{"shard function", m.ShardFunc, want.ShardFunc},
+		{"max chunk size", m.MaxChunkSize, want.MaxChunkSize},
+		{"slot format", m.SlotFormat, want.SlotFormat},
+		{"slot size", m.SlotSize, want.SlotSize},
+		{"size classes", fmt.Sprint(m.SizeClasses), fmt.Sprint(want.SizeClasses)},
+		{"slot alignment", m.SlotAlignment, want.SlotAlignment},
+	} {
+		if f.manifest != f.want {
+			return &ManifestMismatchError{
+				Field:    f.name,
+				Manifest: f.manifest,
+				Options:  f.want,
+			}
+		}
+	}
+	return nil
+}
+
+func (m *Manifest) options() (o *Options) {
+	return &Options{
+		ShardCount:    m.ShardCount,
+		ShardFunc:     m.ShardFunc,
+		SlotFormat:    m.SlotFormat,
+		SizeClasses:   m.SizeClasses,
+		SlotAlignment: m.SlotAlignment,
+	}
+}
+
+func (m *Manifest) layout() (l layout, err error) {
+	return newLayout(m.MaxChunkSize, m.options())
+}
+
+func openManifest(path string, maxChunkSize int, o *Options) (m *Manifest, err error) {
+	want, err := newManifest(maxChunkSize, o)
+	if err != nil {
+		return nil, err
+	}
+	m, err = readStoreManifest(path, maxChunkSize)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+		if err := writeManifest(path, want); err != nil {
+			return nil, err
+		}
+		return want, nil
+	}
+	if m.Version > FormatVersion {
+		return nil, fmt.Errorf("unsupported store format version %v", m.Version)
+	}
+	for m.Version < FormatVersion {
+		migrate, ok := migrations[m.Version]
+		if !ok {
+			return nil, fmt.Errorf("no migration from store format version %v", m.Version)
+		}
+		if err := migrate(path, m); err != nil {
+			return nil, fmt.Errorf("migrate store format version %v: %v", m.Version, err)
+		}
+		m.Version++
+		if err := writeManifest(path, m); err != nil {
+			return nil, err
+		}
+	}
+	if err := m.validate(want); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func checkManifest(path string, maxChunkSize int, o *Options) (err error) {
+	m, err := ReadManifest(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	want, err := newManifest(maxChunkSize, o)
+	if err != nil {
+		return err
+	}
+	return m.validate(want)
+}
+
+func writeManifest(path string, m *Manifest) (err error) {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	filename := filepath.Join(path, manifestFilename)
+	f, err := os.Create(filename + ".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(filename+".tmp", filename); err != nil {
+		return err
+	}
+	return syncDir(path)
+}
@@ -0,0 +1,141 @@
+// Copyright 2019 The Swarm Authors
+// This file is part of the Swarm library.
+//
+// The Swarm library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The Swarm library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the Swarm library. If not, see <http://www.gnu.org/licenses/>.
+
+package forky_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ethersphere/swarm/chunk"
+	"github.com/janos/forky"
+	"github.com/janos/forky/mem"
+	"github.com/janos/forky/test"
+)
+
+func TestManifest(t *testing.T) {
+	s, path, clean := newTestStore(t, chunk.DefaultSize, nil)
+	defer clean()
+
+	m := s.Manifest()
+	if m.Version != forky.FormatVersion {
+		t.Errorf("got version %v, want %v", m.Version, forky.FormatVersion)
+	}
+	if m.MaxChunkSize != chunk.DefaultSize {
+		t.Errorf("got max chunk size %v, want %v", m.MaxChunkSize, chunk.DefaultSize)
+	}
+	if m.SlotFormat != forky.SlotFormatRaw {
+		t.Errorf("got slot format %v, want %v", m.SlotFormat, forky.SlotFormatRaw)
+	}
+	if m.UUID == "" {
+		t.Error("empty uuid")
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := forky.NewStore(path, chunk.DefaultSize, mem.NewMetaStore(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := s.Manifest(); got.UUID != m.UUID || !got.Created.Equal(m.Created) {
+		t.Errorf("got manifest %+v, want %+v", got, m)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name         string
+		maxChunkSize int
+		o            *forky.Options
+	}{
+		{
+			name:         "max chunk size",
+			maxChunkSize: 1024,
+		},
+		{
+			name:         "slot format",
+			maxChunkSize: chunk.DefaultSize,
+			o: &forky.Options{
+				SlotFormat: forky.SlotFormatHeader,
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := forky.NewStore(path, tc.maxChunkSize, mem.NewMetaStore(), tc.o)
+			if e, ok := err.(*forky.ManifestMismatchError); !ok {
+				t.Fatalf("got error %v, want manifest mismatch error", err)
+			} else if e.Field != tc.name {
+				t.Errorf("got mismatch field %q, want %q", e.Field, tc.name)
+			}
+		})
+	}
+}
+
+// TestManifestLegacyStore validates that the store with shard files and
+// without the manifest is migrated from the format version 0.
+func TestManifestLegacyStore(t *testing.T) {
+	s, path, clean := newTestStore(t, chunk.DefaultSize, nil)
+	defer clean()
+
+	if err := s.Put(test.GenerateTestRandomChunk()); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(path, "manifest.json")); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := forky.NewStore(path, chunk.DefaultSize, mem.NewMetaStore(), &forky.Options{
+		ShardCount: 16,
+	})
+	if e, ok := err.(*forky.ManifestMismatchError); !ok {
+		t.Fatalf("got error %v, want manifest mismatch error", err)
+	} else if e.Field != "shard count" {
+		t.Errorf("got mismatch field %q, want %q", e.Field, "shard count")
+	}
+
+	s, err = forky.NewStore(path, chunk.DefaultSize, mem.NewMetaStore(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	m := s.Manifest()
+	if m.Version != forky.FormatVersion {
+		t.Errorf("got version %v, want %v", m.Version, forky.FormatVersion)
+	}
+	if m.ShardCount != 32 {
+		t.Errorf("got shard count %v, want %v", m.ShardCount, 32)
+	}
+	if m.SlotFormat != forky.SlotFormatRaw {
+		t.Errorf("got slot format %v, want %v", m.SlotFormat, forky.SlotFormatRaw)
+	}
+	if m.UUID == "" {
+		t.Error("empty uuid")
+	}
+	got, err := forky.ReadManifest(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.UUID != m.UUID {
+		t.Errorf("got written manifest uuid %q, want %q", got.UUID, m.UUID)
+	}
+}
@@ -17,13 +17,21 @@
 package mem
 
 import (
+	"sort"
 	"sync"
 
 	"github.com/ethersphere/swarm/chunk"
 	"github.com/janos/forky"
 )
 
-var _ forky.MetaStore = new(MetaStore)
+var (
+	_ forky.MetaStore         = new(MetaStore)
+	_ forky.BatchMetaStore    = new(MetaStore)
+	_ forky.BatchGetMetaStore = new(MetaStore)
+	_ forky.GroupMetaStore    = new(MetaStore)
+	_ forky.BitmapMetaStore   = new(MetaStore)
+	_ forky.RangeMetaStore    = new(MetaStore)
+)
 
 type MetaStore struct {
 	meta map[string]*forky.Meta
@@ -33,8 +41,8 @@ type MetaStore struct {
 
 func NewMetaStore() (s *MetaStore) {
 	free := make(map[uint8]map[int64]struct{})
-	for shard := uint8(0); shard < 255; shard++ {
-		free[shard] = make(map[int64]struct{})
+	for shard := 0; shard <= 255; shard++ {
+		free[uint8(shard)] = make(map[int64]struct{})
 	}
 	return &MetaStore{
 		meta: make(map[string]*forky.Meta),
@@ -52,6 +60,16 @@ func (s *MetaStore) Get(addr chunk.Address) (m *forky.Meta, err error) {
 	return m, nil
 }
 
+func (s *MetaStore) GetBatch(addrs []chunk.Address) (metas []*forky.Meta, err error) {
+	metas = make([]*forky.Meta, len(addrs))
+	s.mu.RLock()
+	for i, addr := range addrs {
+		metas[i] = s.meta[string(addr)]
+	}
+	s.mu.RUnlock()
+	return metas, nil
+}
+
 func (s *MetaStore) Set(addr chunk.Address, shard uint8, reclaimed bool, m *forky.Meta) (err error) {
 	s.mu.Lock()
 	if reclaimed {
@@ -62,6 +80,57 @@ func (s *MetaStore) Set(addr chunk.Address, shard uint8, reclaimed bool, m *fork
 	return nil
 }
 
+func (s *MetaStore) SetBatch(entries []forky.MetaEntry) (err error) {
+	s.mu.Lock()
+	for _, e := range entries {
+		if e.Reclaimed {
+			delete(s.free[e.Shard], e.Meta.Offset)
+		}
+		s.meta[string(e.Address)] = e.Meta
+	}
+	s.mu.Unlock()
+	return nil
+}
+
+// WriteGroup applies all writes or none of them, if any of the removed
+// chunks is not found.
+func (s *MetaStore) WriteGroup(writes []forky.MetaWrite) (err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	exists := make(map[string]bool)
+	for _, w := range writes {
+		key := string(w.Address)
+		if !w.Remove {
+			exists[key] = true
+			continue
+		}
+		e, ok := exists[key]
+		if !ok {
+			e = s.meta[key] != nil
+		}
+		if !e {
+			return chunk.ErrChunkNotFound
+		}
+		exists[key] = false
+	}
+	for _, w := range writes {
+		key := string(w.Address)
+		if w.Remove {
+			if !w.NoFreeOffset {
+				s.free[w.Shard][s.meta[key].Offset] = struct{}{}
+			}
+			delete(s.meta, key)
+			continue
+		}
+		if w.Reclaimed {
+			delete(s.free[w.Shard], w.Meta.Offset)
+		}
+		s.meta[key] = w.Meta
+	}
+	return nil
+}
+
 func (s *MetaStore) Remove(addr chunk.Address, shard uint8) (err error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -75,6 +144,17 @@ func (s *MetaStore) Remove(addr chunk.Address, shard uint8) (err error) {
 	return nil
 }
 
+func (s *MetaStore) RemoveMeta(addr chunk.Address) (err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := string(addr)
+	if s.meta[key] == nil {
+		return chunk.ErrChunkNotFound
+	}
+	delete(s.meta, key)
+	return nil
+}
+
 func (s *MetaStore) FreeOffset(shard uint8) (offset int64, err error) {
 	s.mu.RLock()
 	for o := range s.free[shard] {
@@ -85,6 +165,42 @@ func (s *MetaStore) FreeOffset(shard uint8) (offset int64, err error) {
 	return -1, nil
 }
 
+func (s *MetaStore) SetFreeOffset(shard uint8, offset int64) (err error) {
+	s.mu.Lock()
+	s.free[shard][offset] = struct{}{}
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *MetaStore) RemoveFreeOffset(shard uint8, offset int64) (err error) {
+	s.mu.Lock()
+	delete(s.free[shard], offset)
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *MetaStore) IterateFreeOffsets(shard uint8, fn func(offset int64) (stop bool, err error)) (err error) {
+	s.mu.RLock()
+	offsets := make([]int64, 0, len(s.free[shard]))
+	for o := range s.free[shard] {
+		offsets = append(offsets, o)
+	}
+	s.mu.RUnlock()
+	sort.Slice(offsets, func(i, j int) bool {
+		return offsets[i] < offsets[j]
+	})
+	for _, o := range offsets {
+		stop, err := fn(o)
+		if err != nil {
+			return err
+		}
+		if stop {
+			return nil
+		}
+	}
+	return nil
+}
+
 func (s *MetaStore) Count() (count int, err error) {
 	s.mu.RLock()
 	count = len(s.meta)
@@ -107,6 +223,28 @@ func (s *MetaStore) Iterate(fn func(chunk.Address, *forky.Meta) (stop bool, err
 	return nil
 }
 
+func (s *MetaStore) IterateFrom(start chunk.Address, fn func(chunk.Address, *forky.Meta) (stop bool, err error)) (err error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var addrs []string
+	for a := range s.meta {
+		if a >= string(start) {
+			addrs = append(addrs, a)
+		}
+	}
+	sort.Strings(addrs)
+	for _, a := range addrs {
+		stop, err := fn(chunk.Address(a), s.meta[a])
+		if err != nil {
+			return err
+		}
+		if stop {
+			return nil
+		}
+	}
+	return nil
+}
+
 func (s *MetaStore) Close() (err error) {
 	return nil
 }
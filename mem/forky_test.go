@@ -31,11 +31,25 @@ func init() {
 
 func TestMemForky(t *testing.T) {
 	test.StoreSuite(t, func(t *testing.T) (forky.Interface, func()) {
-		path, err := ioutil.TempDir("", "swarm-forky-")
-		if err != nil {
-			t.Fatal(err)
-		}
+		return newForkyStore(t)
+	})
+}
+
+func TestMemRangeMetaStore(t *testing.T) {
+	test.RangeMetaStoreSuite(t, mem.NewMetaStore())
+}
 
-		return test.NewForkyStore(t, path, mem.NewMetaStore())
+func BenchmarkMemForky(b *testing.B) {
+	test.StoreBenchmarkSuite(b, func(b *testing.B) (forky.Interface, func()) {
+		return newForkyStore(b)
 	})
 }
+
+func newForkyStore(t testing.TB) (s *forky.Store, clean func()) {
+	path, err := ioutil.TempDir("", "swarm-forky-")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return test.NewForkyStore(t, path, mem.NewMetaStore())
+}
@@ -16,36 +16,59 @@
 
 package forky
 
-import (
-	"sync"
+import "github.com/ethersphere/swarm/chunk"
 
-	"github.com/ethersphere/swarm/chunk"
-)
+// DefaultMetaCacheSize is the default memory budget of the chunk meta cache.
+const DefaultMetaCacheSize = 64 << 20
 
+// metaCacheEntryOverhead is the approximate memory used by a single cache
+// entry in addition to its address: the index map entry, the entry in the
+// ring and the referenced Meta.
+const metaCacheEntryOverhead = 112
+
+// metaCache keeps chunk meta within a memory budget.
 type metaCache struct {
-	t  metaTrie
-	mu sync.RWMutex
+	*clockCache
+}
+
+func newMetaCache(maxSize int64) (c *metaCache) {
+	return &metaCache{
+		clockCache: newClockCache(maxSize, nil),
+	}
 }
 
-func newMetaCache() (c *metaCache) {
-	return new(metaCache)
+func metaCacheEntrySize(addr string) (size int64) {
+	return int64(len(addr)) + metaCacheEntryOverhead
 }
 
 func (c *metaCache) get(addr chunk.Address) (m *Meta) {
-	c.mu.RLock()
-	m = c.t.get(addr)
-	c.mu.RUnlock()
-	return m
+	v, ok := c.clockCache.get(string(addr))
+	c.record(ok)
+	if !ok {
+		return nil
+	}
+	return v.(*Meta)
 }
 
 func (c *metaCache) set(addr chunk.Address, m *Meta) {
-	c.mu.Lock()
-	c.t.set(addr, m)
-	c.mu.Unlock()
+	key := string(addr)
+	c.clockCache.set(key, m, metaCacheEntrySize(key))
+}
+
+func (c *metaCache) add(addr chunk.Address, m *Meta) (full bool) {
+	key := string(addr)
+	return c.clockCache.add(key, m, metaCacheEntrySize(key))
 }
 
 func (c *metaCache) remove(addr chunk.Address) {
-	c.mu.Lock()
-	c.t.remove(addr)
-	c.mu.Unlock()
+	c.clockCache.remove(string(addr))
+}
+
+// MetaCacheStats returns counters of the chunk meta cache. They are all
+// zero if the cache is disabled.
+func (s *Store) MetaCacheStats() (stats CacheStats) {
+	if s.metaCache == nil {
+		return stats
+	}
+	return s.metaCache.stats()
 }
@@ -0,0 +1,134 @@
+// Copyright 2019 The Swarm Authors
+// This file is part of the Swarm library.
+//
+// The Swarm library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The Swarm library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the Swarm library. If not, see <http://www.gnu.org/licenses/>.
+
+package forky
+
+import (
+	"math/rand"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ethersphere/swarm/chunk"
+)
+
+func init() {
+	rand.Seed(time.Now().UnixNano())
+}
+
+func TestMetaCache(t *testing.T) {
+	c := newMetaCache(DefaultMetaCacheSize)
+
+	addrs := []chunk.Address{
+		generateRandomAddress(32),
+		generateRandomAddress(64),
+		generateRandomAddress(17),
+	}
+	for i, addr := range addrs {
+		c.set(addr, &Meta{
+			Offset: int64(i) * 4096,
+			Size:   uint16(i),
+		})
+	}
+	for i, addr := range addrs {
+		want := &Meta{
+			Offset: int64(i) * 4096,
+			Size:   uint16(i),
+		}
+		if got := c.get(addr); !reflect.DeepEqual(got, want) {
+			t.Errorf("got meta %v %s, want %s", i, got, want)
+		}
+	}
+
+	c.remove(addrs[1])
+	if got := c.get(addrs[1]); got != nil {
+		t.Errorf("got meta %s for removed address, expected <nil>", got)
+	}
+
+	stats := c.stats()
+	if stats.Hits != 3 {
+		t.Errorf("got hits %v, want %v", stats.Hits, 3)
+	}
+	if stats.Misses != 1 {
+		t.Errorf("got misses %v, want %v", stats.Misses, 1)
+	}
+	if stats.Entries != 2 {
+		t.Errorf("got entries %v, want %v", stats.Entries, 2)
+	}
+	wantSize := metaCacheEntrySize(string(addrs[0])) + metaCacheEntrySize(string(addrs[2]))
+	if stats.Size != wantSize {
+		t.Errorf("got size %v, want %v", stats.Size, wantSize)
+	}
+}
+
+func TestMetaCacheEviction(t *testing.T) {
+	const capacity = 10
+
+	c := newMetaCache(capacity * metaCacheEntrySize(string(generateRandomAddress(32))))
+
+	addrs := make([]chunk.Address, 2*capacity)
+	for i := range addrs {
+		addrs[i] = generateRandomAddress(32)
+	}
+	for _, addr := range addrs[:capacity] {
+		c.set(addr, new(Meta))
+	}
+	// referenced entry should survive the next eviction
+	if c.get(addrs[0]) == nil {
+		t.Fatal("entry not found")
+	}
+	c.set(addrs[capacity], new(Meta))
+
+	if c.get(addrs[0]) == nil {
+		t.Error("referenced entry is evicted")
+	}
+	if c.get(addrs[1]) != nil {
+		t.Error("unreferenced entry is not evicted")
+	}
+
+	for _, addr := range addrs[capacity+1:] {
+		c.set(addr, new(Meta))
+	}
+	stats := c.stats()
+	if stats.Entries != capacity {
+		t.Errorf("got entries %v, want %v", stats.Entries, capacity)
+	}
+	if stats.Evictions != capacity {
+		t.Errorf("got evictions %v, want %v", stats.Evictions, capacity)
+	}
+	if stats.Size > c.maxSize {
+		t.Errorf("got size %v larger than %v", stats.Size, c.maxSize)
+	}
+	// the clock hand skips the entry referenced again and evicts
+	// the next one
+	if c.get(addrs[0]) == nil {
+		t.Error("referenced entry is evicted")
+	}
+	if c.get(addrs[capacity]) != nil {
+		t.Error("unreferenced entry is not evicted")
+	}
+	for i, addr := range addrs[capacity+1:] {
+		if c.get(addr) == nil {
+			t.Errorf("latest entry %v is evicted", i)
+		}
+	}
+}
+
+func generateRandomAddress(size int) (addr chunk.Address) {
+	addr = make([]byte, size)
+	rand.Read(addr)
+	return addr
+}
@@ -0,0 +1,118 @@
+// Copyright 2019 The Swarm Authors
+// This file is part of the Swarm library.
+//
+// The Swarm library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The Swarm library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the Swarm library. If not, see <http://www.gnu.org/licenses/>.
+
+package forky
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+// mmapMinSize is the minimal length of the shard file mapping.
+const mmapMinSize = 1 << 20
+
+// mmapReader reads data of a shard file from its memory mapping. The mapping
+// is longer than the file, so that it is replaced only when data beyond it
+// is read, which happens after the file has grown. Only data of stored
+// chunks is read, so pages beyond the end of the file are never accessed.
+type mmapReader struct {
+	f    *os.File
+	data []byte
+	// old mappings are kept until close if views of them are returned
+	old  [][]byte
+	keep bool
+	mu   sync.RWMutex
+}
+
+func newMmapReader(f *os.File, keep bool) (r *mmapReader) {
+	return &mmapReader{
+		f:    f,
+		keep: keep,
+	}
+}
+
+// read returns size bytes at offset. If view is true, the returned data
+// references the mapping instead of being copied.
+func (r *mmapReader) read(offset int64, size int, view bool) (data []byte, err error) {
+	end := offset + int64(size)
+	for {
+		r.mu.RLock()
+		if end <= int64(len(r.data)) {
+			data = r.data[offset:end:end]
+			if !view {
+				data = append([]byte(nil), data...)
+			}
+			r.mu.RUnlock()
+			return data, nil
+		}
+		r.mu.RUnlock()
+
+		if err := r.remap(end); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (r *mmapReader) remap(length int64) (err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if length <= int64(len(r.data)) {
+		return nil
+	}
+	fi, err := r.f.Stat()
+	if err != nil {
+		return err
+	}
+	if fi.Size() < length {
+		return fmt.Errorf("incomplete chunk data, file size %v is less than %v", fi.Size(), length)
+	}
+	size := 2 * fi.Size()
+	if size < mmapMinSize {
+		size = mmapMinSize
+	}
+	data, err := mmap(r.f, int(size))
+	if err != nil {
+		return err
+	}
+	if r.data != nil {
+		if r.keep {
+			r.old = append(r.old, r.data)
+		} else if err := munmap(r.data); err != nil {
+			return err
+		}
+	}
+	r.data = data
+	return nil
+}
+
+func (r *mmapReader) close() (err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, data := range append(r.old, r.data) {
+		if data == nil {
+			continue
+		}
+		if err := munmap(data); err != nil {
+			return err
+		}
+	}
+	r.data = nil
+	r.old = nil
+	return nil
+}
@@ -0,0 +1,137 @@
+// Copyright 2019 The Swarm Authors
+// This file is part of the Swarm library.
+//
+// The Swarm library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The Swarm library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the Swarm library. If not, see <http://www.gnu.org/licenses/>.
+
+package forky_test
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"testing"
+
+	"github.com/ethersphere/swarm/chunk"
+	"github.com/janos/forky"
+	"github.com/janos/forky/mem"
+	"github.com/janos/forky/test"
+)
+
+func TestStoreMmap(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("mmap is supported only on linux")
+	}
+	for _, view := range []bool{false, true} {
+		name := "copy"
+		if view {
+			name = "view"
+		}
+		t.Run(name, func(t *testing.T) {
+			s, _, clean := newTestStore(t, chunk.DefaultSize, &forky.Options{
+				ShardCount: 1,
+				Mmap:       true,
+				MmapView:   view,
+			})
+			defer clean()
+
+			chunks := make([]chunk.Chunk, 300)
+			for i := range chunks {
+				chunks[i] = test.GenerateTestRandomChunk()
+			}
+			put := func(chunks []chunk.Chunk) {
+				t.Helper()
+
+				for _, ch := range chunks {
+					if err := s.Put(ch); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+			get := func(chunks []chunk.Chunk) {
+				t.Helper()
+
+				for _, ch := range chunks {
+					got, err := s.Get(ch.Address())
+					if err != nil {
+						t.Fatal(err)
+					}
+					if !bytes.Equal(got.Data(), ch.Data()) {
+						t.Fatalf("got chunk %s data %x, want %x", ch.Address(), got.Data(), ch.Data())
+					}
+				}
+			}
+
+			put(chunks[:10])
+			get(chunks[:10])
+			// the file grows beyond the first mapping
+			put(chunks[10:])
+			get(chunks)
+
+			// deleted slots are reused by new chunks
+			for _, ch := range chunks[:10] {
+				if err := s.Delete(ch.Address()); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for i := 0; i < 10; i++ {
+				chunks[i] = test.GenerateTestRandomChunk()
+			}
+			put(chunks[:10])
+			get(chunks)
+
+			for _, ch := range chunks[150:] {
+				if err := s.Delete(ch.Address()); err != nil {
+					t.Fatal(err)
+				}
+			}
+			chunks = chunks[:150]
+			_, err := s.Compact(context.Background(), nil)
+			if view {
+				if err == nil {
+					t.Fatal("got no compaction error with mmap views")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			get(chunks)
+			// the truncated file grows again
+			more := make([]chunk.Chunk, 100)
+			for i := range more {
+				more[i] = test.GenerateTestRandomChunk()
+			}
+			put(more)
+			get(more)
+			get(chunks)
+		})
+	}
+
+	t.Run("view without mmap", func(t *testing.T) {
+		path, err := ioutil.TempDir("", "swarm-forky-")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(path)
+
+		_, err = forky.NewStore(path, chunk.DefaultSize, mem.NewMetaStore(), &forky.Options{
+			MmapView: true,
+		})
+		if err == nil {
+			t.Error("got no error for mmap view without mmap")
+		}
+	})
+}
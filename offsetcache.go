@@ -18,39 +18,57 @@ package forky
 
 import "sync"
 
+// DefaultFreeCacheSize is the default maximal number of cached free offsets.
+const DefaultFreeCacheSize = 1 << 16
+
+// offsetCache keeps up to maxCount free offsets of all bins. Offsets that
+// do not fit are not cached, as they are still found in MetaStore.
 type offsetCache struct {
-	m  map[uint8]map[int64]struct{}
-	mu sync.RWMutex
+	m        map[uint8]map[int64]struct{}
+	count    int
+	maxCount int
+	mu       sync.RWMutex
 }
 
-func newOffsetCache(shardCount uint8) (c *offsetCache) {
+func newOffsetCache(shardCount, maxCount int) (c *offsetCache) {
 	m := make(map[uint8]map[int64]struct{})
-	for i := uint8(0); i < shardCount; i++ {
-		m[i] = make(map[int64]struct{})
+	for i := 0; i < shardCount; i++ {
+		m[uint8(i)] = make(map[int64]struct{})
 	}
 	return &offsetCache{
-		m: m,
+		m:        m,
+		maxCount: maxCount,
 	}
 }
 
-func (c *offsetCache) get(shard uint8) (offset int64) {
-	c.mu.RLock()
+func (c *offsetCache) pop(shard uint8) (offset int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
 	for o := range c.m[shard] {
-		c.mu.RUnlock()
+		delete(c.m[shard], o)
+		c.count--
 		return o
 	}
-	c.mu.RUnlock()
 	return -1
 }
 
 func (c *offsetCache) set(shard uint8, offset int64) {
 	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.m[shard][offset]; ok || c.count >= c.maxCount {
+		return
+	}
 	c.m[shard][offset] = struct{}{}
-	c.mu.Unlock()
+	c.count++
 }
 
 func (c *offsetCache) remove(shard uint8, offset int64) {
 	c.mu.Lock()
-	delete(c.m[shard], offset)
+	if _, ok := c.m[shard][offset]; ok {
+		delete(c.m[shard], offset)
+		c.count--
+	}
 	c.mu.Unlock()
 }
@@ -0,0 +1,116 @@
+// Copyright 2019 The Swarm Authors
+// This file is part of the Swarm library.
+//
+// The Swarm library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The Swarm library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the Swarm library. If not, see <http://www.gnu.org/licenses/>.
+
+package forky
+
+import (
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// ErrDiskFull is returned by Put and PutMulti if shard files are preallocated
+// and there is not enough disk space for a new extent.
+var ErrDiskFull = errors.New("disk full")
+
+// endsFilename is the name of the file with data ends of preallocated shard
+// files.
+const endsFilename = "ends.db"
+
+// dataEnds records the offset after the last reserved slot of every bin, as
+// sizes of preallocated shard files include slots that are not yet used.
+// Ends are stored as 8 byte values at offsets of their bins.
+type dataEnds struct {
+	f    *os.File
+	ends []int64
+}
+
+func openDataEnds(path string) (e *dataEnds, err error) {
+	f, err := os.OpenFile(filepath.Join(path, endsFilename), os.O_CREATE|os.O_RDWR, 0666)
+	if err != nil {
+		return nil, err
+	}
+	ends, err := readDataEndsFile(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &dataEnds{
+		f:    f,
+		ends: ends,
+	}, nil
+}
+
+func readDataEnds(path string, binCount int) (ends []int64, err error) {
+	f, err := os.Open(filepath.Join(path, endsFilename))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	recorded, err := readDataEndsFile(f)
+	if err != nil {
+		return nil, err
+	}
+	ends = make([]int64, binCount)
+	for i := range ends {
+		ends[i] = -1
+		if i < len(recorded) {
+			ends[i] = recorded[i]
+		}
+	}
+	return ends, nil
+}
+
+func readDataEndsFile(f *os.File) (ends []int64, err error) {
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i+8 <= len(data); i += 8 {
+		ends = append(ends, int64(binary.BigEndian.Uint64(data[i:i+8])))
+	}
+	return ends, nil
+}
+
+func (e *dataEnds) get(bin uint8) (end int64, ok bool) {
+	if int(bin) >= len(e.ends) {
+		return 0, false
+	}
+	return e.ends[bin], true
+}
+
+// set records the data end of the bin. Different bins can be set
+// concurrently.
+func (e *dataEnds) set(bin uint8, end int64) (err error) {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(end))
+	_, err = e.f.WriteAt(b, int64(bin)*8)
+	return err
+}
+
+func (e *dataEnds) sync() (err error) {
+	return e.f.Sync()
+}
+
+func (e *dataEnds) close() (err error) {
+	return e.f.Close()
+}
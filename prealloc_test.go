@@ -0,0 +1,142 @@
+// Copyright 2019 The Swarm Authors
+// This file is part of the Swarm library.
+//
+// The Swarm library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The Swarm library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the Swarm library. If not, see <http://www.gnu.org/licenses/>.
+
+package forky_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/ethersphere/swarm/chunk"
+	"github.com/janos/forky"
+	"github.com/janos/forky/mem"
+	"github.com/janos/forky/test"
+)
+
+func TestStorePreallocate(t *testing.T) {
+	path, err := ioutil.TempDir("", "swarm-forky-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(path)
+
+	const extent = 1 << 20
+	o := &forky.Options{
+		ShardCount:      1,
+		SlotFormat:      forky.SlotFormatHeader,
+		PreallocateSize: extent,
+	}
+	metaStore := mem.NewMetaStore()
+	s, err := forky.NewStore(path, chunk.DefaultSize, metaStore, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	shardFileSize := func() int64 {
+		t.Helper()
+
+		fi, err := os.Stat(filepath.Join(path, "chunks-0.db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fi.Size()
+	}
+
+	chunks := make([]chunk.Chunk, 10)
+	for i := range chunks {
+		chunks[i] = test.GenerateTestRandomChunk()
+		if err := s.Put(chunks[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if size := shardFileSize(); size != extent {
+		t.Errorf("got shard file size %v, want %v", size, extent)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// data end is used without preallocation
+	s, err = forky.NewStore(path, chunk.DefaultSize, metaStore, &forky.Options{
+		ShardCount: 1,
+		SlotFormat: forky.SlotFormatHeader,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		ch := test.GenerateTestRandomChunk()
+		if err := s.Put(ch); err != nil {
+			t.Fatal(err)
+		}
+		chunks = append(chunks, ch)
+	}
+	for _, ch := range chunks {
+		got, err := s.Get(ch.Address())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got.Data(), ch.Data()) {
+			t.Fatalf("got chunk %s data %x, want %x", ch.Address(), got.Data(), ch.Data())
+		}
+	}
+	if size := shardFileSize(); size != extent {
+		t.Errorf("got shard file size %v, want %v", size, extent)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := forky.Check(path, chunk.DefaultSize, metaStore, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Problems) != 0 || r.Chunks != len(chunks) || r.FreeSlots != 0 {
+		t.Errorf("got check report %+v", r)
+	}
+	rr, err := forky.RebuildMetaStore(path, chunk.DefaultSize, mem.NewMetaStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rr.Chunks != len(chunks) || rr.FreeSlots != 0 {
+		t.Errorf("got rebuild report %+v", rr)
+	}
+
+	if runtime.GOOS != "linux" {
+		return
+	}
+	// disk space for a too large extent can not be allocated
+	s, path, clean := newTestStore(t, chunk.DefaultSize, &forky.Options{
+		PreallocateSize: 1 << 50,
+	})
+	defer clean()
+
+	ch := test.GenerateTestRandomChunk()
+	if err := s.Put(ch); err == nil {
+		t.Error("got no error for too large preallocation")
+	}
+	if has, err := s.Has(ch.Address()); err != nil || has {
+		t.Errorf("got has %v with error %v, want false", has, err)
+	}
+	if size := shardFileSize(); size != 0 {
+		t.Errorf("got shard file size %v, want 0", size)
+	}
+}
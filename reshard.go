@@ -0,0 +1,458 @@
+// Copyright 2019 The Swarm Authors
+// This file is part of the Swarm library.
+//
+// The Swarm library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The Swarm library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the Swarm library. If not, see <http://www.gnu.org/licenses/>.
+
+package forky
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/ethersphere/swarm/chunk"
+)
+
+// ErrReshardInProgress is returned by NewStore if the store directory
+// contains an unfinished Reshard operation.
+var ErrReshardInProgress = errors.New("reshard in progress")
+
+const (
+	reshardDirname    = "reshard"
+	reshardOldDirname = "reshard-old"
+	reshardIndexName  = "index"
+	reshardStateName  = "state"
+)
+
+// Reshard phases are recorded in the state file in the reshard directory.
+const (
+	reshardPhaseCopy    = "copy"
+	reshardPhaseMeta    = "meta"
+	reshardPhaseSwapOld = "swap-old"
+	reshardPhaseSwapNew = "swap-new"
+	reshardPhaseDone    = "done"
+)
+
+// ReshardOptions defines the target shard layout for the Reshard function.
+type ReshardOptions struct {
+	ShardCount int
+	ShardFunc  ShardFunc
+	// Progress, if not nil, is called after every copied chunk with
+	// the number of copied chunks and the total number of chunks.
+	Progress func(done, total int)
+}
+
+// Reshard changes the number of shard files and the shard function of
+// a closed store. Every chunk referenced by MetaStore is copied into a new
+// set of shard files in the reshard subdirectory of the store, MetaStore
+// entries are updated with new offsets, free offsets are removed, as new
+// shard files have no free slots, and new shard files replace the old ones.
+// Progress is recorded in the reshard directory, so that Reshard can be
+// called again with the same options to resume after an interruption. Until
+// Reshard completes, NewStore returns ErrReshardInProgress.
+func Reshard(path string, metaStore MetaStore, o *ReshardOptions) (err error) {
+	dir := filepath.Join(path, reshardDirname)
+	state, err := readReshardState(dir)
+	if err != nil {
+		return err
+	}
+	if state == "" {
+		if err := startReshard(path, o); err != nil {
+			return err
+		}
+		state = reshardPhaseCopy
+	}
+
+	// the current manifest is moved to the reshard-old directory on swap
+	current, err := ReadManifest(path)
+	if os.IsNotExist(err) && state != reshardPhaseCopy {
+		current, err = ReadManifest(filepath.Join(path, reshardOldDirname))
+	}
+	if err != nil && state != reshardPhaseDone {
+		return err
+	}
+	target, err := ReadManifest(dir)
+	if err != nil {
+		return err
+	}
+	if err := target.validate(&Manifest{
+		ShardCount:    o.ShardCount,
+		ShardFunc:     o.ShardFunc,
+		MaxChunkSize:  target.MaxChunkSize,
+		SlotFormat:    target.SlotFormat,
+		SlotSize:      target.SlotSize,
+		SizeClasses:   target.SizeClasses,
+		SlotAlignment: target.SlotAlignment,
+	}); err != nil {
+		return fmt.Errorf("resume reshard: %v", err)
+	}
+
+	for {
+		switch state {
+		case reshardPhaseCopy:
+			err = reshardCopy(path, metaStore, current, target, o.Progress)
+			state = reshardPhaseMeta
+		case reshardPhaseMeta:
+			err = reshardMeta(dir, metaStore, current, target)
+			state = reshardPhaseSwapOld
+		case reshardPhaseSwapOld:
+			err = reshardSwapOld(path, current)
+			state = reshardPhaseSwapNew
+		case reshardPhaseSwapNew:
+			err = reshardSwapNew(path, target)
+			state = reshardPhaseDone
+		case reshardPhaseDone:
+			if err := os.RemoveAll(filepath.Join(path, reshardOldDirname)); err != nil {
+				return err
+			}
+			return os.RemoveAll(dir)
+		default:
+			return fmt.Errorf("unknown reshard state %q", state)
+		}
+		if err != nil {
+			return err
+		}
+		if err := writeReshardState(dir, state); err != nil {
+			return err
+		}
+	}
+}
+
+func startReshard(path string, o *ReshardOptions) (err error) {
+	m, err := ReadManifest(path)
+	if err != nil {
+		return err
+	}
+	if f, err := os.Open(filepath.Join(path, journalFilename)); err == nil {
+		pending, err := readJournal(f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+		if len(pending) > 0 {
+			return errors.New("store journal has pending intents, open the store to recover them")
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	target, err := newManifest(m.MaxChunkSize, &Options{
+		ShardCount:    o.ShardCount,
+		ShardFunc:     o.ShardFunc,
+		SlotFormat:    m.SlotFormat,
+		SizeClasses:   m.SizeClasses,
+		SlotAlignment: m.SlotAlignment,
+	})
+	if err != nil {
+		return err
+	}
+	target.Created = m.Created
+	target.UUID = m.UUID
+
+	dir := filepath.Join(path, reshardDirname)
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	if err := os.Mkdir(dir, 0777); err != nil {
+		return err
+	}
+	if err := syncDir(path); err != nil {
+		return err
+	}
+	if err := writeManifest(dir, target); err != nil {
+		return err
+	}
+	return writeReshardState(dir, reshardPhaseCopy)
+}
+
+func reshardCopy(path string, metaStore MetaStore, current, target *Manifest, progress func(done, total int)) (err error) {
+	dir := filepath.Join(path, reshardDirname)
+	cl, err := current.layout()
+	if err != nil {
+		return err
+	}
+	tl, err := target.layout()
+	if err != nil {
+		return err
+	}
+
+	index, err := os.OpenFile(filepath.Join(dir, reshardIndexName), os.O_CREATE|os.O_RDWR, 0666)
+	if err != nil {
+		return err
+	}
+	defer index.Close()
+
+	// load already copied chunks
+	copied := make(map[string]struct{})
+	ends := make([]int64, tl.binCount())
+	r := bufio.NewReader(index)
+	var indexSize int64
+	for {
+		rec, err := readJournalRecord(r)
+		if err != nil {
+			if err == io.EOF || err == errJournalRecord {
+				break
+			}
+			return err
+		}
+		data, err := rec.MarshalBinary()
+		if err != nil {
+			return err
+		}
+		indexSize += int64(len(data))
+		copied[string(rec.addr)] = struct{}{}
+		if end := rec.meta.Offset + tl.slotSize(rec.shard); end > ends[rec.shard] {
+			ends[rec.shard] = end
+		}
+	}
+	// remove a possibly incomplete record and slots that are not in the index
+	if err := index.Truncate(indexSize); err != nil {
+		return err
+	}
+	if _, err := index.Seek(indexSize, io.SeekStart); err != nil {
+		return err
+	}
+	w := bufio.NewWriter(index)
+
+	oldShards := make([]*os.File, cl.binCount())
+	newShards := make([]*os.File, tl.binCount())
+	defer func() {
+		for _, f := range append(oldShards, newShards...) {
+			if f != nil {
+				f.Close()
+			}
+		}
+	}()
+	for i := range oldShards {
+		oldShards[i], err = os.Open(filepath.Join(path, cl.filename(uint8(i))))
+		if err != nil {
+			return err
+		}
+	}
+	for i := range newShards {
+		newShards[i], err = os.OpenFile(filepath.Join(dir, tl.filename(uint8(i))), os.O_CREATE|os.O_RDWR, 0666)
+		if err != nil {
+			return err
+		}
+		if err := newShards[i].Truncate(ends[i]); err != nil {
+			return err
+		}
+	}
+
+	total, err := metaStore.Count()
+	if err != nil {
+		return err
+	}
+	done := len(copied)
+	err = metaStore.Iterate(func(addr chunk.Address, m *Meta) (stop bool, err error) {
+		if _, ok := copied[string(addr)]; ok {
+			return false, nil
+		}
+		oldBin := cl.bin(current.ShardFunc.shard(addr, cl.shardCount), int(m.Size))
+		slot := make([]byte, cl.slotSize(oldBin))
+		n, err := oldShards[oldBin].ReadAt(slot, m.Offset)
+		if err != nil && !(err == io.EOF && int64(n) >= cl.slotFormat.headerSize()+int64(m.Size)) {
+			return true, fmt.Errorf("read chunk %s: %v", addr.Hex(), err)
+		}
+		bin := tl.bin(target.ShardFunc.shard(addr, tl.shardCount), int(m.Size))
+		if _, err := newShards[bin].WriteAt(slot, ends[bin]); err != nil {
+			return true, err
+		}
+		rec := &journalRecord{
+			typ:   journalPut,
+			shard: bin,
+			meta: Meta{
+				Size:       m.Size,
+				Offset:     ends[bin],
+				Checksum:   m.Checksum,
+				noChecksum: m.noChecksum,
+			},
+			addr: addr,
+		}
+		data, err := rec.MarshalBinary()
+		if err != nil {
+			return true, err
+		}
+		if _, err := w.Write(data); err != nil {
+			return true, err
+		}
+		ends[bin] += tl.slotSize(bin)
+		done++
+		if progress != nil {
+			progress(done, total)
+		}
+		return false, nil
+	})
+	// flush the index also on error to keep copied chunks for resume
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	for _, f := range append(newShards, index) {
+		if err := f.Sync(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reshardMeta sets chunk meta from the index file to MetaStore and removes
+// all free offsets. It can be safely repeated.
+func reshardMeta(dir string, metaStore MetaStore, current, target *Manifest) (err error) {
+	index, err := os.Open(filepath.Join(dir, reshardIndexName))
+	if err != nil {
+		return err
+	}
+	defer index.Close()
+
+	r := bufio.NewReader(index)
+	for {
+		rec, err := readJournalRecord(r)
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return err
+		}
+		if err := metaStore.Set(rec.addr, rec.shard, false, &rec.meta); err != nil {
+			return err
+		}
+	}
+
+	cl, err := current.layout()
+	if err != nil {
+		return err
+	}
+	tl, err := target.layout()
+	if err != nil {
+		return err
+	}
+	bins := tl.binCount()
+	if cl.binCount() > bins {
+		bins = cl.binCount()
+	}
+	for bin := 0; bin < bins; bin++ {
+		var offsets []int64
+		if err := metaStore.IterateFreeOffsets(uint8(bin), func(offset int64) (stop bool, err error) {
+			offsets = append(offsets, offset)
+			return false, nil
+		}); err != nil {
+			return err
+		}
+		for _, offset := range offsets {
+			if err := metaStore.RemoveFreeOffset(uint8(bin), offset); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func reshardSwapOld(path string, current *Manifest) (err error) {
+	old := filepath.Join(path, reshardOldDirname)
+	if err := os.MkdirAll(old, 0777); err != nil {
+		return err
+	}
+	l, err := current.layout()
+	if err != nil {
+		return err
+	}
+	// new shard files are not preallocated and have no free slots, so data
+	// ends and free bitmaps are moved together with the old ones
+	names := []string{manifestFilename, endsFilename, freeBitmapFilename}
+	for i := 0; i < l.binCount(); i++ {
+		names = append(names, l.filename(uint8(i)))
+	}
+	return moveFiles(path, old, names)
+}
+
+func reshardSwapNew(path string, target *Manifest) (err error) {
+	l, err := target.layout()
+	if err != nil {
+		return err
+	}
+	var names []string
+	for i := 0; i < l.binCount(); i++ {
+		names = append(names, l.filename(uint8(i)))
+	}
+	names = append(names, manifestFilename)
+	return moveFiles(filepath.Join(path, reshardDirname), path, names)
+}
+
+// moveFiles renames files from one directory to another, skipping the ones
+// that do not exist in the source directory, as they are already moved.
+// Both directories are synced, so that the renames are durable before the
+// next phase is recorded.
+func moveFiles(from, to string, names []string) (err error) {
+	for _, name := range names {
+		if err := os.Rename(filepath.Join(from, name), filepath.Join(to, name)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := syncDir(from); err != nil {
+		return err
+	}
+	return syncDir(to)
+}
+
+func syncDir(dir string) (err error) {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func readReshardState(dir string) (state string, err error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, reshardStateName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return "", err
+	}
+	return string(data), nil
+}
+
+func writeReshardState(dir, state string) (err error) {
+	filename := filepath.Join(dir, reshardStateName)
+	f, err := os.Create(filename + ".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteString(state); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(filename+".tmp", filename); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
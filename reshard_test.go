@@ -0,0 +1,165 @@
+// Copyright 2019 The Swarm Authors
+// This file is part of the Swarm library.
+//
+// The Swarm library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The Swarm library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the Swarm library. If not, see <http://www.gnu.org/licenses/>.
+
+package forky_test
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ethersphere/swarm/chunk"
+	"github.com/janos/forky"
+	"github.com/janos/forky/mem"
+	"github.com/janos/forky/test"
+)
+
+func TestReshard(t *testing.T) {
+	path, err := ioutil.TempDir("", "swarm-forky-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(path)
+
+	metaStore := mem.NewMetaStore()
+	s, err := forky.NewStore(path, chunk.DefaultSize, metaStore, &forky.Options{
+		SlotFormat: forky.SlotFormatHeader,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	chunks := make([]chunk.Chunk, 100)
+	for i := range chunks {
+		chunks[i] = test.GenerateTestRandomChunk()
+		if err := s.Put(chunks[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	deleted := chunks[:20]
+	chunks = chunks[20:]
+	for _, ch := range deleted {
+		if err := s.Delete(ch.Address()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	o := &forky.ReshardOptions{
+		ShardCount: 5,
+		ShardFunc:  forky.ShardHash,
+	}
+
+	// interrupt the first reshard in the middle of copying
+	errInterrupted := errors.New("interrupted")
+	err = forky.Reshard(path, &interruptingMetaStore{MetaStore: metaStore, limit: 30, err: errInterrupted}, o)
+	if err != errInterrupted {
+		t.Fatalf("got error %v, want %v", err, errInterrupted)
+	}
+	if _, err := forky.NewStore(path, chunk.DefaultSize, metaStore, nil); err != forky.ErrReshardInProgress {
+		t.Fatalf("got error %v, want %v", err, forky.ErrReshardInProgress)
+	}
+
+	var progress int
+	o.Progress = func(done, total int) {
+		if total != len(chunks) {
+			t.Errorf("got total %v, want %v", total, len(chunks))
+		}
+		if progress == 0 && done <= 1 {
+			t.Errorf("reshard did not resume, got done %v", done)
+		}
+		progress = done
+	}
+	if err := forky.Reshard(path, metaStore, o); err != nil {
+		t.Fatal(err)
+	}
+	if progress != len(chunks) {
+		t.Errorf("got progress %v, want %v", progress, len(chunks))
+	}
+
+	files, err := filepath.Glob(filepath.Join(path, "chunks-*.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 5 {
+		t.Errorf("got %v shard files, want 5", len(files))
+	}
+	for _, dir := range []string{"reshard", "reshard-old"} {
+		if _, err := os.Stat(filepath.Join(path, dir)); !os.IsNotExist(err) {
+			t.Errorf("directory %s not removed: %v", dir, err)
+		}
+	}
+
+	r, err := forky.Check(path, chunk.DefaultSize, metaStore, &forky.Options{
+		ShardCount: 5,
+		ShardFunc:  forky.ShardHash,
+		SlotFormat: forky.SlotFormatHeader,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Problems) != 0 || r.FreeSlots != 0 || r.Chunks != len(chunks) {
+		t.Errorf("got check report %+v", r)
+	}
+
+	s, err = forky.NewStore(path, chunk.DefaultSize, metaStore, &forky.Options{
+		ShardCount: 5,
+		ShardFunc:  forky.ShardHash,
+		SlotFormat: forky.SlotFormatHeader,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	for _, ch := range chunks {
+		got, err := s.Get(ch.Address())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got.Data(), ch.Data()) {
+			t.Fatalf("got chunk %s data %x, want %x", ch.Address(), got.Data(), ch.Data())
+		}
+	}
+	for _, ch := range deleted {
+		if _, err := s.Get(ch.Address()); err != chunk.ErrChunkNotFound {
+			t.Errorf("got error %v, want %v", err, chunk.ErrChunkNotFound)
+		}
+	}
+}
+
+// interruptingMetaStore returns an error from Iterate after
+// the limit number of iterated chunks.
+type interruptingMetaStore struct {
+	forky.MetaStore
+	limit int
+	err   error
+}
+
+func (s *interruptingMetaStore) Iterate(fn func(chunk.Address, *forky.Meta) (stop bool, err error)) error {
+	var count int
+	return s.MetaStore.Iterate(func(addr chunk.Address, m *forky.Meta) (stop bool, err error) {
+		if count >= s.limit {
+			return true, s.err
+		}
+		count++
+		return fn(addr, m)
+	})
+}
@@ -0,0 +1,148 @@
+// Copyright 2019 The Swarm Authors
+// This file is part of the Swarm library.
+//
+// The Swarm library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The Swarm library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the Swarm library. If not, see <http://www.gnu.org/licenses/>.
+
+package forky
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+
+	"github.com/ethersphere/swarm/chunk"
+	"golang.org/x/sync/semaphore"
+)
+
+// DefaultShardCount is the number of shard files used if it is not
+// specified in Options.
+const DefaultShardCount = 32
+
+// MaxShardCount is the maximal number of shard files, limited by the shard
+// identifier type in MetaStore.
+const MaxShardCount = 256
+
+// ShardFunc defines which shard file stores the chunk with a given address.
+type ShardFunc uint8
+
+const (
+	// ShardLastByte selects the shard by the last address byte modulo shard
+	// count. Distribution is even only for shard counts that are powers of two.
+	ShardLastByte ShardFunc = iota
+	// ShardFirstByte splits the address space into consecutive ranges by the
+	// first address byte, so that addresses with the same proximity order
+	// prefix are stored in the same shard.
+	ShardFirstByte
+	// ShardHash selects the shard by the hash of the whole address, which
+	// distributes chunks evenly for any shard count.
+	ShardHash
+)
+
+func (f ShardFunc) shard(addr chunk.Address, count int) (shard uint8) {
+	switch f {
+	case ShardFirstByte:
+		return uint8(int(addr[0]) * count / 256)
+	case ShardHash:
+		h := fnv.New64a()
+		h.Write(addr)
+		return uint8(h.Sum64() % uint64(count))
+	}
+	return uint8(int(addr[len(addr)-1]) % count)
+}
+
+func (f ShardFunc) String() string {
+	switch f {
+	case ShardLastByte:
+		return "last-byte"
+	case ShardFirstByte:
+		return "first-byte"
+	case ShardHash:
+		return "hash"
+	}
+	return fmt.Sprintf("ShardFunc(%d)", uint8(f))
+}
+
+func (f ShardFunc) MarshalText() (text []byte, err error) {
+	switch f {
+	case ShardLastByte, ShardFirstByte, ShardHash:
+		return []byte(f.String()), nil
+	}
+	return nil, fmt.Errorf("unknown shard function %v", uint8(f))
+}
+
+func (f *ShardFunc) UnmarshalText(text []byte) error {
+	switch string(text) {
+	case "last-byte":
+		*f = ShardLastByte
+	case "first-byte":
+		*f = ShardFirstByte
+	case "hash":
+		*f = ShardHash
+	default:
+		return fmt.Errorf("unknown shard function %q", text)
+	}
+	return nil
+}
+
+func (o *Options) shardCount() (count int, err error) {
+	count = o.ShardCount
+	if count == 0 {
+		count = DefaultShardCount
+	}
+	if count < 1 || count > MaxShardCount {
+		return 0, fmt.Errorf("invalid shard count %v", count)
+	}
+	return count, nil
+}
+
+func shardFilename(shard uint8) string {
+	return fmt.Sprintf("chunks-%v.db", shard)
+}
+
+// shardLockWeight is the weight of the exclusive shard lock, larger than any
+// number of concurrent readers.
+const shardLockWeight = 1 << 40
+
+// shardLock is a readers-writer lock that can be acquired until the context
+// is done. Waiting writers block new readers, so that Gets do not starve Puts.
+type shardLock struct {
+	sem *semaphore.Weighted
+}
+
+func newShardLock() shardLock {
+	return shardLock{sem: semaphore.NewWeighted(shardLockWeight)}
+}
+
+func (l shardLock) Lock() {
+	_ = l.sem.Acquire(context.Background(), shardLockWeight)
+}
+
+// LockContext acquires the lock or returns the context error if the context
+// is done before the lock is acquired.
+func (l shardLock) LockContext(ctx context.Context) (err error) {
+	return l.sem.Acquire(ctx, shardLockWeight)
+}
+
+func (l shardLock) Unlock() {
+	l.sem.Release(shardLockWeight)
+}
+
+// RLockContext acquires the lock for reading, together with other readers.
+func (l shardLock) RLockContext(ctx context.Context) (err error) {
+	return l.sem.Acquire(ctx, 1)
+}
+
+func (l shardLock) RUnlock() {
+	l.sem.Release(1)
+}
@@ -0,0 +1,84 @@
+// Copyright 2019 The Swarm Authors
+// This file is part of the Swarm library.
+//
+// The Swarm library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The Swarm library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the Swarm library. If not, see <http://www.gnu.org/licenses/>.
+
+package forky_test
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+
+	"github.com/ethersphere/swarm/chunk"
+	"github.com/janos/forky"
+	"github.com/janos/forky/mem"
+	"github.com/janos/forky/test"
+)
+
+func TestStoreShards(t *testing.T) {
+	for _, f := range []forky.ShardFunc{
+		forky.ShardLastByte,
+		forky.ShardFirstByte,
+		forky.ShardHash,
+	} {
+		t.Run(f.String(), func(t *testing.T) {
+			o := &forky.Options{
+				ShardCount: 7,
+				ShardFunc:  f,
+			}
+			s, path, clean := newTestStore(t, chunk.DefaultSize, o)
+			defer clean()
+
+			chunks := make([]chunk.Chunk, 50)
+			for i := range chunks {
+				chunks[i] = test.GenerateTestRandomChunk()
+				if err := s.Put(chunks[i]); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for _, ch := range chunks {
+				got, err := s.Get(ch.Address())
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(got.Data(), ch.Data()) {
+					t.Fatalf("got chunk %s data %x, want %x", ch.Address(), got.Data(), ch.Data())
+				}
+			}
+
+			files, err := filepath.Glob(filepath.Join(path, "chunks-*.db"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(files) != 7 {
+				t.Errorf("got %v shard files, want 7", len(files))
+			}
+			if m := s.Manifest(); m.ShardCount != 7 || m.ShardFunc != f {
+				t.Errorf("got manifest shard count %v function %v, want 7 %v", m.ShardCount, m.ShardFunc, f)
+			}
+			if err := s.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = forky.NewStore(path, chunk.DefaultSize, mem.NewMetaStore(), &forky.Options{
+				ShardCount: 7,
+				ShardFunc:  (f + 1) % 3,
+			})
+			if _, ok := err.(*forky.ManifestMismatchError); !ok {
+				t.Errorf("got error %v, want manifest mismatch error", err)
+			}
+		})
+	}
+}
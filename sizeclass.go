@@ -0,0 +1,114 @@
+// Copyright 2019 The Swarm Authors
+// This file is part of the Swarm library.
+//
+// The Swarm library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The Swarm library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the Swarm library. If not, see <http://www.gnu.org/licenses/>.
+
+package forky
+
+import (
+	"fmt"
+	"sort"
+)
+
+func (o *Options) sizeClasses(maxChunkSize int) (classes []int, err error) {
+	if len(o.SizeClasses) == 0 {
+		return nil, nil
+	}
+	sorted := append([]int(nil), o.SizeClasses...)
+	sort.Ints(sorted)
+	for i, c := range sorted {
+		if c <= 0 || c >= maxChunkSize {
+			return nil, fmt.Errorf("invalid size class %v for maximal chunk size %v", c, maxChunkSize)
+		}
+		if i > 0 && sorted[i-1] == c {
+			continue
+		}
+		classes = append(classes, c)
+	}
+	return classes, nil
+}
+
+// layout maps chunks to shard files. Every shard has a separate file for
+// every size class, which is called a bin. Bins are identified by a single
+// byte that is passed as the shard argument to MetaStore methods, so that
+// every bin has its own free offsets.
+type layout struct {
+	shardCount int
+	// classes are slot data sizes, with the maximal chunk size as the last one
+	classes    []int
+	slotFormat SlotFormat
+	// slotAlignment is the multiple of slot sizes, if not zero
+	slotAlignment int64
+}
+
+func newLayout(maxChunkSize int, o *Options) (l layout, err error) {
+	shardCount, err := o.shardCount()
+	if err != nil {
+		return l, err
+	}
+	classes, err := o.sizeClasses(maxChunkSize)
+	if err != nil {
+		return l, err
+	}
+	classes = append(classes, maxChunkSize)
+	if a := o.SlotAlignment; a < 0 || a&(a-1) != 0 {
+		return l, fmt.Errorf("invalid slot alignment %v, it must be a power of two", a)
+	}
+	if shardCount*len(classes) > MaxShardCount {
+		return l, fmt.Errorf("shard count %v with %v size classes exceeds %v shard files", shardCount, len(classes), MaxShardCount)
+	}
+	return layout{
+		shardCount:    shardCount,
+		classes:       classes,
+		slotFormat:    o.SlotFormat,
+		slotAlignment: int64(o.SlotAlignment),
+	}, nil
+}
+
+func (l layout) binCount() int {
+	return l.shardCount * len(l.classes)
+}
+
+// bin returns the bin of the shard for the chunk with the data size. Sizes
+// larger than the maximal chunk size are mapped to the largest class.
+func (l layout) bin(shard uint8, size int) (bin uint8) {
+	class := sort.SearchInts(l.classes, size)
+	if class == len(l.classes) {
+		class--
+	}
+	return uint8(class*l.shardCount + int(shard))
+}
+
+func (l layout) shard(bin uint8) (shard uint8) {
+	return uint8(int(bin) % l.shardCount)
+}
+
+func (l layout) classSize(bin uint8) (size int) {
+	return l.classes[int(bin)/l.shardCount]
+}
+
+func (l layout) slotSize(bin uint8) (size int64) {
+	return slotSize(l.classSize(bin), l.slotFormat, l.slotAlignment)
+}
+
+// filename returns the name of the bin file. Bins of the largest class are
+// named only by the shard, as they are the only ones in stores without
+// additional size classes.
+func (l layout) filename(bin uint8) string {
+	shard := l.shard(bin)
+	if int(bin)/l.shardCount == len(l.classes)-1 {
+		return shardFilename(shard)
+	}
+	return fmt.Sprintf("chunks-%v-%v.db", shard, l.classSize(bin))
+}
@@ -0,0 +1,135 @@
+// Copyright 2019 The Swarm Authors
+// This file is part of the Swarm library.
+//
+// The Swarm library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The Swarm library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the Swarm library. If not, see <http://www.gnu.org/licenses/>.
+
+package forky_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/ethersphere/swarm/chunk"
+	"github.com/janos/forky"
+	"github.com/janos/forky/mem"
+	"github.com/janos/forky/test"
+)
+
+func TestStoreSizeClasses(t *testing.T) {
+	path, err := ioutil.TempDir("", "swarm-forky-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(path)
+
+	o := &forky.Options{
+		ShardCount:  2,
+		SizeClasses: []int{1024, 256},
+	}
+	metaStore := mem.NewMetaStore()
+	s, err := forky.NewStore(path, chunk.DefaultSize, metaStore, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	var chunks []chunk.Chunk
+	for _, size := range []int{1, 40, 256, 257, 1000, 1024, 1025, chunk.DefaultSize} {
+		for i := 0; i < 5; i++ {
+			ch := test.GenerateTestRandomChunk()
+			ch = chunk.NewChunk(ch.Address(), ch.Data()[:size])
+			if err := s.Put(ch); err != nil {
+				t.Fatal(err)
+			}
+			chunks = append(chunks, ch)
+		}
+	}
+	for _, ch := range chunks {
+		got, err := s.Get(ch.Address())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got.Data(), ch.Data()) {
+			t.Fatalf("got chunk %s data %x, want %x", ch.Address(), got.Data(), ch.Data())
+		}
+	}
+
+	// every class file has slots of its size
+	var size int64
+	for class, slotSize := range map[string]int64{
+		"chunks-*-256.db":  256,
+		"chunks-*-1024.db": 1024,
+		"chunks-?.db":      chunk.DefaultSize,
+	} {
+		files, err := filepath.Glob(filepath.Join(path, class))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(files) != 2 {
+			t.Errorf("got %v files %s, want 2", len(files), class)
+		}
+		for _, file := range files {
+			fi, err := os.Stat(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fi.Size()%slotSize != 0 {
+				t.Errorf("file %s size %v is not aligned to slot size %v", file, fi.Size(), slotSize)
+			}
+			size += fi.Size()
+		}
+	}
+	if want := int64(15*256 + 15*1024 + 10*chunk.DefaultSize); size != want {
+		t.Errorf("got shard files size %v, want %v", size, want)
+	}
+
+	// deleted slots are reused by chunks of the same class
+	for _, ch := range chunks[:10] {
+		if err := s.Delete(ch.Address()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 10; i++ {
+		ch := test.GenerateTestRandomChunk()
+		if err := s.Put(chunk.NewChunk(ch.Address(), ch.Data()[:100])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if m := s.Manifest(); !reflect.DeepEqual(m.SizeClasses, []int{256, 1024}) {
+		t.Errorf("got manifest size classes %v, want [256 1024]", m.SizeClasses)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := forky.Check(path, chunk.DefaultSize, metaStore, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Problems) != 0 || r.Chunks != len(chunks) {
+		t.Errorf("got check report %+v", r)
+	}
+
+	_, err = forky.NewStore(path, chunk.DefaultSize, mem.NewMetaStore(), &forky.Options{
+		ShardCount:  2,
+		SizeClasses: []int{512},
+	})
+	if _, ok := err.(*forky.ManifestMismatchError); !ok {
+		t.Errorf("got error %v, want manifest mismatch error", err)
+	}
+}
@@ -0,0 +1,276 @@
+// Copyright 2019 The Swarm Authors
+// This file is part of the Swarm library.
+//
+// The Swarm library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The Swarm library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the Swarm library. If not, see <http://www.gnu.org/licenses/>.
+
+package forky
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/ethersphere/swarm/chunk"
+)
+
+// SlotFormat defines how chunks are written in shard file slots.
+type SlotFormat uint8
+
+const (
+	// SlotFormatRaw slots contain only chunk data. MetaStore is the only
+	// source of information about what chunk is stored in the slot.
+	SlotFormatRaw SlotFormat = iota
+	// SlotFormatHeader slots start with a header that contains chunk address,
+	// data size and checksum, so that MetaStore can be rebuilt from shard
+	// files with RebuildMetaStore function.
+	SlotFormatHeader
+)
+
+func (f SlotFormat) String() string {
+	switch f {
+	case SlotFormatRaw:
+		return "raw"
+	case SlotFormatHeader:
+		return "header"
+	}
+	return fmt.Sprintf("SlotFormat(%d)", uint8(f))
+}
+
+func (f SlotFormat) MarshalText() (text []byte, err error) {
+	switch f {
+	case SlotFormatRaw, SlotFormatHeader:
+		return []byte(f.String()), nil
+	}
+	return nil, fmt.Errorf("unknown slot format %v", uint8(f))
+}
+
+func (f *SlotFormat) UnmarshalText(text []byte) error {
+	switch string(text) {
+	case "raw":
+		*f = SlotFormatRaw
+	case "header":
+		*f = SlotFormatHeader
+	default:
+		return fmt.Errorf("unknown slot format %q", text)
+	}
+	return nil
+}
+
+// slotHeaderSize is the length of the slot header in SlotFormatHeader:
+// flags, address length, data size, checksum and address.
+const slotHeaderSize = 64
+
+// maxHeaderAddressLength is the maximal length of the address that can be
+// stored in the slot header.
+const maxHeaderAddressLength = slotHeaderSize - 8
+
+const slotFlagUsed byte = 1
+
+var errAddressTooLong = errors.New("address too long for slot header")
+
+func (f SlotFormat) headerSize() int64 {
+	if f == SlotFormatHeader {
+		return slotHeaderSize
+	}
+	return 0
+}
+
+func slotSize(maxChunkSize int, f SlotFormat, alignment int64) (size int64) {
+	size = int64(maxChunkSize) + f.headerSize()
+	if alignment > 0 {
+		if r := size % alignment; r != 0 {
+			size += alignment - r
+		}
+	}
+	return size
+}
+
+type slotHeader struct {
+	flags byte
+	addr  chunk.Address
+	size  uint16
+	sum   uint32
+}
+
+func (h *slotHeader) MarshalBinary() (data []byte, err error) {
+	if len(h.addr) > maxHeaderAddressLength {
+		return nil, errAddressTooLong
+	}
+	data = make([]byte, slotHeaderSize)
+	data[0] = h.flags
+	data[1] = uint8(len(h.addr))
+	binary.BigEndian.PutUint16(data[2:4], h.size)
+	binary.BigEndian.PutUint32(data[4:8], h.sum)
+	copy(data[8:], h.addr)
+	return data, nil
+}
+
+func (h *slotHeader) UnmarshalBinary(data []byte) error {
+	if len(data) < slotHeaderSize {
+		return fmt.Errorf("invalid slot header length %v", len(data))
+	}
+	l := int(data[1])
+	if l > maxHeaderAddressLength {
+		return errAddressTooLong
+	}
+	h.flags = data[0]
+	h.size = binary.BigEndian.Uint16(data[2:4])
+	h.sum = binary.BigEndian.Uint32(data[4:8])
+	h.addr = append(chunk.Address(nil), data[8:8+l]...)
+	return nil
+}
+
+// markSlotFree clears the used flag in the slot header so that the slot is
+// not considered by RebuildMetaStore.
+func (s *Store) markSlotFree(bin uint8, offset int64) (err error) {
+	if s.slotFormat != SlotFormatHeader {
+		return nil
+	}
+	if !s.directIO {
+		_, err = s.shards[bin].WriteAt([]byte{0}, offset)
+		return err
+	}
+	// direct i/o writes whole blocks, so the first block of the slot
+	// is read and written with the cleared flags
+	block := s.buffer(int(s.layout.slotAlignment))
+	if _, err := s.shards[bin].ReadAt(block, offset); err != nil && err != io.EOF {
+		return err
+	}
+	block[0] = 0
+	_, err = s.shards[bin].WriteAt(block, offset)
+	return err
+}
+
+// RebuildReport contains statistics about the RebuildMetaStore result.
+type RebuildReport struct {
+	Chunks         int `json:"chunks"`
+	FreeSlots      int `json:"freeSlots"`
+	CorruptedSlots int `json:"corruptedSlots"`
+}
+
+// RebuildMetaStore scans all slots in shard files of a closed store that is
+// created with SlotFormatHeader, with the layout from the manifest, and sets
+// chunk meta and free offsets in the provided MetaStore. It is intended to
+// be called with an empty MetaStore, as existing chunk meta with addresses
+// that are not found in shard files is not removed. Slots with data that do
+// not match the header checksum are marked as free.
+func RebuildMetaStore(path string, maxChunkSize int, metaStore MetaStore) (r *RebuildReport, err error) {
+	o := &Options{
+		SlotFormat: SlotFormatHeader,
+	}
+	m, err := ReadManifest(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+	} else {
+		o = m.options()
+		o.SlotFormat = SlotFormatHeader
+		if err := checkManifest(path, maxChunkSize, o); err != nil {
+			return nil, err
+		}
+	}
+	l, err := newLayout(maxChunkSize, o)
+	if err != nil {
+		return nil, err
+	}
+	ends, err := readDataEnds(path, l.binCount())
+	if err != nil {
+		return nil, err
+	}
+	bitmap, err := hasFreeBitmap(path)
+	if err != nil {
+		return nil, err
+	}
+	// the filter does not contain rebuilt chunks
+	if err := removeFilter(path); err != nil {
+		return nil, err
+	}
+	r = new(RebuildReport)
+	for bin := 0; bin < l.binCount(); bin++ {
+		end := int64(-1)
+		if ends != nil {
+			end = ends[bin]
+		}
+		if err := rebuildBin(path, l, uint8(bin), end, !bitmap, metaStore, r); err != nil {
+			return nil, err
+		}
+	}
+	if bitmap {
+		// free bitmaps are rebuilt from chunk meta when the store is opened
+		if err := markFreeBitmapDirty(path); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+func rebuildBin(path string, l layout, bin uint8, dataEnd int64, freeOffsets bool, metaStore MetaStore, r *RebuildReport) (err error) {
+	f, err := os.Open(filepath.Join(path, l.filename(bin)))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+
+	size := l.slotSize(bin)
+	slot := make([]byte, size)
+	addrs := make(map[string]struct{})
+	referenced := make(map[int64]struct{})
+	var end int64
+	for offset := int64(0); dataEnd < 0 || offset < dataEnd; offset += size {
+		if _, err := f.ReadAt(slot, offset); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return err
+		}
+		end = offset + size
+		var h slotHeader
+		if err := h.UnmarshalBinary(slot); err != nil || h.flags&slotFlagUsed == 0 {
+			continue
+		}
+		if int(h.size) > l.classSize(bin) || l.bin(l.shard(bin), int(h.size)) != bin || checksum(slot[slotHeaderSize:slotHeaderSize+int(h.size)]) != h.sum {
+			r.CorruptedSlots++
+			continue
+		}
+		if _, ok := addrs[string(h.addr)]; ok {
+			// the same chunk is already found in another slot
+			continue
+		}
+		if err := metaStore.Set(h.addr, bin, false, &Meta{
+			Size:     h.size,
+			Offset:   offset,
+			Checksum: h.sum,
+		}); err != nil {
+			return err
+		}
+		addrs[string(h.addr)] = struct{}{}
+		referenced[offset] = struct{}{}
+		r.Chunks++
+	}
+	r.FreeSlots += int((end / size)) - len(referenced)
+	if !freeOffsets {
+		return nil
+	}
+	return rebuildFreeOffsets(metaStore, bin, func(offset int64) bool {
+		_, ok := referenced[offset]
+		return ok
+	}, size, end)
+}
@@ -0,0 +1,153 @@
+// Copyright 2019 The Swarm Authors
+// This file is part of the Swarm library.
+//
+// The Swarm library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The Swarm library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the Swarm library. If not, see <http://www.gnu.org/licenses/>.
+
+package forky_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/ethersphere/swarm/chunk"
+	"github.com/janos/forky"
+	"github.com/janos/forky/mem"
+	"github.com/janos/forky/test"
+)
+
+func TestRebuildMetaStore(t *testing.T) {
+	s, path, clean := newTestStore(t, chunk.DefaultSize, &forky.Options{
+		SlotFormat: forky.SlotFormatHeader,
+	})
+	defer clean()
+
+	chunks := make([]chunk.Chunk, 20)
+	for i := range chunks {
+		chunks[i] = test.GenerateTestRandomChunk()
+		if err := s.Put(chunks[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	deleted := chunks[:5]
+	for _, ch := range deleted {
+		if err := s.Delete(ch.Address()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	metaStore := mem.NewMetaStore()
+	r, err := forky.RebuildMetaStore(path, chunk.DefaultSize, metaStore)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Chunks != 15 {
+		t.Errorf("got %v rebuilt chunks, want 15", r.Chunks)
+	}
+	if r.FreeSlots != 5 {
+		t.Errorf("got %v free slots, want 5", r.FreeSlots)
+	}
+
+	s, err = forky.NewStore(path, chunk.DefaultSize, metaStore, &forky.Options{
+		SlotFormat: forky.SlotFormatHeader,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	for _, ch := range deleted {
+		if _, err := s.Get(ch.Address()); err != chunk.ErrChunkNotFound {
+			t.Errorf("got error %v, want %v", err, chunk.ErrChunkNotFound)
+		}
+	}
+	for _, ch := range chunks[5:] {
+		got, err := s.Get(ch.Address())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got.Data(), ch.Data()) {
+			t.Errorf("got chunk %s data %x, want %x", ch.Address(), got.Data(), ch.Data())
+		}
+	}
+}
+
+// TestRebuildMetaStoreFailedPut validates that a chunk of a failed Put into
+// a reclaimed slot is not rebuilt.
+func TestRebuildMetaStoreFailedPut(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		o    forky.Options
+	}{
+		{name: "free offsets"},
+		{name: "free bitmap", o: forky.Options{FreeBitmap: true}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			path, err := ioutil.TempDir("", "swarm-forky-")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(path)
+
+			o := tc.o
+			o.ShardCount = 1
+			o.SlotFormat = forky.SlotFormatHeader
+			failing := &failingMetaStore{
+				MetaStore: mem.NewMetaStore(),
+			}
+			s, err := forky.NewStore(path, chunk.DefaultSize, failing, &o)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+
+			chunks := make([]chunk.Chunk, 3)
+			for i := range chunks {
+				chunks[i] = test.GenerateTestRandomChunk()
+				if err := s.Put(chunks[i]); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := s.Delete(chunks[1].Address()); err != nil {
+				t.Fatal(err)
+			}
+
+			failing.fail = true
+			failed := test.GenerateTestRandomChunk()
+			if err := s.Put(failed); err != errFailingMetaStore {
+				t.Fatalf("got error %v, want %v", err, errFailingMetaStore)
+			}
+			failing.fail = false
+			if err := s.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			metaStore := mem.NewMetaStore()
+			r, err := forky.RebuildMetaStore(path, chunk.DefaultSize, metaStore)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if r.Chunks != 2 || r.FreeSlots != 1 {
+				t.Errorf("got rebuild report %+v, want 2 chunks and 1 free slot", r)
+			}
+			if _, err := metaStore.Get(failed.Address()); err != chunk.ErrChunkNotFound {
+				t.Errorf("got error %v, want %v", err, chunk.ErrChunkNotFound)
+			}
+		})
+	}
+}
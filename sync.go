@@ -0,0 +1,134 @@
+// Copyright 2019 The Swarm Authors
+// This file is part of the Swarm library.
+//
+// The Swarm library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The Swarm library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the Swarm library. If not, see <http://www.gnu.org/licenses/>.
+
+package forky
+
+import (
+	"fmt"
+	"time"
+)
+
+// SyncMode defines when shard files and MetaStore are synced to persistent
+// storage. Shard files are always synced before MetaStore, so that synced
+// chunk meta never references data that is not synced.
+type SyncMode uint8
+
+const (
+	// SyncNone leaves syncing to the operating system and MetaStore.
+	SyncNone SyncMode = iota
+	// SyncAlways syncs on every Put, PutMulti and Delete, so that chunks
+	// are durable when these methods return without an error.
+	SyncAlways
+	// SyncInterval syncs all shard files and MetaStore periodically, with
+	// the period defined by Options.SyncInterval. Chunks stored between
+	// syncs may be lost on crash.
+	SyncInterval
+	// SyncBatch syncs only on PutMulti, so that chunks stored together are
+	// durable when it returns without an error, while Put and Delete are
+	// not synced.
+	SyncBatch
+)
+
+func (m SyncMode) String() string {
+	switch m {
+	case SyncNone:
+		return "none"
+	case SyncAlways:
+		return "always"
+	case SyncInterval:
+		return "interval"
+	case SyncBatch:
+		return "batch"
+	}
+	return fmt.Sprintf("SyncMode(%d)", uint8(m))
+}
+
+// DefaultSyncInterval is the period of SyncInterval mode if it is not
+// specified in Options.
+const DefaultSyncInterval = time.Second
+
+// SyncMetaStore is an optional MetaStore extension that writes all stored
+// data to persistent storage. MetaStore that does not implement it is
+// expected to be durable on every write, or not durable at all.
+type SyncMetaStore interface {
+	Sync() error
+}
+
+// Sync writes data of all shard files and then MetaStore to persistent
+// storage, regardless of the sync mode.
+func (s *Store) Sync() (err error) {
+	done, err := s.protect()
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	return s.sync()
+}
+
+func (s *Store) sync() (err error) {
+	for _, f := range s.shards {
+		if err := f.Sync(); err != nil {
+			return err
+		}
+	}
+	if s.ends != nil {
+		if err := s.ends.sync(); err != nil {
+			return err
+		}
+	}
+	if err := s.syncMeta(); err != nil {
+		return err
+	}
+	if s.journal != nil {
+		return s.journal.syncFile()
+	}
+	return nil
+}
+
+func (s *Store) syncBin(bin uint8) (err error) {
+	if err := s.shards[bin].Sync(); err != nil {
+		return err
+	}
+	if s.ends != nil {
+		return s.ends.sync()
+	}
+	return nil
+}
+
+func (s *Store) syncMeta() (err error) {
+	if m, ok := s.meta.(SyncMetaStore); ok {
+		return m.Sync()
+	}
+	return nil
+}
+
+func (s *Store) syncLoop(interval time.Duration) {
+	defer s.wg.Done()
+
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+			// errors are returned by the final sync on Close
+			_ = s.sync()
+		case <-s.quit:
+			return
+		}
+	}
+}
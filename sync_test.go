@@ -0,0 +1,143 @@
+// Copyright 2019 The Swarm Authors
+// This file is part of the Swarm library.
+//
+// The Swarm library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The Swarm library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the Swarm library. If not, see <http://www.gnu.org/licenses/>.
+
+package forky_test
+
+import (
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ethersphere/swarm/chunk"
+	"github.com/janos/forky"
+	"github.com/janos/forky/mem"
+	"github.com/janos/forky/test"
+)
+
+func TestStoreSyncMode(t *testing.T) {
+	for _, tc := range []struct {
+		mode forky.SyncMode
+		// number of MetaStore syncs after Put, PutMulti and Delete
+		wantSyncs []int
+	}{
+		{mode: forky.SyncNone, wantSyncs: []int{0, 0, 0}},
+		{mode: forky.SyncAlways, wantSyncs: []int{1, 2, 3}},
+		{mode: forky.SyncBatch, wantSyncs: []int{0, 1, 1}},
+	} {
+		t.Run(tc.mode.String(), func(t *testing.T) {
+			s, metaStore, clean := newSyncTestStore(t, &forky.Options{
+				SyncMode: tc.mode,
+			})
+			defer clean()
+
+			ch := test.GenerateTestRandomChunk()
+			if err := s.Put(ch); err != nil {
+				t.Fatal(err)
+			}
+			if got := metaStore.syncCount(); got != tc.wantSyncs[0] {
+				t.Errorf("got %v syncs after put, want %v", got, tc.wantSyncs[0])
+			}
+			if err := s.PutMulti(test.GenerateTestRandomChunk(), test.GenerateTestRandomChunk()); err != nil {
+				t.Fatal(err)
+			}
+			if got := metaStore.syncCount(); got != tc.wantSyncs[1] {
+				t.Errorf("got %v syncs after put multi, want %v", got, tc.wantSyncs[1])
+			}
+			if err := s.Delete(ch.Address()); err != nil {
+				t.Fatal(err)
+			}
+			if got := metaStore.syncCount(); got != tc.wantSyncs[2] {
+				t.Errorf("got %v syncs after delete, want %v", got, tc.wantSyncs[2])
+			}
+		})
+	}
+
+	t.Run(forky.SyncInterval.String(), func(t *testing.T) {
+		s, metaStore, clean := newSyncTestStore(t, &forky.Options{
+			SyncMode:     forky.SyncInterval,
+			SyncInterval: 10 * time.Millisecond,
+		})
+		defer clean()
+
+		if err := s.Put(test.GenerateTestRandomChunk()); err != nil {
+			t.Fatal(err)
+		}
+		deadline := time.Now().Add(5 * time.Second)
+		for metaStore.syncCount() == 0 {
+			if time.Now().After(deadline) {
+				t.Fatal("store not synced")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		path, err := ioutil.TempDir("", "swarm-forky-")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(path)
+
+		_, err = forky.NewStore(path, chunk.DefaultSize, mem.NewMetaStore(), &forky.Options{
+			SyncMode: forky.SyncBatch + 1,
+		})
+		if err == nil {
+			t.Error("got no error for invalid sync mode")
+		}
+	})
+}
+
+func newSyncTestStore(t *testing.T, o *forky.Options) (s *forky.Store, metaStore *syncMetaStore, clean func()) {
+	t.Helper()
+
+	path, err := ioutil.TempDir("", "swarm-forky-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	metaStore = &syncMetaStore{MetaStore: mem.NewMetaStore()}
+	s, err = forky.NewStore(path, chunk.DefaultSize, metaStore, o)
+	if err != nil {
+		os.RemoveAll(path)
+		t.Fatal(err)
+	}
+	return s, metaStore, func() {
+		s.Close()
+		os.RemoveAll(path)
+	}
+}
+
+// syncMetaStore counts Sync calls.
+type syncMetaStore struct {
+	forky.MetaStore
+	syncs int
+	mu    sync.Mutex
+}
+
+func (s *syncMetaStore) Sync() error {
+	s.mu.Lock()
+	s.syncs++
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *syncMetaStore) syncCount() (count int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.syncs
+}
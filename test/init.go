@@ -22,6 +22,15 @@ var (
 	chunksFlag      = flag.Int("chunks", 100, "Number of chunks to use in tests.")
 	concurrencyFlag = flag.Int("concurrency", 8, "Maximal number of parallel operations.")
 	noCacheFlag     = flag.Bool("no-cache", false, "Disable forky memory cache.")
+	slotHeadersFlag = flag.Bool("slot-headers", false, "Write headers in forky shard file slots.")
+	syncFlag        = flag.Bool("sync", false, "Sync forky shard files and MetaStore on every write.")
+	groupCommitFlag = flag.Bool("group-commit", false, "Coalesce forky MetaStore writes of concurrent operations.")
+	mmapFlag        = flag.Bool("mmap", false, "Read forky shard files from memory mapping.")
+	directIOFlag    = flag.Bool("direct-io", false, "Open forky shard files with direct i/o.")
+	preallocateFlag = flag.Int64("preallocate", 0, "Preallocate forky shard files in extents of this size.")
+	freeBitmapFlag  = flag.Bool("free-bitmap", false, "Keep forky free slots in bitmaps instead of MetaStore.")
+	dataCacheFlag   = flag.Int64("data-cache", 0, "Cache forky chunk data up to this size in bytes.")
+	filterFlag      = flag.Int("filter", 0, "Filter absent forky chunks with a cuckoo filter of this capacity.")
 )
 
 func Init() {
@@ -22,7 +22,9 @@ import (
 	"io/ioutil"
 	"math/rand"
 	"os"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -47,6 +49,15 @@ func StoreSuite(t *testing.T, newStoreFunc func(t *testing.T) (forky.Interface,
 		})
 	})
 
+	t.Run("batch", func(t *testing.T) {
+		TestStore(t, &TestStoreOptions{
+			ChunkCount:   *chunksFlag,
+			DeleteSplit:  2,
+			PutBatchSize: 10,
+			NewStoreFunc: newStoreFunc,
+		})
+	})
+
 	for _, tc := range []struct {
 		name        string
 		deleteSplit int
@@ -87,9 +98,12 @@ func StoreSuite(t *testing.T, newStoreFunc func(t *testing.T) (forky.Interface,
 }
 
 type TestStoreOptions struct {
-	ChunkCount   int
-	DeleteSplit  int
-	Cleaned      bool
+	ChunkCount  int
+	DeleteSplit int
+	Cleaned     bool
+	// PutBatchSize is the number of chunks stored with a single PutMulti
+	// call. If zero, chunks are stored with Put.
+	PutBatchSize int
 	NewStoreFunc func(t *testing.T) (forky.Interface, func())
 }
 
@@ -152,30 +166,50 @@ func TestStore(t *testing.T, o *TestStoreOptions) {
 		sem := make(chan struct{}, *concurrencyFlag)
 		var wg sync.WaitGroup
 		var wantCountMu sync.Mutex
-		wg.Add(o.ChunkCount)
-		for i, ch := range chunks {
+		// deleteChunk deletes every DeleteSplit chunk after it is stored
+		deleteChunk := func(i int, ch chunk.Chunk) {
+			if o.DeleteSplit > 0 && i%o.DeleteSplit == 0 {
+				if err := db.Delete(ch.Address()); err != nil {
+					panic(err)
+				}
+				deletedChunks.Store(string(ch.Address()), nil)
+			} else {
+				wantCountMu.Lock()
+				wantCount++
+				wantCountMu.Unlock()
+			}
+		}
+		batchSize := o.PutBatchSize
+		if batchSize == 0 {
+			batchSize = 1
+		}
+		for start := 0; start < o.ChunkCount; start += batchSize {
+			end := start + batchSize
+			if end > o.ChunkCount {
+				end = o.ChunkCount
+			}
 			sem <- struct{}{}
+			wg.Add(1)
 
-			go func(i int, ch chunk.Chunk) {
+			go func(start int, batch []chunk.Chunk) {
 				defer func() {
 					<-sem
 					wg.Done()
 				}()
 
-				if err := db.Put(ch); err != nil {
-					panic(err)
-				}
-				if o.DeleteSplit > 0 && i%o.DeleteSplit == 0 {
-					if err := db.Delete(ch.Address()); err != nil {
+				if o.PutBatchSize > 0 {
+					if err := db.PutMulti(batch...); err != nil {
 						panic(err)
 					}
-					deletedChunks.Store(string(ch.Address()), nil)
 				} else {
-					wantCountMu.Lock()
-					wantCount++
-					wantCountMu.Unlock()
+					if err := db.Put(batch[0]); err != nil {
+						panic(err)
+					}
 				}
-			}(i, ch)
+				for i, ch := range batch {
+					deleteChunk(start+i, ch)
+				}
+			}(start, chunks[start:end])
 		}
 		wg.Wait()
 
@@ -248,9 +282,37 @@ func TestStore(t *testing.T, o *TestStoreOptions) {
 		}
 		wg.Wait()
 	})
+
+	t.Run("read-multi", func(t *testing.T) {
+		addrs := make([]chunk.Address, len(chunks))
+		for i, ch := range chunks {
+			addrs[i] = ch.Address()
+		}
+		got, errs, err := db.GetMulti(addrs...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, ch := range chunks {
+			if _, ok := deletedChunks.Load(string(ch.Address())); ok {
+				if errs[i] != chunk.ErrChunkNotFound {
+					t.Fatalf("got error %v, want %v", errs[i], chunk.ErrChunkNotFound)
+				}
+				continue
+			}
+			if errs[i] != nil {
+				t.Fatalf("chunk %v %s: %v", i, ch.Address().Hex(), errs[i])
+			}
+			if !bytes.Equal(got[i].Address(), ch.Address()) {
+				t.Fatalf("got chunk %v address %x, want %x", i, got[i].Address(), ch.Address())
+			}
+			if !bytes.Equal(got[i].Data(), ch.Data()) {
+				t.Fatalf("got chunk %v data %x, want %x", i, got[i].Data(), ch.Data())
+			}
+		}
+	})
 }
 
-func NewForkyStore(t *testing.T, path string, metaStore forky.MetaStore) (s *forky.Store, clean func()) {
+func NewForkyStore(t testing.TB, path string, metaStore forky.MetaStore) (s *forky.Store, clean func()) {
 	t.Helper()
 
 	path, err := ioutil.TempDir("", "swarm-forky")
@@ -258,7 +320,26 @@ func NewForkyStore(t *testing.T, path string, metaStore forky.MetaStore) (s *for
 		t.Fatal(err)
 	}
 
-	s, err = forky.NewStore(path, chunk.DefaultSize, metaStore, *noCacheFlag)
+	o := &forky.Options{
+		GroupCommit:     *groupCommitFlag,
+		Mmap:            *mmapFlag,
+		DirectIO:        *directIOFlag,
+		PreallocateSize: *preallocateFlag,
+		FreeBitmap:      *freeBitmapFlag,
+		DataCacheSize:   *dataCacheFlag,
+		FilterCapacity:  *filterFlag,
+	}
+	if *noCacheFlag {
+		o.MetaCacheSize = -1
+		o.FreeCacheSize = -1
+	}
+	if *slotHeadersFlag {
+		o.SlotFormat = forky.SlotFormatHeader
+	}
+	if *syncFlag {
+		o.SyncMode = forky.SyncAlways
+	}
+	s, err = forky.NewStore(path, chunk.DefaultSize, metaStore, o)
 	if err != nil {
 		os.RemoveAll(path)
 		t.Fatal(err)
@@ -269,6 +350,155 @@ func NewForkyStore(t *testing.T, path string, metaStore forky.MetaStore) (s *for
 	}
 }
 
+// StoreBenchmarkSuite runs benchmarks with the number of goroutines doubled
+// up to the concurrency flag value, so that scaling of the store throughput
+// with concurrent operations can be compared.
+// RangeMetaStoreSuite validates that the meta store iterates over chunk
+// meta in the address order from the start address, without free offsets.
+func RangeMetaStoreSuite(t *testing.T, metaStore forky.MetaStore) {
+	r, ok := metaStore.(forky.RangeMetaStore)
+	if !ok {
+		t.Fatal("meta store does not implement RangeMetaStore")
+	}
+	addrs := make([]chunk.Address, 10)
+	for i := range addrs {
+		addrs[i] = GenerateTestRandomChunk().Address()
+		if err := metaStore.Set(addrs[i], 0, false, &forky.Meta{Size: 10, Offset: int64(i) * 4096}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := metaStore.SetFreeOffset(0, 40960); err != nil {
+		t.Fatal(err)
+	}
+	sort.Slice(addrs, func(i, j int) bool {
+		return bytes.Compare(addrs[i], addrs[j]) < 0
+	})
+
+	for _, tc := range []struct {
+		name  string
+		start chunk.Address
+		limit int
+		want  []chunk.Address
+	}{
+		{
+			name: "all",
+			want: addrs,
+		},
+		{
+			name:  "existing",
+			start: addrs[3],
+			want:  addrs[3:],
+		},
+		{
+			name:  "after",
+			start: append(append(chunk.Address(nil), addrs[3]...), 0),
+			limit: 2,
+			want:  addrs[4:6],
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var got []chunk.Address
+			if err := r.IterateFrom(tc.start, func(addr chunk.Address, m *forky.Meta) (stop bool, err error) {
+				got = append(got, append(chunk.Address(nil), addr...))
+				return len(got) == tc.limit, nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != len(tc.want) {
+				t.Fatalf("got %v addresses, want %v", len(got), len(tc.want))
+			}
+			for i := range got {
+				if !bytes.Equal(got[i], tc.want[i]) {
+					t.Errorf("got address %v %s, want %s", i, got[i], tc.want[i])
+				}
+			}
+		})
+	}
+}
+
+func StoreBenchmarkSuite(b *testing.B, newStoreFunc func(b *testing.B) (forky.Interface, func())) {
+	for concurrency := 1; ; concurrency *= 2 {
+		if concurrency > *concurrencyFlag {
+			concurrency = *concurrencyFlag
+		}
+		b.Run(fmt.Sprintf("get-%v", concurrency), func(b *testing.B) {
+			benchmarkGet(b, concurrency, newStoreFunc)
+		})
+		b.Run(fmt.Sprintf("put-%v", concurrency), func(b *testing.B) {
+			benchmarkPut(b, concurrency, newStoreFunc)
+		})
+		if concurrency == *concurrencyFlag {
+			break
+		}
+	}
+}
+
+// benchmarkGet measures Get calls for stored chunks from a number of
+// concurrent goroutines.
+func benchmarkGet(b *testing.B, concurrency int, newStoreFunc func(b *testing.B) (forky.Interface, func())) {
+	db, clean := newStoreFunc(b)
+	defer clean()
+
+	chunks := getChunks(*chunksFlag)
+	for _, ch := range chunks {
+		if err := db.Put(ch); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	b.SetBytes(chunk.DefaultSize)
+	b.ResetTimer()
+
+	runConcurrently(b, b.N, concurrency, func(i int) (err error) {
+		_, err = db.Get(chunks[i%len(chunks)].Address())
+		return err
+	})
+}
+
+// benchmarkPut measures Put calls of new chunks from a number of concurrent
+// goroutines.
+func benchmarkPut(b *testing.B, concurrency int, newStoreFunc func(b *testing.B) (forky.Interface, func())) {
+	db, clean := newStoreFunc(b)
+	defer clean()
+
+	chunks := make([]chunk.Chunk, b.N)
+	for i := range chunks {
+		chunks[i] = GenerateTestRandomChunk()
+	}
+
+	b.SetBytes(chunk.DefaultSize)
+	b.ResetTimer()
+
+	runConcurrently(b, b.N, concurrency, func(i int) (err error) {
+		return db.Put(chunks[i])
+	})
+}
+
+// runConcurrently calls fn for every index up to count from a number of
+// goroutines, reporting the first error.
+func runConcurrently(b *testing.B, count, concurrency int, fn func(i int) error) {
+	var n int64
+	var wg sync.WaitGroup
+	wg.Add(concurrency)
+	for i := 0; i < concurrency; i++ {
+		go func() {
+			defer wg.Done()
+
+			for {
+				i := int(atomic.AddInt64(&n, 1) - 1)
+				if i >= count {
+					return
+				}
+				if err := fn(i); err != nil {
+					b.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
 var chunkCache []chunk.Chunk
 
 func getChunks(count int) []chunk.Chunk {
@@ -0,0 +1,85 @@
+// Copyright 2019 The Swarm Authors
+// This file is part of the Swarm library.
+//
+// The Swarm library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The Swarm library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the Swarm library. If not, see <http://www.gnu.org/licenses/>.
+
+package forky
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/ethersphere/swarm/chunk"
+	"github.com/ethersphere/swarm/storage"
+)
+
+// Validator checks if the chunk is valid. Store rejects chunks for which
+// any of the configured validators returns a non-nil error.
+type Validator interface {
+	Validate(ch chunk.Chunk) (err error)
+}
+
+// ValidatorFunc adapts an ordinary function to the Validator interface.
+type ValidatorFunc func(ch chunk.Chunk) (err error)
+
+func (f ValidatorFunc) Validate(ch chunk.Chunk) (err error) {
+	return f(ch)
+}
+
+// InvalidChunkError is returned by Store when a validator rejects a chunk.
+type InvalidChunkError struct {
+	Address chunk.Address
+	Err     error
+}
+
+func (e *InvalidChunkError) Error() string {
+	return fmt.Sprintf("invalid chunk %s: %v", e.Address.Hex(), e.Err)
+}
+
+func (e *InvalidChunkError) Unwrap() error {
+	return e.Err
+}
+
+// NewContentAddressValidator returns a Validator that checks that the chunk
+// address is the Swarm BMT hash of its span prefixed data.
+func NewContentAddressValidator() Validator {
+	hasher := storage.MakeHashFunc(storage.BMTHash)
+	return ValidatorFunc(func(ch chunk.Chunk) (err error) {
+		data := ch.Data()
+		if l := len(data); l < 9 || l > chunk.DefaultSize+8 {
+			return fmt.Errorf("invalid data length %v", l)
+		}
+		h := hasher()
+		h.ResetWithLength(data[:8])
+		if _, err := h.Write(data[8:]); err != nil {
+			return err
+		}
+		if sum := h.Sum(nil); !bytes.Equal(sum, ch.Address()) {
+			return fmt.Errorf("content address mismatch, bmt hash %x", sum)
+		}
+		return nil
+	})
+}
+
+func (s *Store) validate(ch chunk.Chunk) (err error) {
+	for _, v := range s.validators {
+		if err := v.Validate(ch); err != nil {
+			return &InvalidChunkError{
+				Address: ch.Address(),
+				Err:     err,
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+// Copyright 2019 The Swarm Authors
+// This file is part of the Swarm library.
+//
+// The Swarm library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The Swarm library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the Swarm library. If not, see <http://www.gnu.org/licenses/>.
+
+package forky_test
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/ethersphere/swarm/chunk"
+	"github.com/ethersphere/swarm/storage"
+	"github.com/janos/forky"
+	"github.com/janos/forky/test"
+)
+
+func TestStoreValidators(t *testing.T) {
+	var rejectOnGet bool
+	s, _, clean := newTestStore(t, chunk.DefaultSize+8, &forky.Options{
+		Validators: []forky.Validator{
+			forky.NewContentAddressValidator(),
+			forky.ValidatorFunc(func(chunk.Chunk) error {
+				if rejectOnGet {
+					return errors.New("rejected")
+				}
+				return nil
+			}),
+		},
+		ValidateOnGet: true,
+	})
+	defer clean()
+
+	ch := storage.GenerateRandomChunk(chunk.DefaultSize)
+	if err := s.Put(ch); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Get(ch.Address()); err != nil {
+		t.Fatal(err)
+	}
+
+	invalid := chunk.NewChunk(test.GenerateTestRandomChunk().Address(), ch.Data())
+	err := s.Put(invalid)
+	if e, ok := err.(*forky.InvalidChunkError); !ok {
+		t.Fatalf("got error %v, want invalid chunk error", err)
+	} else if !bytes.Equal(e.Address, invalid.Address()) {
+		t.Errorf("got invalid chunk address %s, want %s", e.Address, invalid.Address())
+	}
+	if _, err := s.Get(invalid.Address()); err != chunk.ErrChunkNotFound {
+		t.Fatalf("got error %v, want %v", err, chunk.ErrChunkNotFound)
+	}
+
+	rejectOnGet = true
+	if _, err := s.Get(ch.Address()); err == nil {
+		t.Fatal("expected validation error on get")
+	} else if _, ok := err.(*forky.InvalidChunkError); !ok {
+		t.Fatalf("got error %v, want invalid chunk error", err)
+	}
+}
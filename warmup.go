@@ -0,0 +1,243 @@
+// Copyright 2019 The Swarm Authors
+// This file is part of the Swarm library.
+//
+// The Swarm library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The Swarm library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the Swarm library. If not, see <http://www.gnu.org/licenses/>.
+
+package forky
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ethersphere/swarm/chunk"
+)
+
+// WarmUpProgress contains the state of the chunk meta cache warm-up.
+type WarmUpProgress struct {
+	// Chunks is the number of chunks with meta read from MetaStore.
+	Chunks int64 `json:"chunks"`
+	// Cached is the number of chunks with meta added to the cache.
+	Cached int64 `json:"cached"`
+	// Total is the number of chunks in MetaStore when the warm-up started.
+	Total int  `json:"total"`
+	Done  bool `json:"done"`
+}
+
+// warmUp tracks the chunk meta cache warm-up. Meta returned by
+// MetaStore.Iterate may be changed before it is added to the cache, so
+// Deletes and compaction record changed addresses, before they change the
+// cache, and the warm-up skips them.
+type warmUp struct {
+	// counters are accessed atomically and they are the first
+	// fields to be aligned on 32-bit platforms
+	chunks  int64
+	cached  int64
+	total   int
+	changed map[string]struct{}
+	err     error
+	done    chan struct{}
+	mu      sync.Mutex
+}
+
+func newWarmUp() (w *warmUp) {
+	return &warmUp{
+		changed: make(map[string]struct{}),
+		done:    make(chan struct{}),
+	}
+}
+
+func (w *warmUp) change(addr chunk.Address) {
+	w.mu.Lock()
+	if w.changed != nil {
+		w.changed[string(addr)] = struct{}{}
+	}
+	w.mu.Unlock()
+}
+
+// add adds the meta to the cache if the address is not changed. Changes
+// are recorded under the same mutex, so the meta is either added before
+// the change, and then removed or replaced, or not added at all.
+func (w *warmUp) add(c *metaCache, addr chunk.Address, m *Meta) (added, full bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if _, ok := w.changed[string(addr)]; ok {
+		return false, false
+	}
+	if c.add(addr, m) {
+		return false, true
+	}
+	return true, false
+}
+
+func (w *warmUp) finish(err error) {
+	w.mu.Lock()
+	w.changed = nil
+	w.err = err
+	w.mu.Unlock()
+	close(w.done)
+}
+
+// RangeMetaStore is an optional MetaStore extension that iterates over chunk
+// meta in the address order, starting from the provided address. The cache
+// warm-up reads meta in batches with it, waiting between them outside of the
+// iteration. If MetaStore does not implement it, the warm-up reads meta in
+// a single iteration without the rate limit.
+type RangeMetaStore interface {
+	IterateFrom(start chunk.Address, fn func(chunk.Address, *Meta) (stop bool, err error)) error
+}
+
+// warmUpBatchSize is the maximal number of chunk meta entries read from
+// RangeMetaStore in a single iteration.
+const warmUpBatchSize = 1024
+
+type warmUpEntry struct {
+	addr chunk.Address
+	meta *Meta
+}
+
+// warmUpMetaCache adds chunk meta from MetaStore to the cache until it is
+// full, reading at most rate chunks per second if it is positive.
+func (s *Store) warmUpMetaCache(rate int) {
+	defer s.wg.Done()
+
+	w := s.warmUp
+	total, err := s.meta.Count()
+	if err != nil {
+		w.finish(err)
+		return
+	}
+	w.mu.Lock()
+	w.total = total
+	w.mu.Unlock()
+
+	r, ok := s.meta.(RangeMetaStore)
+	if !ok {
+		w.finish(s.meta.Iterate(func(addr chunk.Address, m *Meta) (stop bool, err error) {
+			select {
+			case <-s.quit:
+				return true, ErrDBClosed
+			default:
+			}
+			atomic.AddInt64(&w.chunks, 1)
+			added, full := w.add(s.metaCache, addr, m)
+			if added {
+				atomic.AddInt64(&w.cached, 1)
+			}
+			return full, nil
+		}))
+		return
+	}
+
+	batchSize := warmUpBatchSize
+	var interval time.Duration
+	if rate > 0 {
+		interval = time.Second / time.Duration(rate)
+		if rate < batchSize {
+			batchSize = rate
+		}
+	}
+	start := time.Now()
+	var (
+		from chunk.Address
+		read int
+	)
+	for {
+		if interval > 0 {
+			if d := time.Until(start.Add(time.Duration(read) * interval)); d > 0 {
+				select {
+				case <-s.quit:
+					w.finish(ErrDBClosed)
+					return
+				case <-time.After(d):
+				}
+			}
+		}
+		select {
+		case <-s.quit:
+			w.finish(ErrDBClosed)
+			return
+		default:
+		}
+		entries := make([]warmUpEntry, 0, batchSize)
+		if err := r.IterateFrom(from, func(addr chunk.Address, m *Meta) (stop bool, err error) {
+			entries = append(entries, warmUpEntry{
+				addr: append(chunk.Address(nil), addr...),
+				meta: m,
+			})
+			return len(entries) == batchSize, nil
+		}); err != nil {
+			w.finish(err)
+			return
+		}
+		read += len(entries)
+		atomic.AddInt64(&w.chunks, int64(len(entries)))
+		for _, e := range entries {
+			added, full := w.add(s.metaCache, e.addr, e.meta)
+			if full {
+				w.finish(nil)
+				return
+			}
+			if added {
+				atomic.AddInt64(&w.cached, 1)
+			}
+		}
+		if len(entries) < batchSize {
+			w.finish(nil)
+			return
+		}
+		// the next batch starts after the last address
+		from = append(entries[len(entries)-1].addr, 0)
+	}
+}
+
+// WarmUpWait waits until the chunk meta cache warm-up completes or the
+// context is done, returning the warm-up or the context error. It returns
+// ErrDBClosed if the store is closed before the warm-up completes.
+func (s *Store) WarmUpWait(ctx context.Context) (err error) {
+	if s.warmUp == nil {
+		return nil
+	}
+	select {
+	case <-s.warmUp.done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	s.warmUp.mu.Lock()
+	defer s.warmUp.mu.Unlock()
+
+	return s.warmUp.err
+}
+
+// WarmUpProgress returns the progress of the chunk meta cache warm-up. It
+// is reported as done if the warm-up is not enabled.
+func (s *Store) WarmUpProgress() (p WarmUpProgress) {
+	w := s.warmUp
+	if w == nil {
+		return WarmUpProgress{Done: true}
+	}
+	p.Chunks = atomic.LoadInt64(&w.chunks)
+	p.Cached = atomic.LoadInt64(&w.cached)
+	select {
+	case <-w.done:
+		p.Done = true
+	default:
+	}
+	w.mu.Lock()
+	p.Total = w.total
+	w.mu.Unlock()
+	return p
+}
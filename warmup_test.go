@@ -0,0 +1,152 @@
+// Copyright 2019 The Swarm Authors
+// This file is part of the Swarm library.
+//
+// The Swarm library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The Swarm library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the Swarm library. If not, see <http://www.gnu.org/licenses/>.
+
+package forky_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/ethersphere/swarm/chunk"
+	"github.com/janos/forky"
+	"github.com/janos/forky/mem"
+	"github.com/janos/forky/test"
+)
+
+func TestStoreWarmUp(t *testing.T) {
+	path, err := ioutil.TempDir("", "swarm-forky-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(path)
+
+	metaStore := &countingMetaStore{MetaStore: mem.NewMetaStore()}
+	s, err := forky.NewStore(path, chunk.DefaultSize, metaStore, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chunks := make([]chunk.Chunk, 20)
+	for i := range chunks {
+		chunks[i] = test.GenerateTestRandomChunk()
+		if err := s.Put(chunks[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if p := s.WarmUpProgress(); !p.Done {
+		t.Errorf("got progress %+v without warm-up, want done", p)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("complete", func(t *testing.T) {
+		s, err := forky.NewStore(path, chunk.DefaultSize, metaStore, &forky.Options{
+			WarmUp:     true,
+			WarmUpRate: 1000,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+
+		if err := s.WarmUpWait(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		want := forky.WarmUpProgress{
+			Chunks: int64(len(chunks)),
+			Cached: int64(len(chunks)),
+			Total:  len(chunks),
+			Done:   true,
+		}
+		if p := s.WarmUpProgress(); p != want {
+			t.Errorf("got progress %+v, want %+v", p, want)
+		}
+
+		gets := metaStore.gets
+		for _, ch := range chunks {
+			if _, err := s.Get(ch.Address()); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if got := metaStore.gets - gets; got != 0 {
+			t.Errorf("got %v MetaStore gets after warm-up", got)
+		}
+	})
+
+	t.Run("full cache", func(t *testing.T) {
+		// approximate size of five cache entries with 32 byte addresses
+		s, err := forky.NewStore(path, chunk.DefaultSize, metaStore, &forky.Options{
+			MetaCacheSize: 5 * 144,
+			WarmUp:        true,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+
+		if err := s.WarmUpWait(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if p := s.WarmUpProgress(); p.Cached != 5 || !p.Done {
+			t.Errorf("got progress %+v, want five cached chunks", p)
+		}
+		if stats := s.MetaCacheStats(); stats.Evictions != 0 {
+			t.Errorf("got %v cache evictions", stats.Evictions)
+		}
+	})
+
+	t.Run("close", func(t *testing.T) {
+		s, err := forky.NewStore(path, chunk.DefaultSize, metaStore, &forky.Options{
+			WarmUp:     true,
+			WarmUpRate: 1,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		if err := s.WarmUpWait(ctx); err != context.DeadlineExceeded {
+			t.Fatalf("got error %v, want %v", err, context.DeadlineExceeded)
+		}
+		// meta is read from MetaStore at the warm-up rate
+		if p := s.WarmUpProgress(); p.Chunks > 1 {
+			t.Errorf("got %v chunks read at rate 1", p.Chunks)
+		}
+		// deleted chunks are not added to the cache by the warm-up
+		for _, ch := range chunks[:5] {
+			if err := s.Delete(ch.Address()); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := s.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.WarmUpWait(context.Background()); err != forky.ErrDBClosed {
+			t.Errorf("got error %v, want %v", err, forky.ErrDBClosed)
+		}
+		if p := s.WarmUpProgress(); p.Cached == int64(len(chunks)) || !p.Done {
+			t.Errorf("got progress %+v, want interrupted", p)
+		}
+	})
+}
+
+func (s *countingMetaStore) IterateFrom(start chunk.Address, fn func(chunk.Address, *forky.Meta) (stop bool, err error)) error {
+	return s.MetaStore.(forky.RangeMetaStore).IterateFrom(start, fn)
+}